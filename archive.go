@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/backend-project/scan"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+type archiveRequest struct {
+	// one of Ids, FolderId or Tag picks the files
+	Ids      []uint `json:"ids"`
+	FolderId *uint  `json:"folder_id"`
+	Tag      string `json:"tag"`
+
+	// Format is zip (the default) or tar.gz
+	Format string `json:"format"`
+}
+
+// archiveEntry is a file and the path it gets inside the archive.
+type archiveEntry struct {
+	file File
+	name string
+	size int64
+}
+
+// sanitizeEntryName makes a file or folder name safe to use as one segment of an archive path.
+func sanitizeEntryName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == ':':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// dedupeEntryName adds " (1)", " (2)"... before the extension until the name is unused.
+// Names are compared case insensitively, so the archive extracts cleanly on any file system.
+func dedupeEntryName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	unique := name
+	for i := 1; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+// archiveFileName is the name a file gets in an archive, falling back to its storage name.
+func archiveFileName(file File) string {
+	if file.Name == "" {
+		return sanitizeEntryName(file.FilePath)
+	}
+	return sanitizeEntryName(file.Name)
+}
+
+// notQuarantined leaves out infected files, rows from before scanning existed have no scan status.
+func notQuarantined(db *gorm.DB) *gorm.DB {
+	return db.Where("scan_status IS NULL OR scan_status <> ?", scan.StatusInfected)
+}
+
+// scanPassed also leaves out files waiting to be scanned again, see scanRefusal.
+func scanPassed(db *gorm.DB) *gorm.DB {
+	return db.Where("scan_status IS NULL OR scan_status NOT IN ?", []string{scan.StatusInfected, scan.StatusError})
+}
+
+// archiveFolderEntries lists the files in folder and all its subfolders,
+// named with their path relative to folder.
+func (app *App) archiveFolderEntries(c *gin.Context, folder Folder) ([]archiveEntry, error) {
+	ids, err := app.descendantFolderIds(c, folder.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Folder
+	if err := app.db.WithContext(c).Where("id IN ?", ids).Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	foldersById := make(map[uint]Folder, len(folders))
+	for _, subfolder := range folders {
+		foldersById[subfolder.ID] = subfolder
+	}
+
+	// paths are built root first, the ids come back from descendantFolderIds parents before children
+	folderPaths := map[uint]string{folder.ID: ""}
+	for _, id := range ids[1:] {
+		subfolder, ok := foldersById[id]
+		if !ok || subfolder.ParentId == nil {
+			continue
+		}
+		folderPaths[id] = folderPaths[*subfolder.ParentId] + sanitizeEntryName(subfolder.Name) + "/"
+	}
+
+	var files []File
+	err = app.db.WithContext(c).
+		Where("folder_id IN ?", ids).Scopes(scanPassed).
+		Order("id").Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]archiveEntry, 0, len(files))
+	for _, file := range files {
+		entries = append(entries, archiveEntry{file: file, name: folderPaths[*file.FolderId] + archiveFileName(file)})
+	}
+	return entries, nil
+}
+
+// archiveEntries finds the files an archive request asks for, limited to what the caller can see.
+// It writes the error response itself, so the handler should just return when ok is false.
+func (app *App) archiveEntries(c *gin.Context, request archiveRequest) (entries []archiveEntry, archiveName string, ok bool) {
+	user, loggedIn := currentUser(c)
+
+	switch {
+	case len(request.Ids) > 0:
+		ids := uniqueIds(request.Ids)
+		if len(ids) > app.config.Limits.ArchiveMaxFiles {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many files, at most %d can be archived at once", app.config.Limits.ArchiveMaxFiles)})
+			return nil, "", false
+		}
+
+		var files []File
+		err := app.db.WithContext(c).Scopes(app.visibleFiles(c)).Where("id IN ?", ids).Find(&files).Error
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, "", false
+		}
+		filesById := make(map[uint]File, len(files))
+		for _, file := range files {
+			filesById[file.ID] = file
+		}
+
+		for _, id := range ids {
+			file, found := filesById[id]
+			if !found {
+				c.JSON(http.StatusNotFound, gin.H{"error": "file not found", "id": id})
+				return nil, "", false
+			}
+			if err := scanRefusal(file); err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "id": id})
+				return nil, "", false
+			}
+			entries = append(entries, archiveEntry{file: file, name: archiveFileName(file)})
+		}
+		archiveName = "files"
+
+	case request.FolderId != nil:
+		if !loggedIn {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "not logged in"})
+			return nil, "", false
+		}
+		folder, err := app.findFolder(c, *request.FolderId, user.ID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+			return nil, "", false
+		}
+
+		entries, err = app.archiveFolderEntries(c, folder)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, "", false
+		}
+		archiveName = sanitizeEntryName(folder.Name)
+
+	case request.Tag != "":
+		var files []File
+		err := app.db.WithContext(c).Scopes(app.visibleFiles(c)).
+			Where("id IN (?)", app.db.Table("user_tags").Select("file_id").
+				Joins("JOIN tags ON tags.id = user_tags.tag_id").
+				Where("tags.name = ? AND tags.deleted_at IS NULL", request.Tag)).
+			Scopes(scanPassed).
+			Order("id").Find(&files).Error
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, "", false
+		}
+		for _, file := range files {
+			entries = append(entries, archiveEntry{file: file, name: archiveFileName(file)})
+		}
+		archiveName = sanitizeEntryName(request.Tag)
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids, folder_id or tag is required"})
+		return nil, "", false
+	}
+
+	if len(entries) > app.config.Limits.ArchiveMaxFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many files, at most %d can be archived at once", app.config.Limits.ArchiveMaxFiles)})
+		return nil, "", false
+	}
+
+	used := make(map[string]bool, len(entries))
+	for i := range entries {
+		entries[i].name = dedupeEntryName(entries[i].name, used)
+	}
+
+	return entries, archiveName, true
+}
+
+// createArchive streams the requested files as a zip or tar.gz, straight from storage without temp files.
+func (app *App) createArchive(c *gin.Context) {
+	var request archiveRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Format == "" {
+		request.Format = archiveZip
+	}
+	if request.Format != archiveZip && request.Format != archiveTarGz {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or tar.gz"})
+		return
+	}
+
+	entries, archiveName, ok := app.archiveEntries(c, request)
+	if !ok {
+		return
+	}
+
+	// check every blob is there before the status code is sent, once streaming starts errors can't be reported
+	for i, entry := range entries {
+		info, err := app.store().Stat(c, storageKey(entry.file))
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file content is missing", "id": entry.file.ID})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entries[i].size = info.Size
+	}
+
+	contentType := "application/zip"
+	if request.Format == archiveTarGz {
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType(dispositionAttachment, map[string]string{"filename": archiveName + "." + request.Format}))
+	c.Status(http.StatusOK)
+
+	var err error
+	if request.Format == archiveTarGz {
+		err = app.writeTarGz(c, c.Writer, entries)
+	} else {
+		err = app.writeZip(c, c.Writer, entries)
+	}
+	app.metrics.countDownload(c)
+	if err != nil {
+		// the client sees a truncated archive, all that's left to do is stop
+		_ = c.Error(err)
+		c.Abort()
+	}
+}
+
+// copyEntry copies an entry's blob from storage to w.
+func (app *App) copyEntry(c *gin.Context, w io.Writer, entry archiveEntry) error {
+	content, err := app.store().Open(c, storageKey(entry.file))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (app *App) writeZip(c *gin.Context, w io.Writer, entries []archiveEntry) error {
+	archive := zip.NewWriter(w)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: entry.file.UpdatedAt}
+		header.SetMode(0o644)
+
+		entryWriter, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := app.copyEntry(c, entryWriter, entry); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func (app *App) writeTarGz(c *gin.Context, w io.Writer, entries []archiveEntry) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:    entry.name,
+			Mode:    0o644,
+			Size:    entry.size,
+			ModTime: entry.file.UpdatedAt,
+			Format:  tar.FormatPAX,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := app.copyEntry(c, archive, entry); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
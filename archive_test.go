@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveNames(t *testing.T) {
+	assert.Equal(t, "_", sanitizeEntryName(".."))
+	assert.Equal(t, "_etc_passwd", sanitizeEntryName("/etc/passwd"))
+	assert.Equal(t, "a_b.txt", sanitizeEntryName("a\\b.txt\x00"))
+
+	used := map[string]bool{}
+	assert.Equal(t, "a.txt", dedupeEntryName("a.txt", used))
+	assert.Equal(t, "A (1).txt", dedupeEntryName("A.txt", used))
+	assert.Equal(t, "a (2).txt", dedupeEntryName("a.txt", used))
+	assert.Equal(t, ".env", dedupeEntryName(".env", used))
+	assert.Equal(t, ".env (1)", dedupeEntryName(".env", used))
+}
+
+func TestCreateArchive(t *testing.T) {
+	defer cleanUp()
+
+	_, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+	otherCookie := registerTestUser(t, router, "other@test.com")
+
+	var a, b Folder
+	w := performJSON(router, "POST", "/folders", folderRequest{Name: "a"}, cookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &a))
+	w = performJSON(router, "POST", "/folders", folderRequest{Name: "b", ParentId: &a.ID}, cookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+
+	upload := func(cookie *http.Cookie, name string, content string, fields map[string]string) File {
+		fields["name"] = name
+		w := uploadTestFile(t, router, cookie, "testfile.txt", []byte(content), fields)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var file File
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+		return file
+	}
+	first := upload(cookie, "notes.txt", "first", map[string]string{"folder_id": fmt.Sprint(a.ID)})
+	second := upload(cookie, "notes.txt", "second", map[string]string{"folder_id": fmt.Sprint(b.ID)})
+	third := upload(cookie, "../notes.txt", "third", map[string]string{})
+	private := upload(otherCookie, "private.txt", "private", map[string]string{})
+
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{Ids: []uint{first.ID, second.ID, third.ID}}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, map[string]string{"notes.txt": "first", "notes (1).txt": "second", ".._notes.txt": "third"}, readZip(t, w.Body.Bytes()))
+
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{FolderId: &a.ID, Format: archiveTarGz}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename=a.tar.gz`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, map[string]string{"notes.txt": "first", "b/notes.txt": "second"}, readTarGz(t, w.Body.Bytes()))
+
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkTag, Ids: []uint{third.ID}, Tags: []string{"red"}}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{Tag: "red"}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{".._notes.txt": "third"}, readZip(t, w.Body.Bytes()))
+
+	// other people's files can't be added to an archive
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{Ids: []uint{first.ID, private.ID}}, cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{FolderId: &a.ID}, otherCookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{Ids: []uint{first.ID}, Format: "rar"}, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{}, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func readZip(t *testing.T, body []byte) map[string]string {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.NoError(t, err)
+
+	contents := map[string]string{}
+	for _, entry := range archive.File {
+		r, err := entry.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		contents[entry.Name] = string(content)
+	}
+	return contents
+}
+
+func readTarGz(t *testing.T, body []byte) map[string]string {
+	compressed, err := gzip.NewReader(bytes.NewReader(body))
+	assert.NoError(t, err)
+	archive := tar.NewReader(compressed)
+
+	contents := map[string]string{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, err := io.ReadAll(archive)
+		assert.NoError(t, err)
+		contents[header.Name] = string(content)
+	}
+	return contents
+}
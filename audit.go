@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errAuditAppendOnly = errors.New("audit logs can't be changed")
+
+// BeforeUpdate keeps the audit log append only, at least as far as gorm is concerned.
+func (AuditLog) BeforeUpdate(*gorm.DB) error {
+	return errAuditAppendOnly
+}
+
+// BeforeDelete keeps the audit log append only, at least as far as gorm is concerned.
+func (AuditLog) BeforeDelete(*gorm.DB) error {
+	return errAuditAppendOnly
+}
+
+// auditedUser is how users appear in the audit log, without their password hash or quota.
+type auditedUser struct {
+	ID    uint   `json:"id"`
+	Email string `json:"email"`
+}
+
+func auditJSON(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// audit records an action by the current user. Actions are named "<target type>.<verb>",
+// before and after are the target's state either side of a change, nil when there isn't one.
+func (app *App) audit(c *gin.Context, action string, targetId uint, before any, after any) {
+	actor, _ := currentUser(c)
+	app.auditAs(c, actor, action, targetId, before, after)
+}
+
+// auditAs records an action by actor, for requests where the actor isn't logged in yet.
+// The action has already happened, so a failure to record it is only logged.
+func (app *App) auditAs(c *gin.Context, actor User, action string, targetId uint, before any, after any) {
+	entry := newAuditLog(actor, action, targetId, before, after)
+	entry.IP = c.ClientIP()
+	entry.UserAgent = c.Request.UserAgent()
+	app.writeAudit(c, entry)
+}
+
+// auditCommand records an action taken with one of the admin commands, which have no user or request.
+func (app *App) auditCommand(ctx context.Context, action string, targetId uint, before any, after any) {
+	entry := newAuditLog(User{}, action, targetId, before, after)
+	entry.UserAgent = commandUserAgent
+	app.writeAudit(ctx, entry)
+}
+
+func newAuditLog(actor User, action string, targetId uint, before any, after any) AuditLog {
+	targetType, _, _ := strings.Cut(action, ".")
+	entry := AuditLog{
+		ActorEmail: actor.Email,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+	if actor.ID != 0 {
+		entry.ActorId = &actor.ID
+	}
+	return entry
+}
+
+func (app *App) writeAudit(ctx context.Context, entry AuditLog) {
+	if err := app.db.WithContext(ctx).Create(&entry).Error; err != nil {
+		logFor(ctx).Error("Writing audit log failed", "action", entry.Action, "error", err)
+	}
+}
+
+// auditFilters narrows the audit log by the query parameters actor_id, actor_email, action
+// (a full action or a target type like "file."), target_type, target_id, since and until.
+func auditFilters(c *gin.Context) (func(db *gorm.DB) *gorm.DB, error) {
+	var since, until time.Time
+	var err error
+	if raw := c.Query("since"); raw != "" {
+		if since, err = time.Parse(time.RFC3339, raw); err != nil {
+			return nil, errors.New("since must be an RFC 3339 time")
+		}
+	}
+	if raw := c.Query("until"); raw != "" {
+		if until, err = time.Parse(time.RFC3339, raw); err != nil {
+			return nil, errors.New("until must be an RFC 3339 time")
+		}
+	}
+
+	return func(db *gorm.DB) *gorm.DB {
+		if actorId := c.Query("actor_id"); actorId != "" {
+			db = db.Where("actor_id = ?", actorId)
+		}
+		if actorEmail := c.Query("actor_email"); actorEmail != "" {
+			db = db.Where("actor_email = ?", actorEmail)
+		}
+		if action := c.Query("action"); strings.HasSuffix(action, ".") {
+			db = startsWith(db, "action", action)
+		} else if action != "" {
+			db = db.Where("action = ?", action)
+		}
+		if targetType := c.Query("target_type"); targetType != "" {
+			db = db.Where("target_type = ?", targetType)
+		}
+		if targetId := c.Query("target_id"); targetId != "" {
+			db = db.Where("target_id = ?", targetId)
+		}
+		if !since.IsZero() {
+			db = db.Where("created_at >= ?", since)
+		}
+		if !until.IsZero() {
+			db = db.Where("created_at < ?", until)
+		}
+		return db
+	}, nil
+}
+
+// getAuditLogs lists audit log entries matching the filters, newest first.
+func (app *App) getAuditLogs(c *gin.Context) {
+	filters, err := auditFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var entries []AuditLog
+	err = app.db.WithContext(c).Scopes(filters, Paginate(c.Request)).Order("id DESC").Find(&entries).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// exportAuditLogs streams every matching entry as JSON Lines, oldest first.
+func (app *App) exportAuditLogs(c *gin.Context) {
+	filters, err := auditFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := app.db.WithContext(c).Model(&AuditLog{}).Scopes(filters).Order("id").Rows()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", mime.FormatMediaType(dispositionAttachment, map[string]string{"filename": "audit.jsonl"}))
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	for rows.Next() {
+		var entry AuditLog
+		if err := app.db.ScanRows(rows, &entry); err != nil {
+			_ = c.Error(err)
+			return
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		_ = c.Error(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	w := performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "wrong"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "POST", "/login", User{Email: "nobody@test.com", Password: "wrong"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = uploadTestFile(t, router, cookie, "testfile.txt", []byte("This is a test file content."), map[string]string{"name": "before"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	w = performJSON(router, "PATCH", fmt.Sprintf("/files/%d", file.ID), map[string]any{"name": "after"}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var entries []AuditLog
+	w = performJSON(router, "GET", "/admin/audit?action=user.login_failed", nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 2) {
+		// newest first, and a login for an unknown email has no actor id
+		assert.Equal(t, "nobody@test.com", entries[0].ActorEmail)
+		assert.Nil(t, entries[0].ActorId)
+		assert.Equal(t, "test@test.com", entries[1].ActorEmail)
+		assert.NotNil(t, entries[1].ActorId)
+	}
+
+	w = performJSON(router, "GET", fmt.Sprintf("/admin/audit?action=file.update&target_id=%d", file.ID), nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "file", entries[0].TargetType)
+		assert.Equal(t, "test@test.com", entries[0].ActorEmail)
+		var before, after File
+		assert.NoError(t, json.Unmarshal(entries[0].Before, &before))
+		assert.NoError(t, json.Unmarshal(entries[0].After, &after))
+		assert.Equal(t, "before", before.Name)
+		assert.Equal(t, "after", after.Name)
+	}
+
+	// a trailing dot matches every action on a target type
+	w = performJSON(router, "GET", "/admin/audit?action=file.", nil, adminCookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	assert.Len(t, entries, 2)
+
+	w = performJSON(router, "GET", "/admin/audit?since=yesterday", nil, adminCookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performJSON(router, "GET", "/admin/audit/export?target_type=user", nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	var actions []string
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var entry AuditLog
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []string{"user.register", "user.register", "user.login_failed", "user.login_failed"}, actions)
+
+	// the log can't be edited through gorm
+	var entry AuditLog
+	assert.NoError(t, app.db.First(&entry).Error)
+	assert.ErrorIs(t, app.db.Delete(&entry).Error, errAuditAppendOnly)
+	assert.ErrorIs(t, app.db.Model(&entry).Update("action", "nothing").Error, errAuditAppendOnly)
+
+	w = performJSON(router, "GET", "/admin/audit", nil, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performJSON(router, "GET", "/admin/audit", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
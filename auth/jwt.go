@@ -2,13 +2,13 @@ package auth
 
 import (
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func getRole(email string) string {
+// GetRole returns the role a user gets in their JWT audience.
+func GetRole(email string) string {
 	if email == "damien.z.hall@gmail.com" {
 		return "admin"
 	}
@@ -16,16 +16,17 @@ func getRole(email string) string {
 	return "default"
 }
 
-func GenerateJWT(email string) (string, error) {
+// GenerateJWT signs a token for email with secret that's good for an hour.
+func GenerateJWT(secret string, email string) (string, error) {
 	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub": email,
 		"iss": "snippet-app",
-		"aud": getRole(email),
+		"aud": GetRole(email),
 		"exp": time.Now().Add(time.Hour).Unix(),
 		"iat": time.Now().Unix(),
 	})
 
-	tokenString, err := claims.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokenString, err := claims.SignedString([]byte(secret))
 	if err != nil {
 		return "", err
 	}
@@ -33,9 +34,10 @@ func GenerateJWT(email string) (string, error) {
 	return tokenString, nil
 }
 
-func VerifyJWT(tokenString string) (*jwt.Token, error) {
+// VerifyJWT checks a token from GenerateJWT against the same secret.
+func VerifyJWT(secret string, tokenString string) (*jwt.Token, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
+		return []byte(secret), nil
 	})
 
 	if err != nil {
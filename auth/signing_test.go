@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignFileURL(t *testing.T) {
+	rotated := "new:new-secret,old:old-secret"
+	_, err := SignFileURL("", 1, time.Now().Add(time.Hour), "")
+	assert.ErrorIs(t, err, ErrSigningNotConfigured)
+
+	query, err := SignFileURL(rotated, 1, time.Now().Add(time.Hour), "inline")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", query.Get("kid"))
+	assert.NoError(t, VerifyFileURL(rotated, 1, query))
+
+	// signatures are tied to the file and disposition
+	assert.ErrorIs(t, VerifyFileURL(rotated, 2, query), ErrInvalidSignature)
+	query.Set("disposition", "attachment")
+	assert.ErrorIs(t, VerifyFileURL(rotated, 1, query), ErrInvalidSignature)
+
+	expired, err := SignFileURL(rotated, 1, time.Now().Add(-time.Minute), "")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, VerifyFileURL(rotated, 1, expired), ErrSignatureExpired)
+
+	// once rotated out, the old key's signatures stop working
+	oldQuery, err := SignFileURL("old:old-secret", 1, time.Now().Add(time.Hour), "")
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyFileURL(rotated, 1, oldQuery))
+	assert.ErrorIs(t, VerifyFileURL("new:new-secret", 1, oldQuery), ErrInvalidSignature)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	bulkDelete  = "delete"
+	bulkRestore = "restore"
+	bulkTag     = "tag"
+	bulkUntag   = "untag"
+	bulkMove    = "move"
+	bulkChown   = "chown"
+)
+
+// bulkEvents is the event published for each file a bulk action changes.
+var bulkEvents = map[string]string{
+	bulkDelete:  eventFileDeleted,
+	bulkRestore: eventFileRestored,
+	bulkTag:     eventFileUpdated,
+	bulkUntag:   eventFileUpdated,
+	bulkMove:    eventFileUpdated,
+	bulkChown:   eventFileUpdated,
+}
+
+var errBulkRolledBack = errors.New("batch rolled back")
+
+type bulkRequest struct {
+	Action string `json:"action"`
+	Ids    []uint `json:"ids"`
+
+	// Atomic rolls back the whole batch if any file fails, otherwise the files that worked are kept
+	Atomic bool `json:"atomic"`
+
+	// Tags is used by tag and untag
+	Tags []string `json:"tags"`
+
+	// FolderId is used by move, nil moves the files to the root
+	FolderId *uint `json:"folder_id"`
+
+	// UserId or Email pick the new owner for chown
+	UserId *uint  `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+type bulkResult struct {
+	Id      uint   `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// uniqueIds drops repeated ids, keeping the order they were asked for in.
+func uniqueIds(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// authorizeBulkFile checks the user may apply action to file.
+// Moving and changing ownership need the user to really own the file, not just the owner role admins have on public files.
+func (app *App) authorizeBulkFile(c *gin.Context, file File, user User, action string) error {
+	role, err := app.files.Role(c, file, user, true)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return errors.New("file not found")
+	}
+
+	switch action {
+	case bulkTag, bulkUntag:
+		if roleRanks[role] < roleRanks[roleEditor] {
+			return errors.New("you need " + roleEditor + " access to do that")
+		}
+	case bulkMove:
+		if file.UserId != user.ID {
+			return errors.New("only the owner can move a file")
+		}
+	case bulkChown:
+		if file.UserId != user.ID && userRole(user) != "admin" {
+			return errors.New("only the owner or an admin can change a file's owner")
+		}
+	default:
+		if role != roleOwner {
+			return errors.New("you need " + roleOwner + " access to do that")
+		}
+	}
+
+	return nil
+}
+
+// bulkFiles applies one action to many files in a single transaction.
+// Each file gets its own savepoint, so one bad file doesn't undo the rest unless the request is atomic.
+func (app *App) bulkFiles(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	var request bulkRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ids := uniqueIds(request.Ids)
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no file ids given"})
+		return
+	}
+	if maxItems := app.config.Limits.BulkMaxItems; len(ids) > maxItems {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many files, at most %d can be changed at once", maxItems)})
+		return
+	}
+
+	var apply func(tx *gorm.DB, file File) error
+	switch request.Action {
+	case bulkDelete:
+		apply = func(tx *gorm.DB, file File) error {
+			return tx.Delete(&file).Error
+		}
+	case bulkRestore:
+		apply = restoreFile
+	case bulkTag, bulkUntag:
+		if len(request.Tags) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no tags given"})
+			return
+		}
+		apply = func(tx *gorm.DB, file File) error {
+			return tagFile(tx, file, request.Tags, request.Action == bulkTag)
+		}
+	case bulkMove:
+		if request.FolderId != nil {
+			if _, err := app.findFolder(c, *request.FolderId, user.ID); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+				return
+			}
+		}
+		apply = func(tx *gorm.DB, file File) error {
+			return tx.Model(&file).Update("folder_id", request.FolderId).Error
+		}
+	case bulkChown:
+		newOwner, err := app.findUser(c, request.UserId, request.Email)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		apply = func(tx *gorm.DB, file File) error {
+			return chownFile(tx, file, newOwner, app.userQuota(newOwner))
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown action " + strconv.Quote(request.Action)})
+		return
+	}
+
+	// restoring works on soft deleted files, everything else only on live ones
+	query := app.db.WithContext(c)
+	if request.Action == bulkRestore {
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+	var files []File
+	if err := query.Where("id IN ?", ids).Find(&files).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filesById := make(map[uint]File, len(files))
+	for _, file := range files {
+		filesById[file.ID] = file
+	}
+
+	results := make([]bulkResult, 0, len(ids))
+	failed := 0
+	err := app.transaction(c, func(tx *gorm.DB) error {
+		for _, id := range ids {
+			result := bulkResult{Id: id}
+
+			err := errors.New("file not found")
+			if file, ok := filesById[id]; ok {
+				err = app.authorizeBulkFile(c, file, user, request.Action)
+				if err == nil {
+					err = tx.Transaction(func(tx *gorm.DB) error {
+						if err := apply(tx, file); err != nil {
+							return err
+						}
+						return app.publishFileEvent(tx, bulkEvents[request.Action], file.ID)
+					})
+				}
+			}
+
+			if err != nil {
+				result.Error = err.Error()
+				failed++
+			} else {
+				result.Success = true
+			}
+			results = append(results, result)
+
+			if err != nil && request.Atomic {
+				return errBulkRolledBack
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errBulkRolledBack) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no files were changed", "results": results})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// each file gets its own entry, so the log can be searched by target like any other change
+	details := gin.H{"tags": request.Tags, "folder_id": request.FolderId, "user_id": request.UserId, "email": request.Email}
+	for _, result := range results {
+		if result.Success {
+			app.audit(c, "file.bulk_"+request.Action, result.Id, filesById[result.Id], details)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results, "succeeded": len(ids) - failed, "failed": failed})
+}
+
+// restoreFile undoes a soft delete. A file whose folder has since been deleted goes back to the root.
+func restoreFile(tx *gorm.DB, file File) error {
+	changes := map[string]any{"deleted_at": nil}
+	if file.FolderId != nil {
+		err := tx.Where("id = ?", *file.FolderId).First(&Folder{}).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			changes["folder_id"] = nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return tx.Unscoped().Model(&File{}).Where("id = ?", file.ID).Updates(changes).Error
+}
+
+// tagFile adds or removes tags by name, creating tags that don't exist yet when adding.
+func tagFile(tx *gorm.DB, file File, names []string, add bool) error {
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		var tag Tag
+		var err error
+		if add {
+			err = tx.Where(Tag{Name: name}).FirstOrCreate(&tag).Error
+		} else {
+			err = tx.Where("name = ?", name).Find(&tag).Error
+		}
+		if err != nil {
+			return err
+		}
+		if tag.ID != 0 {
+			tags = append(tags, tag)
+		}
+	}
+
+	if !add {
+		if len(tags) == 0 {
+			return nil
+		}
+		return tx.Model(&file).Association("Tags").Delete(tags)
+	}
+	return tx.Model(&file).Omit("Tags.*").Association("Tags").Append(tags)
+}
+
+// chownFile gives a file to a new owner, moving its usage across. The file leaves its folder,
+// since folders belong to the old owner.
+func chownFile(tx *gorm.DB, file File, newOwner User, quota Quota) error {
+	if file.UserId == newOwner.ID {
+		return nil
+	}
+
+	oldOwnerId := file.UserId
+	err := tx.Model(&file).Updates(map[string]any{"user_id": newOwner.ID, "folder_id": nil}).Error
+	if err != nil {
+		return err
+	}
+
+	if err := adjustUsage(tx, oldOwnerId, -file.Size, -1, Quota{}); err != nil {
+		return err
+	}
+	return adjustUsage(tx, newOwner.ID, file.Size, 1, quota)
+}
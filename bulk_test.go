@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type bulkResponse struct {
+	Error     string       `json:"error"`
+	Results   []bulkResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+}
+
+func TestBulkFiles(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+	otherCookie := registerTestUser(t, router, "other@test.com")
+	content := []byte("This is a test file content.")
+
+	var ids []uint
+	for _, name := range []string{"one", "two", "three"} {
+		w := uploadTestFile(t, router, cookie, "testfile.txt", content, map[string]string{"name": name})
+		assert.Equal(t, http.StatusOK, w.Code)
+		var file File
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+		ids = append(ids, file.ID)
+	}
+	w := uploadTestFile(t, router, otherCookie, "testfile.txt", content, map[string]string{"name": "other"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var otherFile File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &otherFile))
+
+	var response bulkResponse
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkTag, Ids: ids, Tags: []string{"red", "blue"}}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 3, response.Succeeded)
+
+	file, err := gorm.G[File](app.db).Preload("Tags", nil).Where("id = ?", ids[0]).First(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, file.Tags, 2)
+
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkUntag, Ids: ids[:1], Tags: []string{"red"}}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	file, err = gorm.G[File](app.db).Preload("Tags", nil).Where("id = ?", ids[0]).First(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, file.Tags, 1)
+
+	// files the user can't see fail on their own, the rest still go through
+	response = bulkResponse{}
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkDelete, Ids: []uint{ids[0], otherFile.ID, 9999}}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Succeeded)
+	assert.Equal(t, 2, response.Failed)
+	assert.Equal(t, "file not found", response.Results[1].Error)
+
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d", ids[0]), nil, cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// atomic batches are all or nothing
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkDelete, Ids: []uint{ids[1], otherFile.ID}, Atomic: true}, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d", ids[1]), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkRestore, Ids: ids[:1]}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d", ids[0]), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var folder Folder
+	w = performJSON(router, "POST", "/folders", folderRequest{Name: "a"}, cookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &folder))
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkMove, Ids: ids, FolderId: &folder.ID}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	file, err = gorm.G[File](app.db).Where("id = ?", ids[2]).First(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, folder.ID, *file.FolderId)
+
+	// changing owner moves the usage across and takes the file out of the old owner's folder
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkChown, Ids: ids[2:], Email: "other@test.com"}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	file, err = gorm.G[File](app.db).Where("id = ?", ids[2]).First(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, otherFile.UserId, file.UserId)
+	assert.Nil(t, file.FolderId)
+
+	usage, err := app.files.Usage(context.TODO(), otherFile.UserId)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), usage.Files)
+
+	app.config.Limits.BulkMaxItems = 2
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkDelete, Ids: ids}, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: "explode", Ids: ids[:1]}, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkDelete, Ids: ids[:1]}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
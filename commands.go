@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/backend-project/auth"
+	"github.com/backend-project/jobs"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// commandUserAgent is what the audit log shows for changes made with the admin commands.
+const commandUserAgent = "backend-project command"
+
+// command is one of the admin commands run as "backend-project <name> [args]", with the same App as the server.
+type command func(ctx context.Context, app *App, args []string, w io.Writer) error
+
+var commands = map[string]command{
+	"migrate": func(ctx context.Context, app *App, args []string, w io.Writer) error {
+		return migrateCommand(ctx, app.db, args, w)
+	},
+	"user":  userCommand,
+	"files": filesCommand,
+}
+
+const commandUsage = `Usage: backend-project [flags] [command]
+
+Commands:
+  serve                                   serve the API, the default
+  migrate up | down [steps] | status      apply, undo or list database migrations
+  user create [-role role] <email>        create a user with a random password
+  user promote <email> [role]             give a user a role, admin unless another one is named
+  user disable <email>                    stop a user logging in, their sessions end straight away
+  user enable <email>                     let a disabled user log in again
+  user reset-password <email>             give a user a new random password
+  files reindex                           recount storage usage and queue hashing for files without a checksum
+  files verify [-checksums] [-json]       check storage for missing, damaged and orphaned uploads
+               [-quarantine-orphans] [-mark-broken] [-orphan-age 24h]
+  files purge [-older-than 720h]          permanently delete files that were deleted before then
+  config check                            validate the configuration
+  config print                            print the configuration with secrets redacted
+
+Flags:
+`
+
+// configCommand runs "config check" and "config print". It gets the config even when it's invalid,
+// with configErr saying why.
+func configCommand(config *Config, configErr error, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: config check | print")
+	}
+
+	switch args[0] {
+	case "check":
+		if configErr != nil {
+			return configErr
+		}
+		fmt.Fprintln(w, "configuration is valid")
+		return nil
+	case "print":
+		if err := config.print(w); err != nil {
+			return err
+		}
+		return configErr
+	default:
+		return fmt.Errorf("unknown config command %q, it's check or print", args[0])
+	}
+}
+
+func userCommand(ctx context.Context, app *App, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: user create | promote | disable | enable | reset-password")
+	}
+
+	switch args[0] {
+	case "create":
+		return app.createUserCommand(ctx, args[1:], w)
+	case "promote":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("usage: user promote <email> [role]")
+		}
+		role := "admin"
+		if len(args) == 3 {
+			role = args[2]
+		}
+		return app.promoteUser(ctx, args[1], role, w)
+	case "disable", "enable":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: user %s <email>", args[0])
+		}
+		return app.setUserDisabled(ctx, args[1], args[0] == "disable", w)
+	case "reset-password":
+		if len(args) != 2 {
+			return errors.New("usage: user reset-password <email>")
+		}
+		return app.resetPassword(ctx, args[1], w)
+	default:
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+}
+
+// validRole keeps roles to names that work in QUOTA_BYTES_<ROLE> variables.
+var validRole = regexp.MustCompile(`^[a-z][a-z0-9_]{0,19}$`)
+
+func (app *App) userByEmail(ctx context.Context, email string) (User, error) {
+	user, err := gorm.G[User](app.db).Where("email = ?", email).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, fmt.Errorf("there's no user with the email %s", email)
+	}
+	return user, err
+}
+
+func (app *App) createUserCommand(ctx context.Context, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	role := flags.String("role", "", "role to give the user, by default the one for their email")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: user create [-role role] <email>")
+	}
+	if *role != "" && !validRole.MatchString(*role) {
+		return fmt.Errorf("%q isn't a valid role", *role)
+	}
+
+	password, err := auth.RandomToken()
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+
+	user := User{Email: flags.Arg(0), Password: hash, Role: *role}
+	if err := app.db.WithContext(ctx).Create(&user).Error; err != nil {
+		return err
+	}
+	app.auditCommand(ctx, "user.create", user.ID, nil, auditedUser{ID: user.ID, Email: user.Email})
+
+	fmt.Fprintf(w, "created user %d %s with the role %s and the password\n%s\n", user.ID, user.Email, userRole(user), password)
+	return nil
+}
+
+func (app *App) promoteUser(ctx context.Context, email string, role string, w io.Writer) error {
+	if !validRole.MatchString(role) {
+		return fmt.Errorf("%q isn't a valid role", role)
+	}
+	user, err := app.userByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	before := userRole(user)
+	if err := app.db.WithContext(ctx).Model(&user).Update("role", role).Error; err != nil {
+		return err
+	}
+	app.auditCommand(ctx, "user.promote", user.ID, gin.H{"role": before}, gin.H{"role": role})
+
+	fmt.Fprintf(w, "%s is now %s, was %s\n", user.Email, role, before)
+	return nil
+}
+
+func (app *App) setUserDisabled(ctx context.Context, email string, disabled bool, w io.Writer) error {
+	user, err := app.userByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	var disabledAt *time.Time
+	action, done := "user.enable", "enabled"
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+		action, done = "user.disable", "disabled"
+	}
+	if err := app.db.WithContext(ctx).Model(&user).Update("disabled_at", disabledAt).Error; err != nil {
+		return err
+	}
+	app.auditCommand(ctx, action, user.ID, nil, nil)
+
+	fmt.Fprintf(w, "%s %s\n", done, user.Email)
+	return nil
+}
+
+func (app *App) resetPassword(ctx context.Context, email string, w io.Writer) error {
+	user, err := app.userByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	password, err := auth.RandomToken()
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	if err := app.db.WithContext(ctx).Model(&user).Update("password", hash).Error; err != nil {
+		return err
+	}
+	app.auditCommand(ctx, "user.reset_password", user.ID, nil, nil)
+
+	fmt.Fprintf(w, "the new password for %s is\n%s\n", user.Email, password)
+	return nil
+}
+
+func filesCommand(ctx context.Context, app *App, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: files reindex | verify | purge")
+	}
+
+	switch args[0] {
+	case "reindex":
+		return app.reindexFiles(ctx, w)
+	case "verify":
+		defaults := app.verifyOptions()
+		flags := flag.NewFlagSet("files verify", flag.ContinueOnError)
+		options := verifyOptions{}
+		flags.BoolVar(&options.Checksums, "checksums", defaults.Checksums, "rehash every file instead of only comparing sizes")
+		flags.BoolVar(&options.QuarantineOrphans, "quarantine-orphans", defaults.QuarantineOrphans, "move blobs that belong to no file to "+orphanPrefix)
+		flags.BoolVar(&options.MarkBroken, "mark-broken", defaults.MarkBroken, "set the integrity status of files that are missing or damaged")
+		flags.DurationVar(&options.OrphanAge, "orphan-age", defaults.OrphanAge, "how old a blob without a file has to be to count as an orphan")
+		asJSON := flags.Bool("json", false, "print the report as JSON")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return app.verifyFiles(ctx, options, *asJSON, w)
+	case "purge":
+		flags := flag.NewFlagSet("files purge", flag.ContinueOnError)
+		olderThan := flags.Duration("older-than", 30*24*time.Hour, "how long ago files must have been deleted")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return app.purgeDeletedFiles(ctx, time.Now().Add(-*olderThan), w)
+	default:
+		return fmt.Errorf("unknown files command %q", args[0])
+	}
+}
+
+// reindexFiles recounts every user's usage from their files, soft deleted ones included, and queues
+// hashing for files that never got a checksum. Files from before sizes were recorded are sized
+// from storage first, so they count towards usage.
+func (app *App) reindexFiles(ctx context.Context, w io.Writer) error {
+	sized, err := app.sizeUnsizedFiles(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "sized %d files from storage\n", sized)
+
+	// the totals are read in the transaction that rewrites usage, so uploads and purges adjusting it
+	// meanwhile aren't lost
+	var users int64
+	err = app.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&Usage{}).Error; err != nil {
+			return err
+		}
+		result := tx.Exec("INSERT INTO usages (user_id, updated_at, bytes, files) "+
+			"SELECT user_id, ?, COALESCE(SUM(size), 0), COUNT(*) FROM files WHERE user_id <> 0 GROUP BY user_id", time.Now())
+		users = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "recounted usage for %d users\n", users)
+
+	// files that already have a hash job waiting aren't queued again
+	hashing, err := app.pendingFileJobs(ctx, jobHashFile)
+	if err != nil {
+		return err
+	}
+
+	var unhashed []File
+	err = app.db.WithContext(ctx).Where("checksum = '' OR checksum IS NULL").
+		Scopes(notQuarantined).Find(&unhashed).Error
+	if err != nil {
+		return err
+	}
+	queued := 0
+	for _, file := range unhashed {
+		if hashing[file.ID] {
+			continue
+		}
+		_, err := app.jobs.Enqueue(ctx, jobs.Spec{Type: jobHashFile, Payload: fileJobPayload{FileId: file.ID}})
+		if err != nil {
+			return err
+		}
+		queued++
+	}
+	fmt.Fprintf(w, "queued hashing for %d files\n", queued)
+	return nil
+}
+
+// pendingFileJobs is the set of files with a job of jobType that's waiting or running.
+func (app *App) pendingFileJobs(ctx context.Context, jobType string) (map[uint]bool, error) {
+	var pending []jobs.Job
+	err := app.db.WithContext(ctx).Where("type = ? AND status IN ?", jobType, []string{jobs.StatusPending, jobs.StatusRunning}).
+		Find(&pending).Error
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[uint]bool, len(pending))
+	for _, job := range pending {
+		var payload fileJobPayload
+		if err := job.Decode(&payload); err != nil {
+			return nil, err
+		}
+		files[payload.FileId] = true
+	}
+	return files, nil
+}
+
+// sizeUnsizedFiles records the size of files that have none, the ones made before there were
+// migrations, from their blobs. Files whose blob is missing are left for files verify to report.
+func (app *App) sizeUnsizedFiles(ctx context.Context) (int, error) {
+	var unsized []File
+	if err := app.db.WithContext(ctx).Unscoped().Where("size IS NULL").Find(&unsized).Error; err != nil {
+		return 0, err
+	}
+
+	sized := 0
+	for _, file := range unsized {
+		info, err := app.store().Stat(ctx, storageKey(file))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return sized, err
+		}
+		err = app.db.WithContext(ctx).Model(&File{}).Unscoped().Where("id = ?", file.ID).Update("size", info.Size).Error
+		if err != nil {
+			return sized, err
+		}
+		sized++
+	}
+	return sized, nil
+}
+
+// purgeDeletedFiles permanently deletes the files that were soft deleted before cutoff.
+func (app *App) purgeDeletedFiles(ctx context.Context, cutoff time.Time, w io.Writer) error {
+	var files []File
+	err := app.db.WithContext(ctx).Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).Find(&files).Error
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := app.purge(ctx, file); err != nil {
+			return fmt.Errorf("purging file %d: %w", file.ID, err)
+		}
+		app.auditCommand(ctx, "file.purge", file.ID, file, nil)
+	}
+
+	fmt.Fprintf(w, "purged %d files deleted before %s\n", len(files), cutoff.Format(time.RFC3339))
+	return nil
+}
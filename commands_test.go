@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/backend-project/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+func runTestCommand(app *App, name string, args ...string) (string, error) {
+	var output bytes.Buffer
+	err := commands[name](context.Background(), app, args, &output)
+	return output.String(), err
+}
+
+func TestUserCommand(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	output, err := runTestCommand(app, "user", "create", "-role", "auditor", "new@test.com")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "new@test.com with the role auditor")
+	password := strings.TrimSpace(output[strings.LastIndex(strings.TrimSpace(output), "\n"):])
+	w := performJSON(router, "POST", "/login", User{Email: "new@test.com", Password: password}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, err = runTestCommand(app, "user", "create", "-role", "Not A Role", "other@test.com")
+	assert.Error(t, err)
+
+	// promoting gives admin unless another role is named
+	w = performJSON(router, "GET", "/admin/jobs", nil, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	output, err = runTestCommand(app, "user", "promote", "test@test.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "test@test.com is now admin, was default\n", output)
+	w = performJSON(router, "GET", "/admin/jobs", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// disabling ends sessions that are already open and stops new ones
+	_, err = runTestCommand(app, "user", "disable", "test@test.com")
+	assert.NoError(t, err)
+	w = performJSON(router, "GET", "/me/usage", nil, cookie)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "secret"}, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "wrong"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the password is still checked first")
+
+	_, err = runTestCommand(app, "user", "enable", "test@test.com")
+	assert.NoError(t, err)
+	w = performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "secret"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	output, err = runTestCommand(app, "user", "reset-password", "test@test.com")
+	assert.NoError(t, err)
+	password = strings.TrimSpace(output[strings.Index(output, "\n"):])
+	w = performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "secret"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: password}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, err = runTestCommand(app, "user", "disable", "nobody@test.com")
+	assert.ErrorContains(t, err, "there's no user with the email nobody@test.com")
+	_, err = runTestCommand(app, "user", "promote")
+	assert.Error(t, err)
+
+	// every change is in the audit log as made by a command
+	var entries []AuditLog
+	assert.NoError(t, app.db.Where("user_agent = ?", commandUserAgent).Order("id").Find(&entries).Error)
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []string{"user.create", "user.promote", "user.disable", "user.enable", "user.reset_password"}, actions)
+}
+
+func TestFilesCommand(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	uploaded := make([]File, 3)
+	for i := range uploaded {
+		w := uploadTestFile(t, router, cookie, fmt.Sprintf("file%d.txt", i), []byte("This is a test file content."), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &uploaded[i]))
+	}
+	runJobs(t, app)
+
+	output, err := runTestCommand(app, "files", "verify")
+	assert.NoError(t, err)
+	assert.Equal(t, "checked 3 files and 3 blobs, 0 problems\n", output)
+
+	// reindex puts usage that's drifted back and hashes files that were missed, including ones
+	// from before scanning that have no scan status
+	assert.NoError(t, app.db.Model(&Usage{}).Where("user_id = ?", uploaded[0].UserId).Update("bytes", 1).Error)
+	assert.NoError(t, app.db.Model(&File{}).Where("id = ?", uploaded[0].ID).Update("checksum", "").Error)
+	assert.NoError(t, app.db.Model(&File{}).Where("id = ?", uploaded[1].ID).Updates(map[string]any{"checksum": nil, "scan_status": nil}).Error)
+	// and files without a size, from before there were migrations, are sized from storage
+	assert.NoError(t, app.db.Model(&File{}).Where("id = ?", uploaded[2].ID).Update("size", nil).Error)
+	output, err = runTestCommand(app, "files", "verify")
+	assert.NoError(t, err)
+	assert.Equal(t, "checked 3 files and 3 blobs, 0 problems\n", output)
+	output, err = runTestCommand(app, "files", "reindex")
+	assert.NoError(t, err)
+	assert.Equal(t, "sized 1 files from storage\nrecounted usage for 1 users\nqueued hashing for 2 files\n", output)
+	var usage Usage
+	assert.NoError(t, app.db.Where("user_id = ?", uploaded[0].UserId).First(&usage).Error)
+	assert.Equal(t, int64(3*len("This is a test file content.")), usage.Bytes)
+	var pending int64
+	assert.NoError(t, app.db.Model(&jobs.Job{}).Where("type = ? AND status = ?", jobHashFile, jobs.StatusPending).Count(&pending).Error)
+	assert.Equal(t, int64(2), pending)
+
+	// running it again doesn't queue the same hashing twice
+	output, err = runTestCommand(app, "files", "reindex")
+	assert.NoError(t, err)
+	assert.Equal(t, "sized 0 files from storage\nrecounted usage for 1 users\nqueued hashing for 0 files\n", output)
+	assert.NoError(t, app.db.Model(&jobs.Job{}).Where("type = ? AND status = ?", jobHashFile, jobs.StatusPending).Count(&pending).Error)
+	assert.Equal(t, int64(2), pending)
+
+	// verify reports missing and truncated uploads
+	assert.NoError(t, app.store().Delete(context.Background(), storageKey(uploaded[1])))
+	_, err = app.store().Put(context.Background(), storageKey(uploaded[2]), strings.NewReader("short"))
+	assert.NoError(t, err)
+	output, err = runTestCommand(app, "files", "verify")
+	assert.Error(t, err)
+	assert.Contains(t, output, fmt.Sprintf("file %d: %s is missing\n", uploaded[1].ID, storageKey(uploaded[1])))
+	assert.Contains(t, output, fmt.Sprintf("file %d: %s is 5 bytes, expected 28\n", uploaded[2].ID, storageKey(uploaded[2])))
+
+	// purge only takes files deleted long enough ago
+	w := performJSON(router, "DELETE", fmt.Sprintf("/files/%d", uploaded[0].ID), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	output, err = runTestCommand(app, "files", "purge")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "purged 0 files")
+	output, err = runTestCommand(app, "files", "purge", "-older-than", "0s")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "purged 1 files")
+	var count int64
+	assert.NoError(t, app.db.Unscoped().Model(&File{}).Where("id = ?", uploaded[0].ID).Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestConfigCommand(t *testing.T) {
+	config := defaultConfig()
+	var output bytes.Buffer
+	assert.NoError(t, configCommand(config, nil, []string{"check"}, &output))
+	assert.Equal(t, "configuration is valid\n", output.String())
+
+	// print still shows an invalid config, with the reason it's invalid
+	invalid := fmt.Errorf("server.read_timeout must be positive")
+	output.Reset()
+	assert.Equal(t, invalid, configCommand(config, invalid, []string{"print"}, &output))
+	assert.Contains(t, output.String(), "environment:")
+	assert.Equal(t, invalid, configCommand(config, invalid, []string{"check"}, &output))
+
+	assert.Error(t, configCommand(config, nil, nil, &output))
+	assert.Error(t, configCommand(config, nil, []string{"edit"}, &output))
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const environmentTest = "TEST"
+
+// Config is every setting the app reads. Each field can come from the config file under its yaml
+// key and from the environment variable in its env tag, the environment wins. Fields tagged secret
+// are redacted when the config is printed.
+type Config struct {
+	// Environment is PRODUCTION or TEST. TEST uses SQLite in test.db unless a database driver is set.
+	Environment string `yaml:"environment" env:"ENVIRONMENT"`
+	// MigrateOnStart applies pending migrations before serving. Turn it off to run "migrate up" as its own step.
+	MigrateOnStart bool `yaml:"migrate_on_start" env:"MIGRATE_ON_START"`
+	// PublicURL is where clients reach the API, used in presigned links. Empty uses the request's host.
+	PublicURL string `yaml:"public_url" env:"PUBLIC_URL"`
+
+	Database DatabaseConfig `yaml:"database"`
+	Server   ServerConfig   `yaml:"server"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Log      LogConfig      `yaml:"log"`
+	Uploads  UploadConfig   `yaml:"uploads"`
+	Import   importLimits   `yaml:"import"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Verify   VerifyConfig   `yaml:"verify"`
+
+	// Quotas are per role, keyed by the lower case role name. Roles without one are unlimited.
+	Quotas map[string]Quota `yaml:"quotas"`
+
+	// JobWorkers is how many background jobs this process runs at once, 0 runs none.
+	JobWorkers        int           `yaml:"job_workers" env:"JOB_WORKERS"`
+	ReadyCheckTimeout time.Duration `yaml:"ready_check_timeout" env:"READY_CHECK_TIMEOUT"`
+}
+
+type DatabaseConfig struct {
+	// Driver is mysql, postgres or sqlite.
+	Driver string `yaml:"driver" env:"DATABASE_DRIVER"`
+	// DSN is the connection string, for SQLite the database file.
+	DSN string `yaml:"dsn" env:"DSN" secret:"true"`
+	// Replicas are the DSNs of read replicas, file listings are read from them. They can lag behind
+	// the primary, so nothing that's just been written is read back from them.
+	Replicas []string `yaml:"replicas" env:"DB_REPLICAS" secret:"true"`
+
+	// The pool settings apply to the primary and to each replica, 0 is unlimited.
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+	// ConnectTimeout is how long to keep retrying at startup when the database isn't up yet.
+	ConnectTimeout time.Duration `yaml:"connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+}
+
+type AuthConfig struct {
+	JWTSecret string `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	// URLSigningKeys is a comma separated list of id:secret pairs for presigned links, the first one signs.
+	URLSigningKeys string `yaml:"url_signing_keys" env:"URL_SIGNING_KEYS" secret:"true"`
+	// CookieDomain is the token cookie's domain, empty keeps it to the host that set it.
+	CookieDomain string `yaml:"cookie_domain" env:"COOKIE_DOMAIN"`
+	CookieSecure bool   `yaml:"cookie_secure" env:"COOKIE_SECURE"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// Format is text for key=value lines or json.
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type UploadConfig struct {
+	// Path is the directory uploads are saved to.
+	Path              string   `yaml:"path" env:"UPLOAD_PATH"`
+	AllowedTypes      []string `yaml:"allowed_mime_types" env:"ALLOWED_MIME_TYPES"`
+	DeniedTypes       []string `yaml:"denied_mime_types" env:"DENIED_MIME_TYPES"`
+	AllowedExtensions []string `yaml:"allowed_extensions" env:"ALLOWED_EXTENSIONS"`
+	DeniedExtensions  []string `yaml:"denied_extensions" env:"DENIED_EXTENSIONS"`
+	// ThumbnailSizes are the sizes in pixels thumbnails are made at, the first is the default.
+	ThumbnailSizes []int `yaml:"thumbnail_sizes" env:"THUMBNAIL_SIZES"`
+	// ClamAVAddress is clamd's address, uploads aren't scanned without one.
+	ClamAVAddress string `yaml:"clamav_address" env:"CLAMAV_ADDRESS"`
+}
+
+type LimitsConfig struct {
+	BulkMaxItems    int `yaml:"bulk_max_items" env:"BULK_MAX_ITEMS"`
+	ArchiveMaxFiles int `yaml:"archive_max_files" env:"ARCHIVE_MAX_FILES"`
+	// EventLogSize is how many events are kept for clients resuming with Last-Event-ID.
+	EventLogSize int `yaml:"event_log_size" env:"EVENT_LOG_SIZE"`
+}
+
+type MetricsConfig struct {
+	// Address serves /metrics on its own listener. Empty serves it on the main router instead.
+	Address string `yaml:"address" env:"METRICS_ADDRESS"`
+	Token   string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+// VerifyConfig is for the storage verifier, "files verify" uses it for the defaults of its flags.
+type VerifyConfig struct {
+	// Interval is how often the verifier runs as a background job, 0 turns it off.
+	Interval time.Duration `yaml:"interval" env:"VERIFY_INTERVAL"`
+	// Checksums rehashes every file, which reads all of storage. Without it only sizes are compared.
+	Checksums         bool `yaml:"checksums" env:"VERIFY_CHECKSUMS"`
+	QuarantineOrphans bool `yaml:"quarantine_orphans" env:"VERIFY_QUARANTINE_ORPHANS"`
+	MarkBroken        bool `yaml:"mark_broken" env:"VERIFY_MARK_BROKEN"`
+	// OrphanAge is how old a blob without a file has to be before it's reported.
+	OrphanAge time.Duration `yaml:"orphan_age" env:"VERIFY_ORPHAN_AGE"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Environment:    "PRODUCTION",
+		MigrateOnStart: true,
+		Database: DatabaseConfig{
+			MaxOpenConns:    25,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			ConnectTimeout:  time.Minute,
+		},
+		Server: ServerConfig{
+			Address:           ":8080",
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Log:     LogConfig{Level: "info", Format: "text"},
+		Uploads: UploadConfig{Path: "./files", ThumbnailSizes: []int{128, 512}},
+		Import:  importLimits{MaxEntries: 1000, MaxBytes: 1 << 30, MaxRatio: 100},
+		Limits:  LimitsConfig{BulkMaxItems: 500, ArchiveMaxFiles: 1000, EventLogSize: 10000},
+		Verify:  VerifyConfig{Interval: 24 * time.Hour, OrphanAge: 24 * time.Hour},
+		Quotas:  map[string]Quota{},
+
+		JobWorkers:        2,
+		ReadyCheckTimeout: 2 * time.Second,
+	}
+}
+
+// loadConfig starts from the defaults and applies the file at path (if there is one), then .env,
+// then the environment. The config is returned even when it's invalid, so it can still be printed.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return config, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	loadEnv()
+	if err := config.loadEnvironment(); err != nil {
+		return config, err
+	}
+
+	// before there was a driver setting ENVIRONMENT=TEST meant SQLite in test.db. That still works
+	// for now, but a DSN always needs its driver, see validate.
+	if config.Database.Driver == "" && config.Database.DSN == "" && config.Environment == environmentTest {
+		slog.Warn("DATABASE_DRIVER isn't set, using SQLite because ENVIRONMENT is TEST, set DATABASE_DRIVER=sqlite as this fallback will be removed")
+		config.Database.Driver = driverSQLite
+	}
+	if config.Database.Driver == driverSQLite && config.Database.DSN == "" {
+		config.Database.DSN = "test.db"
+	}
+	return config, config.validate()
+}
+
+// loadFile reads a YAML file, or a TOML one when path ends in .toml, over the current values.
+func (config *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		// TOML goes through YAML so both formats share the yaml keys
+		var values map[string]any
+		if err := toml.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		if data, err = yaml.Marshal(values); err != nil {
+			return err
+		}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// loadEnvironment applies every environment variable that's set and not empty. QUOTA_BYTES_<ROLE> and
+// QUOTA_FILES_<ROLE> set the quota for a role, e.g. QUOTA_BYTES_DEFAULT.
+func (config *Config) loadEnvironment() error {
+	errs := []error{applyEnv(reflect.ValueOf(config).Elem())}
+
+	for _, variable := range os.Environ() {
+		name, raw, _ := strings.Cut(variable, "=")
+		var role string
+		var isBytes, isFiles bool
+		if role, isBytes = strings.CutPrefix(name, "QUOTA_BYTES_"); !isBytes {
+			role, isFiles = strings.CutPrefix(name, "QUOTA_FILES_")
+		}
+		if !(isBytes || isFiles) || role == "" || raw == "" {
+			continue
+		}
+
+		limit, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q isn't a whole number", name, raw))
+			continue
+		}
+		role = strings.ToLower(role)
+		quota := config.Quotas[role]
+		if isBytes {
+			quota.Bytes = limit
+		} else {
+			quota.Files = limit
+		}
+		if config.Quotas == nil {
+			config.Quotas = map[string]Quota{}
+		}
+		config.Quotas[role] = quota
+	}
+
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// applyEnv sets the fields of the struct in value from the variables named by their env tags,
+// going into nested sections.
+func applyEnv(value reflect.Value) error {
+	var errs []error
+	for i := range value.NumField() {
+		field, fieldValue := value.Type().Field(i), value.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(fieldValue))
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		raw := os.Getenv(name)
+		if name == "" || raw == "" {
+			continue
+		}
+		if err := setFromString(fieldValue, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setFromString parses raw into value by its type. Lists are comma separated.
+func setFromString(value reflect.Value, raw string) error {
+	if value.Type() == durationType {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q isn't a duration like 30s", raw)
+		}
+		value.SetInt(int64(duration))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", raw)
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", raw)
+		}
+		value.SetInt(parsed)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		list := reflect.MakeSlice(value.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setFromString(list.Index(i), item); err != nil {
+				return err
+			}
+		}
+		value.Set(list)
+	default:
+		return fmt.Errorf("can't set a %s from the environment", value.Type())
+	}
+	return nil
+}
+
+// validate reports every setting that would stop the app working properly, all at once.
+func (config *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(config.Auth.JWTSecret != "", "JWT_SECRET must be set")
+	driver := config.Database.Driver
+	check(driver != "", "DATABASE_DRIVER must be set to mysql, postgres or sqlite")
+	check(driver == "" || slices.Contains([]string{driverMySQL, driverPostgres, driverSQLite}, driver), "DATABASE_DRIVER must be mysql, postgres or sqlite, not %q", driver)
+	check(driver == "" || driver == driverSQLite || config.Database.DSN != "", "DSN must be set for %s", driver)
+	check(config.Database.MaxOpenConns >= 0 && config.Database.MaxIdleConns >= 0, "DB_MAX_OPEN_CONNS and DB_MAX_IDLE_CONNS can't be negative")
+	check(config.Database.ConnMaxLifetime >= 0 && config.Database.ConnMaxIdleTime >= 0, "DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME can't be negative")
+	check(config.Database.ConnectTimeout >= 0, "DB_CONNECT_TIMEOUT can't be negative")
+
+	if config.Auth.URLSigningKeys != "" {
+		pairsOk := true
+		for _, pair := range strings.Split(config.Auth.URLSigningKeys, ",") {
+			id, secret, found := strings.Cut(strings.TrimSpace(pair), ":")
+			pairsOk = pairsOk && found && id != "" && secret != ""
+		}
+		check(pairsOk, "URL_SIGNING_KEYS must be id:secret pairs separated by commas")
+	}
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(config.Log.Level)) == nil, "LOG_LEVEL must be debug, info, warn or error, not %q", config.Log.Level)
+	check(config.Log.Format == "text" || config.Log.Format == "json", "LOG_FORMAT must be text or json, not %q", config.Log.Format)
+
+	check((config.Server.TLSCertFile == "") == (config.Server.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	for name, timeout := range map[string]time.Duration{
+		"HTTP_READ_HEADER_TIMEOUT": config.Server.ReadHeaderTimeout,
+		"HTTP_READ_TIMEOUT":        config.Server.ReadTimeout,
+		"HTTP_WRITE_TIMEOUT":       config.Server.WriteTimeout,
+		"HTTP_IDLE_TIMEOUT":        config.Server.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":         config.Server.ShutdownTimeout,
+	} {
+		check(timeout >= 0, "%s can't be negative", name)
+	}
+	check(config.ReadyCheckTimeout > 0, "READY_CHECK_TIMEOUT must be positive")
+
+	check(config.Uploads.Path != "", "UPLOAD_PATH must be set")
+	check(len(config.Uploads.ThumbnailSizes) > 0, "THUMBNAIL_SIZES needs at least one size")
+	for _, size := range config.Uploads.ThumbnailSizes {
+		check(size > 0 && size <= 4096, "THUMBNAIL_SIZES must be between 1 and 4096, not %d", size)
+	}
+
+	for name, limit := range map[string]int64{
+		"BULK_MAX_ITEMS":     int64(config.Limits.BulkMaxItems),
+		"ARCHIVE_MAX_FILES":  int64(config.Limits.ArchiveMaxFiles),
+		"EVENT_LOG_SIZE":     int64(config.Limits.EventLogSize),
+		"IMPORT_MAX_ENTRIES": int64(config.Import.MaxEntries),
+		"IMPORT_MAX_BYTES":   config.Import.MaxBytes,
+		"IMPORT_MAX_RATIO":   config.Import.MaxRatio,
+	} {
+		check(limit > 0, "%s must be positive", name)
+	}
+	check(config.JobWorkers >= 0, "JOB_WORKERS can't be negative")
+	check(config.Verify.Interval >= 0, "VERIFY_INTERVAL can't be negative")
+	check(config.Verify.OrphanAge >= 0, "VERIFY_ORPHAN_AGE can't be negative")
+
+	for role, quota := range config.Quotas {
+		check(quota.Bytes >= 0 && quota.Files >= 0, "the quota for %s can't be negative", role)
+	}
+
+	return errors.Join(errs...)
+}
+
+// print writes the config as YAML with the secrets that are set replaced.
+func (config *Config) print(w io.Writer) error {
+	copied := *config
+	redactSecrets(reflect.ValueOf(&copied).Elem())
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(copied); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func redactSecrets(value reflect.Value) {
+	for i := range value.NumField() {
+		field, fieldValue := value.Type().Field(i), value.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			redactSecrets(fieldValue)
+		} else if field.Tag.Get("secret") == "true" && fieldValue.Len() > 0 {
+			// a new slice, so the one in the config that's in use is left alone
+			if fieldValue.Kind() == reflect.Slice {
+				fieldValue.Set(reflect.ValueOf([]string{redacted}))
+			} else {
+				fieldValue.SetString(redacted)
+			}
+		}
+	}
+}
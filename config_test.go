@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "TEST")
+	t.Setenv("JWT_SECRET", "very-secret")
+
+	config, err := loadConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", config.Server.Address)
+	assert.Equal(t, 10*time.Second, config.Server.ReadHeaderTimeout)
+	assert.Zero(t, config.Server.ReadTimeout)
+	assert.Equal(t, []int{128, 512}, config.Uploads.ThumbnailSizes)
+	assert.Equal(t, 500, config.Limits.BulkMaxItems)
+
+	t.Setenv("HTTP_ADDRESS", "127.0.0.1:9000")
+	t.Setenv("HTTP_READ_TIMEOUT", "1h")
+	t.Setenv("COOKIE_SECURE", "true")
+	t.Setenv("DENIED_EXTENSIONS", ".exe, .bat")
+	t.Setenv("THUMBNAIL_SIZES", "64,256")
+	t.Setenv("IMPORT_MAX_BYTES", "2048")
+	t.Setenv("QUOTA_BYTES_DEFAULT", "40")
+	t.Setenv("QUOTA_FILES_ADMIN", "5")
+	config, err = loadConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9000", config.Server.Address)
+	assert.Equal(t, time.Hour, config.Server.ReadTimeout)
+	assert.True(t, config.Auth.CookieSecure)
+	assert.Equal(t, []string{".exe", ".bat"}, config.Uploads.DeniedExtensions)
+	assert.Equal(t, []int{64, 256}, config.Uploads.ThumbnailSizes)
+	assert.Equal(t, int64(2048), config.Import.MaxBytes)
+	assert.Equal(t, Quota{Bytes: 40}, config.Quotas["default"])
+	assert.Equal(t, Quota{Files: 5}, config.Quotas["admin"])
+
+	// values that don't parse are reported by name instead of quietly falling back
+	t.Setenv("SHUTDOWN_TIMEOUT", "nonsense")
+	t.Setenv("BULK_MAX_ITEMS", "lots")
+	_, err = loadConfig("")
+	assert.ErrorContains(t, err, "SHUTDOWN_TIMEOUT")
+	assert.ErrorContains(t, err, "BULK_MAX_ITEMS")
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "TEST")
+	t.Setenv("JWT_SECRET", "very-secret")
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(yamlFile, []byte(`
+public_url: https://files.example.com
+server:
+  address: ":9090"
+  shutdown_timeout: 5s
+uploads:
+  allowed_mime_types: [image/*, text/plain]
+quotas:
+  default: {bytes: 1000, files: 10}
+`), 0600))
+	config, err := loadConfig(yamlFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://files.example.com", config.PublicURL)
+	assert.Equal(t, ":9090", config.Server.Address)
+	assert.Equal(t, 5*time.Second, config.Server.ShutdownTimeout)
+	assert.Equal(t, []string{"image/*", "text/plain"}, config.Uploads.AllowedTypes)
+	assert.Equal(t, Quota{Bytes: 1000, Files: 10}, config.Quotas["default"])
+	// settings the file leaves out keep their defaults
+	assert.Equal(t, 10*time.Second, config.Server.ReadHeaderTimeout)
+
+	tomlFile := filepath.Join(dir, "config.toml")
+	assert.NoError(t, os.WriteFile(tomlFile, []byte(`
+job_workers = 4
+
+[server]
+address = ":9191"
+idle_timeout = "1m"
+
+[limits]
+archive_max_files = 50
+`), 0600))
+	config, err = loadConfig(tomlFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, config.JobWorkers)
+	assert.Equal(t, ":9191", config.Server.Address)
+	assert.Equal(t, time.Minute, config.Server.IdleTimeout)
+	assert.Equal(t, 50, config.Limits.ArchiveMaxFiles)
+
+	// the environment wins over the file
+	t.Setenv("HTTP_ADDRESS", ":7070")
+	config, err = loadConfig(tomlFile)
+	assert.NoError(t, err)
+	assert.Equal(t, ":7070", config.Server.Address)
+
+	// typos are caught rather than ignored
+	assert.NoError(t, os.WriteFile(yamlFile, []byte("server:\n  adress: \":9090\"\n"), 0600))
+	_, err = loadConfig(yamlFile)
+	assert.ErrorContains(t, err, "adress")
+
+	_, err = loadConfig(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestConfigValidation(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "PRODUCTION")
+	t.Setenv("DATABASE_DRIVER", "mysql")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("DSN", "")
+	t.Setenv("LOG_LEVEL", "loud")
+	t.Setenv("TLS_CERT_FILE", "cert.pem")
+	t.Setenv("URL_SIGNING_KEYS", "no-secret")
+	t.Setenv("THUMBNAIL_SIZES", "0")
+
+	_, err := loadConfig("")
+	for _, problem := range []string{"JWT_SECRET", "DSN", "LOG_LEVEL", "TLS_CERT_FILE", "URL_SIGNING_KEYS", "THUMBNAIL_SIZES"} {
+		assert.ErrorContains(t, err, problem)
+	}
+
+	t.Setenv("ENVIRONMENT", "TEST")
+	t.Setenv("DATABASE_DRIVER", "")
+	t.Setenv("JWT_SECRET", "very-secret")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("URL_SIGNING_KEYS", "k1:signing-secret")
+	t.Setenv("THUMBNAIL_SIZES", "")
+	_, err = loadConfig("")
+	assert.NoError(t, err)
+}
+
+func TestPrintConfig(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "TEST")
+	t.Setenv("JWT_SECRET", "very-secret")
+	t.Setenv("DATABASE_DRIVER", "mysql")
+	t.Setenv("DSN", "user:hunter2@tcp(db:3306)/files")
+	t.Setenv("METRICS_TOKEN", "scrape-me")
+	t.Setenv("COOKIE_DOMAIN", "files.example.com")
+	t.Setenv("DB_REPLICAS", "user:swordfish@tcp(replica:3306)/files")
+
+	config, err := loadConfig("")
+	assert.NoError(t, err)
+
+	var printed bytes.Buffer
+	assert.NoError(t, config.print(&printed))
+	assert.Contains(t, printed.String(), "jwt_secret: '[REDACTED]'")
+	assert.Contains(t, printed.String(), "cookie_domain: files.example.com")
+	assert.Contains(t, printed.String(), "shutdown_timeout: 30s")
+	for _, secret := range []string{"very-secret", "hunter2", "scrape-me", "swordfish"} {
+		assert.NotContains(t, printed.String(), secret)
+	}
+	// printing doesn't touch the config in use
+	assert.Equal(t, "very-secret", config.Auth.JWTSecret)
+	assert.Equal(t, []string{"user:swordfish@tcp(replica:3306)/files"}, config.Database.Replicas)
+
+	// what's printed can be read back in
+	file := filepath.Join(t.TempDir(), "printed.yaml")
+	assert.NoError(t, os.WriteFile(file, printed.Bytes(), 0600))
+	reloaded, err := loadConfig(file)
+	assert.NoError(t, err)
+	assert.Equal(t, config.Server, reloaded.Server)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+	"gorm.io/plugin/opentelemetry/tracing"
+)
+
+// Database drivers, also the names of the gorm dialects and the migrations directories.
+const (
+	driverMySQL    = "mysql"
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+// replicasResolver names the read replicas. Only queries that ask for them with readReplica go
+// there, everything else, reads included, stays on the primary.
+const replicasResolver = "replicas"
+
+// The backoff between attempts to connect at startup.
+const (
+	connectBackoff    = 500 * time.Millisecond
+	maxConnectBackoff = 10 * time.Second
+)
+
+func dialectorFor(driver string, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case driverMySQL:
+		return mysql.Open(dsn), nil
+	case driverPostgres:
+		return postgres.Open(dsn), nil
+	case driverSQLite:
+		return sqlite.Open(dsn), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+// connectedDialector is a dialector for a connection pool that's already open.
+func connectedDialector(driver string, dsn string, conn gorm.ConnPool) gorm.Dialector {
+	switch driver {
+	case driverMySQL:
+		return mysql.New(mysql.Config{DSN: dsn, Conn: conn})
+	case driverPostgres:
+		return postgres.New(postgres.Config{DSN: dsn, Conn: conn})
+	default:
+		return sqlite.New(sqlite.Config{DSN: dsn, Conn: conn})
+	}
+}
+
+// openDatabase connects to the configured database and its replicas, retrying until DB_CONNECT_TIMEOUT
+// so the server can start before they're up. It doesn't migrate it, see migrateDatabase.
+func openDatabase(ctx context.Context, config *Config) (*gorm.DB, error) {
+	settings := config.Database
+	dialector, err := dialectorFor(settings.Driver, settings.DSN)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Opening the database", "driver", settings.Driver, "replicas", len(settings.Replicas), "environment", config.Environment)
+
+	db, err := connect(ctx, dialector, settings.ConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the database: %w", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(settings.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(settings.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(settings.ConnMaxIdleTime)
+
+	if len(settings.Replicas) > 0 {
+		replicas := make([]gorm.Dialector, len(settings.Replicas))
+		for i, dsn := range settings.Replicas {
+			replicaDialector, err := dialectorFor(settings.Driver, dsn)
+			if err != nil {
+				return nil, err
+			}
+			// dbresolver would open the replicas itself and fail straight away on one that isn't up yet
+			replica, err := connect(ctx, replicaDialector, settings.ConnectTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("connecting to read replica %d: %w", i+1, err)
+			}
+			replicas[i] = connectedDialector(settings.Driver, dsn, replica.ConnPool)
+		}
+		resolver := dbresolver.Register(dbresolver.Config{Replicas: replicas, Policy: dbresolver.RandomPolicy{}}, replicasResolver).
+			SetMaxOpenConns(settings.MaxOpenConns).
+			SetMaxIdleConns(settings.MaxIdleConns).
+			SetConnMaxLifetime(settings.ConnMaxLifetime).
+			SetConnMaxIdleTime(settings.ConnMaxIdleTime)
+		if err := db.Use(resolver); err != nil {
+			return nil, fmt.Errorf("connecting to the read replicas: %w", err)
+		}
+	}
+
+	// spans for every query, without the values so passwords and tokens stay out of traces
+	if err := db.Use(tracing.NewPlugin(tracing.WithoutQueryVariables(), tracing.WithoutMetrics())); err != nil {
+		return nil, fmt.Errorf("setting up database tracing: %w", err)
+	}
+	return db, nil
+}
+
+// connect opens the database and pings it, trying again with a growing backoff until timeout has passed.
+func connect(ctx context.Context, dialector gorm.Dialector, timeout time.Duration) (*gorm.DB, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := connectBackoff
+	for attempt := 1; ; attempt++ {
+		db, err := gorm.Open(dialector, &gorm.Config{})
+		if err == nil {
+			return db, nil
+		}
+		// the ping failed after the pool was made
+		if db != nil {
+			if sqlDB, _ := db.DB(); sqlDB != nil {
+				_ = sqlDB.Close()
+			}
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+
+		slog.Warn("The database isn't reachable yet, trying again", "attempt", attempt, "in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// readReplica sends a query to a read replica when there are any. Only use it for reads that can be
+// a little stale, like listings, replicas can lag behind the primary.
+func readReplica(db *gorm.DB) *gorm.DB {
+	return db.Clauses(dbresolver.Use(replicasResolver))
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// transaction runs fn in a transaction and wakes the job workers once it commits, so the jobs
+// it queued start straight away instead of at the next poll.
+func (app *App) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	if err := app.db.WithContext(ctx).Transaction(fn); err != nil {
+		return err
+	}
+	app.jobs.Notify()
+	return nil
+}
+
+// startsWith matches rows where column starts with prefix, taken literally and ignoring case on
+// every database. LIKE is case sensitive on Postgres, so it uses ILIKE there, and the escape
+// character is given because SQLite has no default one.
+func startsWith(db *gorm.DB, column string, prefix string) *gorm.DB {
+	operator := "LIKE"
+	if db.Dialector.Name() == driverPostgres {
+		operator = "ILIKE"
+	}
+	return db.Where(column+" "+operator+" ? ESCAPE '!'", likeEscaper.Replace(prefix)+"%")
+}
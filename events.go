@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// eventsPollInterval is how often a stream checks the log for new events. The log is in the
+	// database, so this also picks up changes made by other processes.
+	eventsPollInterval = time.Second
+	eventsHeartbeat    = 15 * time.Second
+
+	// eventsBatchSize is the most events sent from one read of the log
+	eventsBatchSize = 100
+
+	// eventsGapTimeout is how long a stream waits for a missing id to show up in the log. Ids are
+	// handed out when a transaction inserts its event but only seen once it commits, so a gap is
+	// usually an event still being committed, unless it's been missing for this long and its
+	// transaction rolled back.
+	eventsGapTimeout = 10 * time.Second
+
+	// eventsTrimEvery is how many events a process logs between trims of the log
+	eventsTrimEvery = 100
+)
+
+// eventGap remembers the missing id a stream is waiting for, and since when.
+type eventGap struct {
+	id    uint
+	since time.Time
+}
+
+// readableThrough returns the highest of ids, the ids in the log after cursor in order, that can
+// be sent without skipping a lower one that might still be committed.
+func (gap *eventGap) readableThrough(cursor uint, ids []uint, now time.Time) uint {
+	end := cursor
+	for _, id := range ids {
+		if id != end+1 {
+			if gap.id != end+1 {
+				gap.id, gap.since = end+1, now
+			}
+			if now.Sub(gap.since) < eventsGapTimeout {
+				break
+			}
+		}
+		end = id
+	}
+	return end
+}
+
+// appendChangeEvent adds a file change to the event log as part of tx, trimming the oldest
+// events every so often to keep the log bounded.
+func (app *App) appendChangeEvent(tx *gorm.DB, eventType string, file File) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	changeEvent := ChangeEvent{Type: eventType, FileId: file.ID, UserId: file.UserId, Data: string(data)}
+	if err := tx.Create(&changeEvent).Error; err != nil {
+		return err
+	}
+
+	if app.eventsAppended.Add(1)%eventsTrimEvery == 0 {
+		return trimChangeEvents(tx, app.config.Limits.EventLogSize)
+	}
+	return nil
+}
+
+// trimChangeEvents deletes all but the newest keep events. It counts rows rather than doing
+// arithmetic on ids, which can skip numbers.
+func trimChangeEvents(tx *gorm.DB, keep int) error {
+	var oldestDropped []uint
+	err := tx.Model(&ChangeEvent{}).Order("id DESC").Offset(keep).Limit(1).Pluck("id", &oldestDropped).Error
+	if err != nil || len(oldestDropped) == 0 {
+		return err
+	}
+	return tx.Where("id <= ?", oldestDropped[0]).Delete(&ChangeEvent{}).Error
+}
+
+// visibleChangeEvents limits a query to events about files the user owns, public files
+// and files shared with them.
+func (app *App) visibleChangeEvents(user User) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		sharedFileIds := app.db.Model(&FileGrant{}).Select("file_id").
+			Where("user_id = ? OR group_id IN (?)", user.ID, memberGroupIds(app.db, user.ID))
+		return db.Where("user_id = 0 OR user_id = ? OR file_id IN (?)", user.ID, sharedFileIds)
+	}
+}
+
+// lastEventId reads where a reconnecting client got up to, ok is false for a fresh connection.
+func lastEventId(c *gin.Context) (uint, bool) {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("last_event_id")
+	}
+	if raw == "" {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// streamEvents sends the changes the user can see as server-sent events. Clients that reconnect
+// with Last-Event-ID get what they missed, or a reset event if it's no longer in the log.
+func (app *App) streamEvents(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	var latestId uint
+	err := app.db.WithContext(c).Model(&ChangeEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&latestId).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cursor := latestId
+	reset := false
+	if lastId, ok := lastEventId(c); ok && lastId <= latestId {
+		var oldestId uint
+		err := app.db.WithContext(c).Model(&ChangeEvent{}).Select("COALESCE(MIN(id), 0)").Scan(&oldestId).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// anything between lastId and the oldest event we still have has been trimmed
+		if oldestId > lastId+1 {
+			reset = true
+		} else {
+			cursor = lastId
+		}
+	}
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if reset {
+		c.Render(-1, sse.Event{Event: "reset", Id: strconv.FormatUint(uint64(cursor), 10), Data: "{}"})
+	}
+	c.Writer.Flush()
+
+	poll := time.NewTicker(eventsPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	var gap eventGap
+	for {
+		// gaps are looked for among everyone's events, one the user can't see still holds up the ones after it
+		var ids []uint
+		err := app.db.WithContext(c.Request.Context()).Model(&ChangeEvent{}).
+			Where("id > ?", cursor).Order("id").Limit(eventsBatchSize).Pluck("id", &ids).Error
+		if err != nil {
+			logFor(c).Error("Reading events failed", "error", err)
+			return
+		}
+		end := gap.readableThrough(cursor, ids, time.Now())
+
+		var changeEvents []ChangeEvent
+		if end > cursor {
+			err = app.db.WithContext(c.Request.Context()).Scopes(app.visibleChangeEvents(user)).
+				Where("id > ? AND id <= ?", cursor, end).Order("id").Find(&changeEvents).Error
+			if err != nil {
+				logFor(c).Error("Reading events failed", "error", err)
+				return
+			}
+		}
+
+		for _, changeEvent := range changeEvents {
+			c.Render(-1, sse.Event{Event: changeEvent.Type, Id: strconv.FormatUint(uint64(changeEvent.ID), 10), Data: changeEvent.Data})
+		}
+		if len(changeEvents) > 0 {
+			c.Writer.Flush()
+		}
+		cursor = end
+		if len(ids) == eventsBatchSize && end == ids[len(ids)-1] {
+			continue
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-app.draining:
+			// the client reconnects to another server, or this one once it's back, with Last-Event-ID
+			return
+		case <-heartbeat.C:
+			// a comment line, which keeps proxies from closing an idle connection
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type streamedEvent struct {
+	Id    string
+	Event string
+	Data  string
+}
+
+// readEventStream connects to /events for a moment and parses what was sent.
+func readEventStream(t *testing.T, router *gin.Engine, cookie *http.Cookie, lastEventId string) []streamedEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/events", nil)
+	req.AddCookie(cookie)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, sse.ContentType, w.Header().Get("Content-Type"))
+
+	var events []streamedEvent
+	for _, block := range strings.Split(w.Body.String(), "\n\n") {
+		var streamed streamedEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, _ := strings.Cut(line, ":")
+			switch field {
+			case "id":
+				streamed.Id = value
+			case "event":
+				streamed.Event = value
+			case "data":
+				streamed.Data = value
+			}
+		}
+		if streamed.Event != "" {
+			events = append(events, streamed)
+		}
+	}
+	return events
+}
+
+func TestStreamEvents(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+	otherCookie := registerTestUser(t, router, "other@test.com")
+
+	w := uploadTestFile(t, router, cookie, "testfile.txt", []byte("mine"), map[string]string{"name": "mine"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = uploadTestFile(t, router, otherCookie, "testfile.txt", []byte("theirs"), map[string]string{"name": "theirs"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var theirs File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &theirs))
+	w = uploadTestFile(t, router, nil, "testfile.txt", []byte("public"), map[string]string{"name": "public"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// a fresh connection only gets new events
+	assert.Empty(t, readEventStream(t, router, cookie, ""))
+
+	events := readEventStream(t, router, cookie, "0")
+	assert.Len(t, events, 2)
+	assert.Equal(t, eventFileCreated, events[0].Event)
+	var file File
+	assert.NoError(t, json.Unmarshal([]byte(events[0].Data), &file))
+	assert.Equal(t, "mine", file.Name)
+
+	// resuming skips what was already seen
+	events = readEventStream(t, router, cookie, events[0].Id)
+	assert.Len(t, events, 1)
+	assert.NoError(t, json.Unmarshal([]byte(events[0].Data), &file))
+	assert.Equal(t, "public", file.Name)
+
+	// sharing a file makes its changes visible
+	w = performJSON(router, "POST", fmt.Sprintf("/files/%d/grants", theirs.ID), grantRequest{Email: "test@test.com", Role: roleViewer}, otherCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = performJSON(router, "POST", "/files/bulk", bulkRequest{Action: bulkTag, Ids: []uint{theirs.ID}, Tags: []string{"red"}}, otherCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	events = readEventStream(t, router, cookie, events[0].Id)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, eventFileUpdated, events[0].Event)
+		assert.Contains(t, events[0].Data, `"Name":"red"`)
+	}
+
+	// a client that fell behind the log is told to start over
+	assert.NoError(t, app.db.Where("id = 1").Delete(&ChangeEvent{}).Error)
+	events = readEventStream(t, router, cookie, "0")
+	assert.Len(t, events, 1)
+	assert.Equal(t, "reset", events[0].Event)
+
+	w = performJSON(router, "GET", "/events", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestEventGaps(t *testing.T) {
+	var gap eventGap
+	now := time.Now()
+
+	assert.Equal(t, uint(12), gap.readableThrough(10, []uint{11, 12}, now))
+	assert.Equal(t, uint(10), gap.readableThrough(10, nil, now))
+
+	// 12 might still be committing, so 13 waits for it
+	assert.Equal(t, uint(11), gap.readableThrough(10, []uint{11, 13}, now))
+	assert.Equal(t, uint(11), gap.readableThrough(11, []uint{13}, now.Add(eventsGapTimeout/2)))
+	assert.Equal(t, uint(13), gap.readableThrough(11, []uint{12, 13}, now.Add(eventsGapTimeout/2)))
+
+	// a gap that doesn't fill was a rollback
+	assert.Equal(t, uint(13), gap.readableThrough(13, []uint{15}, now))
+	assert.Equal(t, uint(16), gap.readableThrough(13, []uint{15, 16}, now.Add(eventsGapTimeout)))
+}
+
+func TestTrimChangeEvents(t *testing.T) {
+	defer cleanUp()
+	app, _ := setupTestApp()
+
+	// ids that skip numbers, like after a rollback
+	for _, id := range []uint{1, 2, 5, 6, 9} {
+		assert.NoError(t, app.db.Create(&ChangeEvent{ID: id, Type: eventFileCreated}).Error)
+	}
+	assert.NoError(t, trimChangeEvents(app.db, 3))
+	var ids []uint
+	assert.NoError(t, app.db.Model(&ChangeEvent{}).Order("id").Pluck("id", &ids).Error)
+	assert.Equal(t, []uint{5, 6, 9}, ids)
+
+	assert.NoError(t, trimChangeEvents(app.db, 10))
+	assert.NoError(t, app.db.Model(&ChangeEvent{}).Order("id").Pluck("id", &ids).Error)
+	assert.Equal(t, []uint{5, 6, 9}, ids)
+}
@@ -1,152 +1,390 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
 
+	"github.com/backend-project/scan"
+	"github.com/backend-project/storage"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+// pageParams reads the page and page_size query parameters, clamped to sane values.
+func pageParams(r *http.Request) (page int, pageSize int) {
+	q := r.URL.Query()
+	page, _ = strconv.Atoi(q.Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	pageSize, _ = strconv.Atoi(q.Get("page_size"))
+	switch {
+	case pageSize > 100:
+		pageSize = 100
+	case pageSize <= 0:
+		pageSize = 10
+	}
+
+	return page, pageSize
+}
+
 // Paginate https://gorm.io/docs/scopes.html#Pagination
 func Paginate(r *http.Request) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		q := r.URL.Query()
-		page, _ := strconv.Atoi(q.Get("page"))
-		if page <= 0 {
-			page = 1
-		}
-
-		pageSize, _ := strconv.Atoi(q.Get("page_size"))
-		switch {
-		case pageSize > 100:
-			pageSize = 100
-		case pageSize <= 0:
-			pageSize = 10
-		}
-
+		page, pageSize := pageParams(r)
 		offset := (page - 1) * pageSize
 		return db.Offset(offset).Limit(pageSize)
 	}
 }
 
-func (app *App) getFiles(c *gin.Context) {
-	var files []File
-	result := app.db.Scopes(Paginate(c.Request)).Find(&files)
-	if result.Error != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error.Error()})
+// store is where uploaded files are kept, the upload path unless the app has other storage.
+func (app *App) store() storage.Storage {
+	if app.storage != nil {
+		return storage.NewTraced(app.storage)
 	}
-	c.JSON(http.StatusOK, files)
-	return
+	return storage.NewTraced(storage.NewDisk(app.config.Uploads.Path))
 }
 
-func (app *App) doesFileNameExist(ctx *gin.Context, fileName string) bool {
-	_, err := gorm.G[File](app.db).Where("file_path LIKE ?", fileName).First(ctx)
+func (app *App) getFiles(c *gin.Context) {
+	user, loggedIn := currentUser(c)
+	page, pageSize := pageParams(c.Request)
+	files, err := app.files.List(c, user, loggedIn, page, pageSize)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return false
-		}
-		panic(err)
-	} else {
-		return true
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	c.JSON(http.StatusOK, files)
 }
 
-func (app *App) generateUniqueFileName(ctx *gin.Context) string {
-	uniqueName := uuid.New().String()
-
-	// Timestamp?
-
-	// I'm not sure if this is necessary, but I'm not sure if the uuid is really guaranteed to be unique
-	for app.doesFileNameExist(ctx, uniqueName) {
-		uniqueName = uuid.New().String()
+func (app *App) createFile(c *gin.Context) {
+	// uploads are anonymous unless the uploader is logged in
+	user, loggedIn := currentUser(c)
+	budget, err := app.files.UploadBudget(c, user, loggedIn)
+	if errors.Is(err, errQuotaExceeded) {
+		quotaExceeded(c, budget.Quota, budget.Usage)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	return uniqueName
-}
-
-func (app *App) createFile(c *gin.Context) {
+	// stop reading the upload as soon as it can't fit, rather than after it's all on disk
+	if budget.MaxRequestBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, budget.MaxRequestBytes)
+	}
 
+	// the body is read and parsed here, so this span is how long the upload itself took
+	_, parseSpan := tracer().Start(c, "multipart.parse")
 	uploadedFile, err := c.FormFile("file")
+	parseSpan.End()
 	fileName := c.PostForm("name")
 	fileDescription := c.DefaultPostForm("description", "")
-	//tags := c.DefaultPostForm("tags", "[]")
-	//tagStructs := []Tag{}
 
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		quotaExceeded(c, budget.Quota, budget.Usage)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	uploadPath := os.Getenv("UPLOAD_PATH")
-	if uploadPath == "" {
-		uploadPath = "./files"
+	if !budget.Fits(uploadedFile.Size) {
+		quotaExceeded(c, budget.Quota, budget.Usage)
+		return
 	}
 
-	uniqueFileName := filepath.Base(app.generateUniqueFileName(c))
+	// tags is a JSON list of names, tags that don't exist yet are created
+	var tags []string
+	if rawTags := c.PostForm("tags"); rawTags != "" {
+		if err := json.Unmarshal([]byte(rawTags), &tags); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tags must be a JSON list of names"})
+			return
+		}
+	}
 
-	err = c.SaveUploadedFile(uploadedFile, fmt.Sprintf("%s/%s", uploadPath, uniqueFileName))
+	contentType, err := app.checkUploadedFile(uploadedFile)
+	if errors.Is(err, errTypeNotAllowed) || errors.Is(err, errContentMismatch) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	file := File{Name: fileName, Description: fileDescription, FilePath: uniqueFileName, Tags: []Tag{}}
-	err = gorm.G[File](app.db).Create(
-		c,
-		&file,
-	)
+	var folderId *uint
+	if rawFolderId := c.PostForm("folder_id"); rawFolderId != "" {
+		folder, err := app.findFolder(c, rawFolderId, user.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "folder not found"})
+			return
+		}
+		folderId = &folder.ID
+	}
+
+	uniqueFileName, err := app.files.UniqueKey(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// I'm querying the database here to get the updatedAt, createdAt, timestamps
-	fileFromDatabase, err := gorm.G[File](app.db).Where(&File{ID: file.ID}).First(c)
+	err = app.saveUploadedFile(c, uploadedFile, uniqueFileName)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, fileFromDatabase)
-}
+	scanStatus, scanResult, err := app.scanUpload(c, uniqueFileName)
+	if err != nil {
+		_ = app.store().Delete(c, uniqueFileName)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-func (app *App) getFile(c *gin.Context) {
-	fileId := c.Param("id")
-	file, err := gorm.G[File](app.db).Where("id = ?", fileId).First(c)
+	file := File{
+		Name:        fileName,
+		Description: fileDescription,
+		FilePath:    uniqueFileName,
+		Tags:        []Tag{},
+		UserId:      user.ID,
+		FolderId:    folderId,
+		Size:        uploadedFile.Size,
+		ContentType: contentType,
+		ScanStatus:  scanStatus,
+	}
+	err = app.insertFile(c, user, &file, tags)
+	if err != nil {
+		_ = app.store().Delete(c, storageKey(file))
+
+		if errors.Is(err, errQuotaExceeded) {
+			quotaExceeded(c, budget.Quota, budget.Usage)
+			return
+		}
 
-	if errors.Is(err, gorm.ErrRecordNotFound) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// read back for the timestamps as they were stored
+	fileFromDatabase, err := app.files.Get(c, file.ID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if len(file.Tags) > 0 {
+		fileFromDatabase.Tags = file.Tags
+	}
+	app.audit(c, "file.create", file.ID, nil, fileFromDatabase)
+
+	// infected uploads are kept in quarantine for an admin to look at, but the uploader is told
+	if scanStatus == scan.StatusInfected {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "file is infected", "signature": scanResult.Signature, "file": fileFromDatabase})
+		return
+	}
+
+	c.JSON(http.StatusOK, fileFromDatabase)
+}
+
+// insertFile saves a new file's row, charges it to the owner's usage and queues its processing, all in one transaction.
+func (app *App) insertFile(ctx context.Context, owner User, file *File, tags []string) error {
+	if err := app.files.Create(ctx, owner, file, tags); err != nil {
+		return err
+	}
+
+	app.metrics.uploadedBytes.Add(float64(file.Size))
+	return nil
+}
+
+// fileChanged runs in the transaction of every change the file repository makes: new uploads are
+// queued for processing and every change is published.
+func (app *App) fileChanged(tx *gorm.DB, eventType string, file File) error {
+	if eventType == eventFileCreated {
+		if err := app.enqueueFileProcessing(tx, file); err != nil {
+			return err
+		}
+	}
+	return app.publishFileEvent(tx, eventType, file.ID)
+}
+
+func (app *App) saveUploadedFile(ctx context.Context, uploadedFile *multipart.FileHeader, key string) error {
+	content, err := uploadedFile.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	_, err = app.store().Put(ctx, key, content)
+	return err
+}
+
+// checkUploadedFile checks an upload against the upload policy and returns its sniffed content type.
+func (app *App) checkUploadedFile(uploadedFile *multipart.FileHeader) (string, error) {
+	content, err := uploadedFile.Open()
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	return app.config.Uploads.policy().check(uploadedFile.Filename, content)
+}
+
+func (app *App) getFile(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleViewer)
+	if !ok {
+		return
+	}
 
 	c.JSON(http.StatusOK, file)
 }
 
-func (app *App) deleteFile(c *gin.Context) {
-	fileId := c.Param("id")
-	_, err := gorm.G[File](app.db).Where("id = ?", fileId).Delete(c)
+// getFileContent downloads a file, either with the usual login, always as an attachment, or with a
+// URL from presignFile.
+func (app *App) getFileContent(c *gin.Context) {
+	if c.Query("signature") != "" {
+		app.getSignedFileContent(c)
+		return
+	}
+
+	file, ok := app.authorizeFile(c, roleViewer)
+	if !ok {
+		return
+	}
+
+	app.sendFileContent(c, file, dispositionAttachment)
+}
+
+// sendFileContent streams the stored upload named after the file, as an attachment unless
+// disposition is "inline" and the file is of a type that can't run script, see inlineContentType.
+func (app *App) sendFileContent(c *gin.Context, file File, disposition string) {
+	if err := scanRefusal(file); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	downloadName := file.Name
+	if downloadName == "" {
+		downloadName = file.FilePath
+	}
+	if disposition != dispositionInline || !inlineContentType(file.ContentType) {
+		disposition = dispositionAttachment
+	}
+
+	app.sendStoredBlob(c, storageKey(file), downloadName, file.ContentType, disposition)
+}
+
+// inlineContentType is whether content of this type is passive enough to show inline: images other
+// than SVG, PDFs and plain text.
+func inlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"):
+		return true
+	default:
+		return mediaType == "application/pdf" || mediaType == "text/plain"
+	}
+}
+
+// sendStoredBlob serves a blob from storage, handling range and conditional requests.
+func (app *App) sendStoredBlob(c *gin.Context, key string, downloadName string, contentType string, disposition string) {
+	info, err := app.store().Stat(c, key)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file content is missing"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
+	content, err := app.store().Open(c, key)
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	// uploads are served from the API's origin, so browsers mustn't guess a type or run anything in them
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	if contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+	if disposition != "" {
+		c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": downloadName}))
+	}
+	http.ServeContent(c.Writer, c.Request, downloadName, info.ModTime, content)
+	app.metrics.countDownload(c)
+}
+
+func (app *App) deleteFile(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+
+	if err := app.files.Delete(c, file); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "file.delete", file.ID, file, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// purgeFile permanently deletes a file, even one that was already soft deleted, and frees up its quota.
+func (app *App) purgeFile(c *gin.Context) {
+	user, loggedIn := currentUser(c)
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	file, err := app.files.GetDeleted(c, uint(id), user, loggedIn, roleOwner)
+	if !fileAccessAllowed(c, err, roleOwner) {
+		return
+	}
+
+	if err := app.purge(c, file); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	app.audit(c, "file.purge", file.ID, file, nil)
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+// purge removes everything belonging to a file: its row, tags, grants, share links, usage and the upload itself.
+func (app *App) purge(ctx context.Context, file File) error {
+	if err := app.files.Purge(ctx, file); err != nil {
+		return err
+	}
+
+	app.deleteThumbnails(ctx, file)
+
+	err := app.store().Delete(ctx, storageKey(file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
 func (app *App) updateFile(c *gin.Context) {
-	fileId := c.Param("id")
+	existingFile, ok := app.authorizeFile(c, roleEditor)
+	if !ok {
+		return
+	}
 
 	var file File
 	if err := c.BindJSON(&file); err != nil {
@@ -154,11 +392,13 @@ func (app *App) updateFile(c *gin.Context) {
 		return
 	}
 
-	_, err := gorm.G[File](app.db).Where("id = ?", fileId).Updates(c, file)
+	// only the descriptive fields can be changed here, ownership and location have their own endpoints
+	updatedFile, err := app.files.Update(c, existingFile, file.Name, file.Description)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	app.audit(c, "file.update", existingFile.ID, existingFile, updatedFile)
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxFolderDepth guards the ancestor walk against rows that already form a cycle.
+const maxFolderDepth = 1000
+
+// maxDescendantFolders caps how many folders descendantFolderIds collects, so a cycle in the rows
+// or a runaway tree can't make it load the whole table.
+const maxDescendantFolders = maxFolderDepth * 100
+
+var (
+	errFolderCycle    = errors.New("cannot move a folder into itself or one of its subfolders")
+	errTooManyFolders = errors.New("too many folders below this one")
+)
+
+type folderRequest struct {
+	Name     string `json:"name"`
+	ParentId *uint  `json:"parent_id"`
+}
+
+type moveFolderRequest struct {
+	ParentId *uint `json:"parent_id"`
+}
+
+type moveFileRequest struct {
+	FolderId *uint `json:"folder_id"`
+}
+
+// whereParent matches rows whose parent column is parentId, or NULL for the root.
+func whereParent(db *gorm.DB, column string, parentId *uint) *gorm.DB {
+	if parentId == nil {
+		return db.Where(column + " IS NULL")
+	}
+	return db.Where(column+" = ?", *parentId)
+}
+
+func sameParent(a *uint, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func validFolderName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (app *App) findFolder(ctx *gin.Context, folderId any, userId uint) (Folder, error) {
+	return gorm.G[Folder](app.db).Where("id = ? AND user_id = ?", folderId, userId).First(ctx)
+}
+
+func (app *App) isFolderNameTaken(ctx *gin.Context, userId uint, parentId *uint, name string) (bool, error) {
+	var count int64
+	query := app.db.WithContext(ctx).Model(&Folder{}).Where("user_id = ? AND name = ?", userId, name)
+	err := whereParent(query, "parent_id", parentId).Count(&count).Error
+	return count > 0, err
+}
+
+// resolveFolderPath walks a slash separated path like "a/b/c" from the owner's root.
+func (app *App) resolveFolderPath(ctx *gin.Context, userId uint, path string) (Folder, error) {
+	var folder Folder
+	var parentId *uint
+	found := false
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		var child Folder
+		query := app.db.WithContext(ctx).Where("user_id = ? AND name = ?", userId, name)
+		err := whereParent(query, "parent_id", parentId).First(&child).Error
+		if err != nil {
+			return Folder{}, err
+		}
+
+		folder = child
+		id := folder.ID
+		parentId = &id
+		found = true
+	}
+
+	if !found {
+		return Folder{}, gorm.ErrRecordNotFound
+	}
+
+	return folder, nil
+}
+
+// checkFolderMove makes sure folderId isn't newParentId or one of its ancestors.
+func (app *App) checkFolderMove(ctx *gin.Context, folderId uint, newParentId uint) error {
+	currentId := &newParentId
+	for depth := 0; currentId != nil; depth++ {
+		if *currentId == folderId || depth > maxFolderDepth {
+			return errFolderCycle
+		}
+
+		folder, err := gorm.G[Folder](app.db).Where("id = ?", *currentId).First(ctx)
+		if err != nil {
+			return err
+		}
+		currentId = folder.ParentId
+	}
+
+	return nil
+}
+
+// descendantFolderIds returns folderId and the ids of every folder nested below it, failing with
+// errTooManyFolders rather than returning part of the tree.
+func (app *App) descendantFolderIds(ctx *gin.Context, folderId uint) ([]uint, error) {
+	ids := []uint{folderId}
+	frontier := []uint{folderId}
+
+	for len(frontier) > 0 {
+		if len(ids) > maxDescendantFolders {
+			return nil, errTooManyFolders
+		}
+
+		var children []uint
+		err := app.db.WithContext(ctx).Model(&Folder{}).Where("parent_id IN ?", frontier).Pluck("id", &children).Error
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, children...)
+		frontier = children
+	}
+
+	return ids, nil
+}
+
+// listFolderContents pages through the subfolders of parentId followed by its files.
+func (app *App) listFolderContents(c *gin.Context, userId uint, parentId *uint) ([]Folder, []File, error) {
+	page, pageSize := pageParams(c.Request)
+	offset := (page - 1) * pageSize
+
+	var folderCount int64
+	folderQuery := app.db.WithContext(c).Model(&Folder{}).Where("user_id = ?", userId)
+	if err := whereParent(folderQuery, "parent_id", parentId).Count(&folderCount).Error; err != nil {
+		return nil, nil, err
+	}
+
+	folders := []Folder{}
+	if int64(offset) < folderCount {
+		query := app.db.WithContext(c).Where("user_id = ?", userId)
+		err := whereParent(query, "parent_id", parentId).Order("name").Offset(offset).Limit(pageSize).Find(&folders).Error
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	files := []File{}
+	if remaining := pageSize - len(folders); remaining > 0 {
+		fileOffset := max(offset-int(folderCount), 0)
+		query := app.db.WithContext(c).Where("user_id = ?", userId)
+		err := whereParent(query, "folder_id", parentId).Order("name").Offset(fileOffset).Limit(remaining).Find(&files).Error
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return folders, files, nil
+}
+
+func (app *App) createFolder(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	var request folderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if !validFolderName(request.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder name"})
+		return
+	}
+
+	if request.ParentId != nil {
+		if _, err := app.findFolder(c, *request.ParentId, user.ID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "parent folder not found"})
+			return
+		}
+	}
+
+	taken, err := app.isFolderNameTaken(c, user.ID, request.ParentId, request.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "a folder with that name already exists"})
+		return
+	}
+
+	folder := Folder{Name: request.Name, ParentId: request.ParentId, UserId: user.ID}
+	if err := gorm.G[Folder](app.db).Create(c, &folder); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "folder.create", folder.ID, nil, folder)
+
+	c.JSON(http.StatusCreated, folder)
+}
+
+func (app *App) getFolder(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folder, err := app.findFolder(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, folder)
+}
+
+func (app *App) getFolderByPath(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folder, err := app.resolveFolderPath(c, user.ID, c.Param("path"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, folder)
+}
+
+func (app *App) getRootFolder(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folders, files, err := app.listFolderContents(c, user.ID, nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"folder": nil, "folders": folders, "files": files})
+}
+
+func (app *App) getFolderContents(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folder, err := app.findFolder(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+
+	folders, files, err := app.listFolderContents(c, user.ID, &folder.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"folder": folder, "folders": folders, "files": files})
+}
+
+// updateFolder renames a folder, use moveFolder to change its parent.
+func (app *App) updateFolder(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folder, err := app.findFolder(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+
+	var request folderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if !validFolderName(request.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder name"})
+		return
+	}
+
+	if request.Name != folder.Name {
+		taken, err := app.isFolderNameTaken(c, user.ID, folder.ParentId, request.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "a folder with that name already exists"})
+			return
+		}
+	}
+
+	before := folder
+	if err := app.db.WithContext(c).Model(&folder).Update("name", request.Name).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "folder.update", folder.ID, before, folder)
+
+	c.JSON(http.StatusOK, folder)
+}
+
+func (app *App) moveFolder(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folder, err := app.findFolder(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+
+	var request moveFolderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// moving a folder to where it is already would find its own name taken
+	if sameParent(folder.ParentId, request.ParentId) {
+		c.JSON(http.StatusOK, folder)
+		return
+	}
+
+	if request.ParentId != nil {
+		if _, err := app.findFolder(c, *request.ParentId, user.ID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "parent folder not found"})
+			return
+		}
+
+		err := app.checkFolderMove(c, folder.ID, *request.ParentId)
+		if errors.Is(err, errFolderCycle) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	taken, err := app.isFolderNameTaken(c, user.ID, request.ParentId, folder.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "a folder with that name already exists"})
+		return
+	}
+
+	before := folder
+	if err := app.db.WithContext(c).Model(&folder).Update("parent_id", request.ParentId).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "folder.move", folder.ID, before, folder)
+
+	c.JSON(http.StatusOK, folder)
+}
+
+// deleteFolder soft deletes a folder, every folder below it and all of their files,
+// the same way deleteFile does for a single file.
+func (app *App) deleteFolder(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	folder, err := app.findFolder(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+		return
+	}
+
+	ids, err := app.descendantFolderIds(c, folder.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = app.transaction(c, func(tx *gorm.DB) error {
+		var fileIds []uint
+		if err := tx.Model(&File{}).Where("folder_id IN ?", ids).Pluck("id", &fileIds).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("folder_id IN ?", ids).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		for _, fileId := range fileIds {
+			if err := app.publishFileEvent(tx, eventFileDeleted, fileId); err != nil {
+				return err
+			}
+		}
+		return tx.Where("id IN ?", ids).Delete(&Folder{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "folder.delete", folder.ID, folder, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (app *App) moveFile(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	file, err := gorm.G[File](app.db).Where("id = ? AND user_id = ?", c.Param("id"), user.ID).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	var request moveFileRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.FolderId != nil {
+		if _, err := app.findFolder(c, *request.FolderId, user.ID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+			return
+		}
+	}
+
+	before := file
+	err = app.transaction(c, func(tx *gorm.DB) error {
+		if err := tx.Model(&file).Update("folder_id", request.FolderId).Error; err != nil {
+			return err
+		}
+		return app.publishFileEvent(tx, eventFileUpdated, file.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "file.move", file.ID, before, file)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFolders(t *testing.T) {
+	defer cleanUp()
+
+	_, router := setupTestApp()
+
+	w := performJSON(router, "POST", "/folders", folderRequest{Name: "a"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	var a, b, c Folder
+	w = performJSON(router, "POST", "/folders", folderRequest{Name: "a"}, cookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &a))
+
+	w = performJSON(router, "POST", "/folders", folderRequest{Name: "b", ParentId: &a.ID}, cookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+
+	w = performJSON(router, "POST", "/folders", folderRequest{Name: "c", ParentId: &b.ID}, cookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &c))
+
+	// names are unique within a parent
+	w = performJSON(router, "POST", "/folders", folderRequest{Name: "b", ParentId: &a.ID}, cookie)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performJSON(router, "GET", "/folders/by-path/a/b/c", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var found Folder
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	assert.Equal(t, c.ID, found.ID)
+
+	w = performJSON(router, "GET", "/folders/by-path/a/missing", nil, cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// a folder can't be moved below itself
+	w = performJSON(router, "POST", fmt.Sprintf("/folders/%d/move", a.ID), moveFolderRequest{ParentId: &c.ID}, cookie)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = uploadTestFile(t, router, cookie, "testfile.txt", []byte("This is a test file content."), map[string]string{"name": "in-c", "folder_id": fmt.Sprint(c.ID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, c.ID, *file.FolderId)
+
+	w = performJSON(router, "GET", fmt.Sprintf("/folders/%d/contents", c.ID), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var contents struct {
+		Folders []Folder `json:"folders"`
+		Files   []File   `json:"files"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &contents))
+	assert.Len(t, contents.Folders, 0)
+	assert.Len(t, contents.Files, 1)
+
+	// moving c to the folder it's in already is a no-op, not a name clash with itself
+	w = performJSON(router, "POST", fmt.Sprintf("/folders/%d/move", c.ID), moveFolderRequest{ParentId: c.ParentId}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// move c to the root, then the file to a
+	w = performJSON(router, "POST", fmt.Sprintf("/folders/%d/move", c.ID), moveFolderRequest{}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "POST", fmt.Sprintf("/files/%d/move", file.ID), moveFileRequest{FolderId: &a.ID}, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performJSON(router, "GET", "/folders?page_size=1", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &contents))
+	assert.Len(t, contents.Folders, 1)
+	assert.Equal(t, "a", contents.Folders[0].Name)
+
+	// deleting a removes b and the file, but not c
+	w = performJSON(router, "DELETE", fmt.Sprintf("/folders/%d", a.ID), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performJSON(router, "GET", fmt.Sprintf("/folders/%d", b.ID), nil, cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d", file.ID), nil, cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performJSON(router, "GET", "/folders/by-path/c", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// other users can't see the folders
+	otherCookie := registerTestUser(t, router, "other@test.com")
+	w = performJSON(router, "GET", fmt.Sprintf("/folders/%d", c.ID), nil, otherCookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type groupRequest struct {
+	Name string `json:"name"`
+}
+
+type groupMemberRequest struct {
+	UserId *uint  `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// findUser looks a user up by id, or by email when no id is given.
+func (app *App) findUser(ctx *gin.Context, userId *uint, email string) (User, error) {
+	switch {
+	case userId != nil:
+		return gorm.G[User](app.db).Where("id = ?", *userId).First(ctx)
+	case email != "":
+		return gorm.G[User](app.db).Where("email = ?", email).First(ctx)
+	default:
+		return User{}, gorm.ErrRecordNotFound
+	}
+}
+
+func (app *App) findOwnedGroup(ctx *gin.Context, groupId string, userId uint) (Group, error) {
+	return gorm.G[Group](app.db).Where("id = ? AND user_id = ?", groupId, userId).First(ctx)
+}
+
+// getGroups returns the groups the user owns or belongs to.
+func (app *App) getGroups(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	groups, err := gorm.G[Group](app.db).
+		Where("user_id = ? OR id IN (?)", user.ID, memberGroupIds(app.db, user.ID)).
+		Order("name").
+		Find(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+func (app *App) createGroup(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	var request groupRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group name is required"})
+		return
+	}
+
+	// the owner is a member of their own group
+	group := Group{Name: request.Name, UserId: user.ID, Members: []User{{ID: user.ID}}}
+	if err := app.db.WithContext(c).Omit("Members.*").Create(&group).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	group.Members = nil
+	app.audit(c, "group.create", group.ID, nil, group)
+	c.JSON(http.StatusCreated, group)
+}
+
+func (app *App) addGroupMember(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	group, err := app.findOwnedGroup(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return
+	}
+
+	var request groupMemberRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := app.findUser(c, request.UserId, request.Email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := app.db.WithContext(c).Model(&group).Omit("Members.*").Association("Members").Append(&member); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "group.add_member", group.ID, nil, auditedUser{ID: member.ID, Email: member.Email})
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (app *App) removeGroupMember(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	group, err := app.findOwnedGroup(c, c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return
+	}
+
+	err = app.db.WithContext(c).Table("group_members").
+		Where("group_id = ? AND user_id = ?", group.ID, c.Param("userId")).
+		Delete(nil).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "group.remove_member", group.ID, gin.H{"user_id": c.Param("userId")}, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
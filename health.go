@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/backend-project/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	checkOk   = "ok"
+	checkFail = "fail"
+)
+
+// healthCheckPrefix is where the storage check writes its probe blobs.
+const healthCheckPrefix = "healthcheck/"
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// getHealth is the liveness probe, it only says the process is up and serving.
+func getHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": checkOk})
+}
+
+// getReadiness is the readiness probe. It runs every check at once, each with its own timeout,
+// and answers 503 with the per check breakdown if any of them failed.
+func (app *App) getReadiness(c *gin.Context) {
+	checks := map[string]func(context.Context) error{
+		"database":   app.checkDatabase,
+		"storage":    app.checkStorage,
+		"migrations": app.checkMigrations,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := runCheck(c.Request.Context(), app.config.ReadyCheckTimeout, check)
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	status, code := checkOk, http.StatusOK
+	for _, result := range results {
+		if result.Status != checkOk {
+			status, code = checkFail, http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(code, gin.H{"status": status, "checks": results})
+}
+
+// runCheck runs check with a timeout. A check that doesn't return in time is
+// reported as failed without waiting for it.
+func runCheck(ctx context.Context, timeout time.Duration, check func(context.Context) error) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := checkResult{Status: checkOk, Duration: time.Since(start).Round(time.Microsecond).String()}
+	if err != nil {
+		result.Status = checkFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (app *App) checkDatabase(ctx context.Context) error {
+	sqlDB, err := app.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// checkStorage writes a small blob, reads it back and deletes it.
+func (app *App) checkStorage(ctx context.Context) error {
+	token, err := auth.RandomToken()
+	if err != nil {
+		return err
+	}
+	key := healthCheckPrefix + token
+	probe := []byte("ready " + token)
+
+	if _, err := app.store().Put(ctx, key, bytes.NewReader(probe)); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	defer func() {
+		_ = app.store().Delete(context.WithoutCancel(ctx), key)
+	}()
+
+	content, err := app.store().Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	defer content.Close()
+
+	read, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(read, probe) {
+		return fmt.Errorf("read back %d bytes that don't match what was written", len(read))
+	}
+	return nil
+}
+
+// checkMigrations makes sure every migration has been applied and every table the app uses exists.
+func (app *App) checkMigrations(ctx context.Context) error {
+	migrator, err := newMigrator(app.db)
+	if err != nil {
+		return err
+	}
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d migrations haven't been applied", pending)
+	}
+
+	db := app.db.WithContext(ctx)
+	for _, model := range migratedModels {
+		statement := &gorm.Statement{DB: db}
+		if err := statement.Parse(model); err != nil {
+			return err
+		}
+		if !db.Migrator().HasTable(statement.Schema.Table) {
+			return fmt.Errorf("table %s is missing", statement.Schema.Table)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type readiness struct {
+	Status string
+	Checks map[string]checkResult
+}
+
+func getReadinessResult(t *testing.T, router *gin.Engine) (int, readiness) {
+	w := performJSON(router, "GET", "/readyz", nil, nil)
+	var result readiness
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return w.Code, result
+}
+
+func TestHealth(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+
+	w := performJSON(router, "GET", "/healthz", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+
+	code, result := getReadinessResult(t, router)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, checkOk, result.Status)
+	assert.Len(t, result.Checks, 3)
+	for name, check := range result.Checks {
+		assert.Equal(t, checkOk, check.Status, name)
+		assert.NotEmpty(t, check.Duration, name)
+	}
+
+	// the storage probe cleans up after itself
+	entries, err := os.ReadDir(filepath.Join("files", "healthcheck"))
+	if err == nil {
+		assert.Empty(t, entries)
+	}
+
+	// an upload directory that can't be written to
+	blocked := filepath.Join(t.TempDir(), "blocked")
+	assert.NoError(t, os.WriteFile(blocked, nil, 0600))
+	app.config.Uploads.Path = blocked
+	code, result = getReadinessResult(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, checkFail, result.Status)
+	assert.Equal(t, checkFail, result.Checks["storage"].Status)
+	assert.Contains(t, result.Checks["storage"].Error, "write")
+	assert.Equal(t, checkOk, result.Checks["database"].Status)
+	app.config.Uploads.Path = "./files"
+
+	assert.NoError(t, app.db.Migrator().DropTable(&ChangeEvent{}))
+	code, result = getReadinessResult(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "table change_events is missing", result.Checks["migrations"].Error)
+
+	sqlDB, err := app.db.DB()
+	assert.NoError(t, err)
+	assert.NoError(t, sqlDB.Close())
+	code, result = getReadinessResult(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, checkFail, result.Checks["database"].Status)
+
+	// the process is still alive
+	w = performJSON(router, "GET", "/healthz", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
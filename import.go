@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/backend-project/scan"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// importRatioFloor is how much an archive has to expand before the compression ratio is checked,
+// small text files can legitimately compress very well.
+const importRatioFloor = 1 << 20 // 1 MiB
+
+var (
+	errUnsafePath       = errors.New("path escapes the archive")
+	errNotRegularFile   = errors.New("not a regular file")
+	errImportTooLarge   = errors.New("archive expands to more than the import limit")
+	errImportRatio      = errors.New("archive compression ratio is suspiciously high")
+	errImportTooMany    = errors.New("archive has too many entries")
+	errUnknownArchive   = errors.New("archive must be a zip or tar.gz")
+	errImportEntryLarge = errors.New("entry is bigger than its header says")
+)
+
+// importLimits protect against archives that expand far beyond their upload size.
+type importLimits struct {
+	MaxEntries int   `yaml:"max_entries" env:"IMPORT_MAX_ENTRIES"`
+	MaxBytes   int64 `yaml:"max_bytes" env:"IMPORT_MAX_BYTES"`
+	MaxRatio   int64 `yaml:"max_ratio" env:"IMPORT_MAX_RATIO"`
+}
+
+// expansionGuard counts the bytes coming out of an archive and fails the read
+// as soon as the total or the ratio to the compressed bytes read goes over the limits.
+type expansionGuard struct {
+	limits     importLimits
+	expanded   int64
+	compressed func() int64
+}
+
+func (guard *expansionGuard) add(n int) error {
+	guard.expanded += int64(n)
+	if guard.expanded > guard.limits.MaxBytes {
+		return errImportTooLarge
+	}
+
+	compressed := guard.compressed()
+	if guard.expanded > importRatioFloor && compressed > 0 && guard.expanded/compressed > guard.limits.MaxRatio {
+		return errImportRatio
+	}
+	return nil
+}
+
+// guardedReader reads one archive entry through an expansionGuard.
+type guardedReader struct {
+	r     io.Reader
+	guard *expansionGuard
+}
+
+func (r guardedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if guardErr := r.guard.add(n); guardErr != nil {
+		return n, guardErr
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// cleanEntryPath turns an archive entry name into a clean relative path, rejecting anything
+// that would land outside the import's destination (zip slip).
+func cleanEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", errUnsafePath
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", errUnsafePath
+		}
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == "" {
+		return "", errUnsafePath
+	}
+	return cleaned, nil
+}
+
+// archiveWalker calls fn for every entry in an archive, stopping at the first error fn returns.
+type archiveWalker func(fn func(name string, isDir bool, content io.Reader) error) error
+
+// openArchive works out whether the upload is a zip or a tar.gz from its first bytes.
+func openArchive(upload io.ReaderAt, size int64, guard *expansionGuard) (archiveWalker, error) {
+	magic := make([]byte, 4)
+	if _, err := upload.ReadAt(magic, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		archive, err := zip.NewReader(upload, size)
+		if err != nil {
+			return nil, err
+		}
+		return zipWalker(archive, guard), nil
+
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		compressed := &countingReader{r: io.NewSectionReader(upload, 0, size)}
+		guard.compressed = func() int64 { return compressed.n }
+		return tarGzWalker(compressed, guard), nil
+
+	default:
+		return nil, errUnknownArchive
+	}
+}
+
+func zipWalker(archive *zip.Reader, guard *expansionGuard) archiveWalker {
+	return func(fn func(name string, isDir bool, content io.Reader) error) error {
+		var compressed int64
+		guard.compressed = func() int64 { return compressed }
+
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() {
+				if err := fn(entry.Name, true, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if !entry.Mode().IsRegular() {
+				if err := fn(entry.Name, false, errReader{errNotRegularFile}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			content, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			compressed += int64(entry.CompressedSize64)
+
+			// the size in the header can't be trusted, so stop reading just past it
+			limited := &io.LimitedReader{R: content, N: int64(entry.UncompressedSize64) + 1}
+			err = fn(entry.Name, false, guardedReader{r: sizeCheckedReader{limited}, guard: guard})
+			content.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func tarGzWalker(compressed io.Reader, guard *expansionGuard) archiveWalker {
+	return func(fn func(name string, isDir bool, content io.Reader) error) error {
+		decompressed, err := gzip.NewReader(bufio.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+
+		// headers and padding count towards the limits too
+		archive := tar.NewReader(guardedReader{r: decompressed, guard: guard})
+		for {
+			header, err := archive.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			switch header.Typeflag {
+			case tar.TypeDir:
+				err = fn(header.Name, true, nil)
+			case tar.TypeReg:
+				err = fn(header.Name, false, archive)
+			case tar.TypeXGlobalHeader:
+				continue
+			default:
+				err = fn(header.Name, false, errReader{errNotRegularFile})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// errReader fails every read, for entries that are reported but can't be imported.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// sizeCheckedReader fails once a LimitedReader set one byte past the expected size runs out.
+type sizeCheckedReader struct {
+	r *io.LimitedReader
+}
+
+func (r sizeCheckedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.r.N <= 0 {
+		return n, errImportEntryLarge
+	}
+	return n, err
+}
+
+type importedEntry struct {
+	Path string `json:"path"`
+	File File   `json:"file"`
+}
+
+type rejectedEntry struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// isArchiveAbort reports whether an error should stop the whole import rather than just one entry.
+func isArchiveAbort(err error) bool {
+	return errors.Is(err, errImportTooLarge) || errors.Is(err, errImportRatio) ||
+		errors.Is(err, errImportTooMany) || errors.Is(err, zip.ErrFormat) ||
+		errors.Is(err, gzip.ErrHeader) || errors.Is(err, tar.ErrHeader)
+}
+
+// importFolder finds the folder called name under parentId, creating it if it doesn't exist.
+func (app *App) importFolder(c *gin.Context, userId uint, parentId *uint, name string) (*uint, error) {
+	var folder Folder
+	query := app.db.WithContext(c).Where("user_id = ? AND name = ?", userId, name)
+	err := whereParent(query, "parent_id", parentId).First(&folder).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		folder = Folder{Name: name, ParentId: parentId, UserId: userId}
+		err = app.db.WithContext(c).Create(&folder).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &folder.ID, nil
+}
+
+// importEntry stores one archive entry and creates its file, the same way createFile would for an upload.
+func (app *App) importEntry(c *gin.Context, user User, name string, folderId *uint, content io.Reader) (File, error) {
+	key, err := app.files.UniqueKey(c)
+	if err != nil {
+		return File{}, err
+	}
+	size, err := app.store().Put(c, key, content)
+	if err != nil {
+		_ = app.store().Delete(c, key)
+		return File{}, err
+	}
+
+	stored, err := app.store().Open(c, key)
+	if err != nil {
+		_ = app.store().Delete(c, key)
+		return File{}, err
+	}
+	contentType, err := app.config.Uploads.policy().check(name, stored)
+	stored.Close()
+	if err != nil {
+		_ = app.store().Delete(c, key)
+		return File{}, err
+	}
+
+	scanStatus, _, err := app.scanUpload(c, key)
+	if err != nil {
+		_ = app.store().Delete(c, key)
+		return File{}, err
+	}
+
+	file := File{
+		Name:        name,
+		FilePath:    key,
+		Tags:        []Tag{},
+		UserId:      user.ID,
+		FolderId:    folderId,
+		Size:        size,
+		ContentType: contentType,
+		ScanStatus:  scanStatus,
+	}
+	if err := app.insertFile(c, user, &file, nil); err != nil {
+		_ = app.store().Delete(c, storageKey(file))
+		return File{}, err
+	}
+	if scanStatus == scan.StatusInfected {
+		return file, errors.New("file is infected")
+	}
+
+	return file, nil
+}
+
+// importArchive turns each entry of an uploaded zip or tar.gz into a file. With folders set the
+// entries' directories are recreated as folders under folder_id, otherwise every file goes straight into it.
+func (app *App) importArchive(c *gin.Context) {
+	user, _ := currentUser(c)
+	limits := app.config.Import
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxBytes+multipartOverhead)
+	upload, err := c.FormFile("file")
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errImportTooLarge.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var destination *uint
+	if rawFolderId := c.PostForm("folder_id"); rawFolderId != "" {
+		folder, err := app.findFolder(c, rawFolderId, user.ID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+			return
+		}
+		destination = &folder.ID
+	}
+	mirrorFolders, _ := strconv.ParseBool(c.PostForm("folders"))
+
+	archiveFile, err := upload.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer archiveFile.Close()
+
+	guard := &expansionGuard{limits: limits}
+	walk, err := openArchive(archiveFile, upload.Size, guard)
+	if errors.Is(err, errUnknownArchive) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	imported := []importedEntry{}
+	rejected := []rejectedEntry{}
+	folderIds := map[string]*uint{".": destination}
+	entries := 0
+
+	// folderFor creates the folders for dir one level at a time, remembering the ones already made
+	var folderFor func(dir string) (*uint, error)
+	folderFor = func(dir string) (*uint, error) {
+		if folderId, ok := folderIds[dir]; ok {
+			return folderId, nil
+		}
+		parentId, err := folderFor(path.Dir(dir))
+		if err != nil {
+			return nil, err
+		}
+		folderId, err := app.importFolder(c, user.ID, parentId, path.Base(dir))
+		if err != nil {
+			return nil, err
+		}
+		folderIds[dir] = folderId
+		return folderId, nil
+	}
+
+	walkErr := walk(func(rawName string, isDir bool, content io.Reader) error {
+		entries++
+		if entries > limits.MaxEntries {
+			return errImportTooMany
+		}
+
+		entryPath, err := cleanEntryPath(rawName)
+		if err != nil {
+			rejected = append(rejected, rejectedEntry{Path: rawName, Error: err.Error()})
+			return nil
+		}
+		if isDir {
+			if mirrorFolders {
+				if _, err := folderFor(entryPath); err != nil {
+					rejected = append(rejected, rejectedEntry{Path: rawName, Error: err.Error()})
+				}
+			}
+			return nil
+		}
+
+		folderId := destination
+		if mirrorFolders {
+			if folderId, err = folderFor(path.Dir(entryPath)); err != nil {
+				rejected = append(rejected, rejectedEntry{Path: rawName, Error: err.Error()})
+				return nil
+			}
+		}
+
+		file, err := app.importEntry(c, user, path.Base(entryPath), folderId, content)
+		if isArchiveAbort(err) {
+			return err
+		}
+		if err != nil {
+			rejected = append(rejected, rejectedEntry{Path: rawName, Error: err.Error()})
+			return nil
+		}
+		imported = append(imported, importedEntry{Path: entryPath, File: file})
+		app.audit(c, "file.import", file.ID, nil, file)
+		return nil
+	})
+
+	report := gin.H{"imported": imported, "rejected": rejected}
+	switch {
+	case walkErr == nil:
+		c.JSON(http.StatusOK, report)
+	case errors.Is(walkErr, errImportTooLarge) || errors.Is(walkErr, errImportRatio) || errors.Is(walkErr, errImportTooMany):
+		// whatever was imported before the limit was hit is kept, the report says how far it got
+		report["error"] = fmt.Sprintf("import stopped: %v", walkErr)
+		c.JSON(http.StatusRequestEntityTooLarge, report)
+	default:
+		report["error"] = fmt.Sprintf("import stopped: %v", walkErr)
+		c.JSON(http.StatusBadRequest, report)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type importReport struct {
+	Error    string          `json:"error"`
+	Imported []importedEntry `json:"imported"`
+	Rejected []rejectedEntry `json:"rejected"`
+}
+
+func TestCleanEntryPath(t *testing.T) {
+	for name, expected := range map[string]string{
+		"a.txt":          "a.txt",
+		"docs/./a.txt":   "docs/a.txt",
+		"docs\\sub\\b":   "docs/sub/b",
+		"docs/":          "docs",
+		"../evil.txt":    "",
+		"docs/../../x":   "",
+		"/etc/passwd":    "",
+		"C:\\Windows\\x": "",
+	} {
+		cleaned, err := cleanEntryPath(name)
+		if expected == "" {
+			assert.ErrorIs(t, err, errUnsafePath, name)
+		} else {
+			assert.NoError(t, err, name)
+			assert.Equal(t, expected, cleaned, name)
+		}
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	zipped := testZip(t, map[string][]byte{
+		"docs/a.txt":     []byte("a"),
+		"docs/sub/b.txt": []byte("b"),
+		"c.txt":          []byte("c"),
+		"../evil.txt":    []byte("evil"),
+		"/abs.txt":       []byte("abs"),
+	})
+
+	var report importReport
+	w := postTestFile(t, router, "/files/import", cookie, "import.zip", zipped, map[string]string{"folders": "true"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Imported, 3)
+	assert.Len(t, report.Rejected, 2)
+	assert.Equal(t, errUnsafePath.Error(), report.Rejected[0].Error)
+
+	var sub Folder
+	w = performJSON(router, "GET", "/folders/by-path/docs/sub", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &sub))
+	for _, entry := range report.Imported {
+		if entry.Path == "docs/sub/b.txt" {
+			assert.Equal(t, "b.txt", entry.File.Name)
+			assert.Equal(t, sub.ID, *entry.File.FolderId)
+		}
+	}
+
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d/content", report.Imported[0].File.ID), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// without folders everything goes into the destination folder
+	report = importReport{}
+	tarred := testTarGz(t, map[string][]byte{"x/one.txt": []byte("one"), "two.txt": []byte("two")})
+	w = postTestFile(t, router, "/files/import", cookie, "import.tar.gz", tarred, map[string]string{"folder_id": fmt.Sprint(sub.ID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Imported, 2)
+	for _, entry := range report.Imported {
+		assert.Equal(t, sub.ID, *entry.File.FolderId)
+	}
+
+	// archives that expand too much are stopped part way through
+	bomb := testZip(t, map[string][]byte{"zeros.bin": make([]byte, 4<<20)})
+	app.config.Import.MaxRatio = 10
+	w = postTestFile(t, router, "/files/import", cookie, "bomb.zip", bomb, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), errImportRatio.Error())
+
+	app.config.Import.MaxRatio = 100000
+	app.config.Import.MaxBytes = 3 << 20
+	w = postTestFile(t, router, "/files/import", cookie, "bomb.zip", bomb, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), errImportTooLarge.Error())
+
+	w = postTestFile(t, router, "/files/import", cookie, "notes.txt", []byte("not an archive"), nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	w = postTestFile(t, router, "/files/import", nil, "import.zip", zipped, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func testZip(t *testing.T, files map[string][]byte) []byte {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write(content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, archive.Close())
+	return buffer.Bytes()
+}
+
+func testTarGz(t *testing.T, files map[string][]byte) []byte {
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressed)
+	for name, content := range files {
+		assert.NoError(t, archive.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := archive.Write(content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, compressed.Close())
+	return buffer.Bytes()
+}
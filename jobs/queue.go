@@ -0,0 +1,399 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	// StatusDead is for jobs that ran out of attempts, they stay put until someone retries them.
+	StatusDead = "dead"
+)
+
+const defaultMaxAttempts = 5
+
+var ErrNotRetryable = errors.New("only dead jobs can be retried")
+
+// Job is a unit of background work stored in the jobs table.
+type Job struct {
+	ID             uint       `gorm:"primarykey"`
+	CreatedAt      time.Time  ``
+	UpdatedAt      time.Time  ``
+	Type           string     `gorm:"size:100;index"`
+	Payload        string     `gorm:"type:text"`
+	Status         string     `gorm:"size:20;index:idx_jobs_status_run_at"`
+	RunAt          time.Time  `gorm:"index:idx_jobs_status_run_at"`
+	Attempts       int        ``
+	MaxAttempts    int        ``
+	LastError      string     `gorm:"type:text"`
+	IdempotencyKey *string    `gorm:"size:191;uniqueIndex"`
+	LockedBy       string     `gorm:"size:100"`
+	LockedAt       *time.Time ``
+	FinishedAt     *time.Time ``
+}
+
+// Decode unmarshals the job's payload into v.
+func (job Job) Decode(v any) error {
+	return json.Unmarshal([]byte(job.Payload), v)
+}
+
+// Spec describes a job to enqueue. A job with the same IdempotencyKey is only ever enqueued once.
+type Spec struct {
+	Type           string
+	Payload        any
+	IdempotencyKey string
+	MaxAttempts    int
+	RunAt          time.Time
+}
+
+// Handler does the work for one type of job, returning an error makes the job retry later.
+type Handler func(ctx context.Context, job Job) error
+
+// Queue stores jobs in the database and runs them on a pool of workers.
+// Several processes can share a queue, a job is claimed by exactly one worker.
+type Queue struct {
+	db       *gorm.DB
+	handlers map[string]Handler
+	workerId string
+	wake     chan struct{}
+	wg       sync.WaitGroup
+	// cancelRunning cancels the context of the jobs the workers are running
+	cancelRunning context.CancelFunc
+
+	PollInterval time.Duration
+	// LockTimeout is how long a job can run before it's assumed its worker died and it's run again.
+	LockTimeout time.Duration
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// CancelGrace is how long Wait gives cancelled jobs to return before leaving them behind.
+	CancelGrace time.Duration
+	// Logger is where worker errors and failed jobs are logged, slog.Default() when nil.
+	Logger *slog.Logger
+}
+
+func NewQueue(db *gorm.DB) *Queue {
+	hostname, _ := os.Hostname()
+
+	return &Queue{
+		db:           db,
+		handlers:     map[string]Handler{},
+		workerId:     fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.IntN(1_000_000)),
+		wake:         make(chan struct{}, 1),
+		PollInterval: time.Second,
+		LockTimeout:  15 * time.Minute,
+		BaseBackoff:  10 * time.Second,
+		MaxBackoff:   time.Hour,
+		CancelGrace:  2 * time.Second,
+	}
+}
+
+func (queue *Queue) Handle(jobType string, handler Handler) {
+	queue.handlers[jobType] = handler
+}
+
+// Enqueue adds a job, see EnqueueTx to add it as part of a transaction.
+func (queue *Queue) Enqueue(ctx context.Context, spec Spec) (Job, error) {
+	job, err := queue.EnqueueTx(queue.db.WithContext(ctx), spec)
+	if err == nil {
+		queue.Notify()
+	}
+	return job, err
+}
+
+// EnqueueTx adds a job using tx, so it's only run if the transaction commits.
+// The workers can't see the job before then, call Notify once it has committed.
+// If a job with the same idempotency key exists already, that job is returned instead.
+func (queue *Queue) EnqueueTx(tx *gorm.DB, spec Spec) (Job, error) {
+	payload, err := json.Marshal(spec.Payload)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job := Job{
+		Type:        spec.Type,
+		Payload:     string(payload),
+		Status:      StatusPending,
+		RunAt:       spec.RunAt,
+		MaxAttempts: spec.MaxAttempts,
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = defaultMaxAttempts
+	}
+	if spec.IdempotencyKey != "" {
+		job.IdempotencyKey = &spec.IdempotencyKey
+	}
+
+	result := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "idempotency_key"}}, DoNothing: true}).Create(&job)
+	if result.Error != nil {
+		return Job{}, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		var existing Job
+		err := tx.Where("idempotency_key = ?", spec.IdempotencyKey).First(&existing).Error
+		return existing, err
+	}
+	return job, nil
+}
+
+// Notify wakes an idle worker to look for jobs, without waiting for the next poll.
+func (queue *Queue) Notify() {
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Retry puts a dead job back in the queue with a fresh set of attempts.
+func (queue *Queue) Retry(ctx context.Context, id uint) (Job, error) {
+	result := queue.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND status = ?", id, StatusDead).
+		Updates(map[string]any{"status": StatusPending, "attempts": 0, "run_at": time.Now(), "finished_at": nil})
+	if result.Error != nil {
+		return Job{}, result.Error
+	}
+
+	var job Job
+	if err := queue.db.WithContext(ctx).First(&job, id).Error; err != nil {
+		return Job{}, err
+	}
+	if result.RowsAffected == 0 {
+		return job, ErrNotRetryable
+	}
+
+	queue.Notify()
+	return job, nil
+}
+
+// Start runs workers until ctx is cancelled, use Wait to wait for them to finish their current jobs.
+// Cancelling ctx stops workers picking up new jobs, a job that's already running gets to finish.
+func (queue *Queue) Start(ctx context.Context, workers int) {
+	// a job stopped halfway would sit locked until LockTimeout, so it isn't cancelled with the workers
+	runCtx, cancelRunning := context.WithCancel(context.WithoutCancel(ctx))
+	queue.cancelRunning = cancelRunning
+
+	for range workers {
+		queue.wg.Add(1)
+		go func() {
+			defer queue.wg.Done()
+			queue.work(ctx, runCtx)
+		}()
+	}
+}
+
+// Wait waits for the workers to stop after the ctx given to Start is cancelled. If ctx here is done
+// first, the jobs still running have their context cancelled, and Wait returns ctx's error once
+// they've given up or CancelGrace has passed. Jobs that ignore being cancelled are left running and
+// run again after LockTimeout.
+func (queue *Queue) Wait(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		queue.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		if queue.cancelRunning != nil {
+			queue.cancelRunning()
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	queue.logger().Warn("Cancelling running jobs", "error", ctx.Err())
+	if queue.cancelRunning != nil {
+		queue.cancelRunning()
+	}
+	select {
+	case <-stopped:
+	case <-time.After(queue.CancelGrace):
+		queue.logger().Error("Running jobs didn't stop when cancelled, leaving them behind", "grace", queue.CancelGrace)
+	}
+	return ctx.Err()
+}
+
+func (queue *Queue) logger() *slog.Logger {
+	if queue.Logger != nil {
+		return queue.Logger
+	}
+	return slog.Default()
+}
+
+func (queue *Queue) work(ctx context.Context, runCtx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := queue.RunOnce(runCtx)
+		if err != nil {
+			queue.logger().Error("Job queue failed", "error", err)
+		}
+		if ran {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-queue.wake:
+		case <-time.After(queue.PollInterval):
+		}
+	}
+}
+
+// RunOnce claims and runs one job that's due, if there is one, and reports whether it did.
+func (queue *Queue) RunOnce(ctx context.Context) (bool, error) {
+	if err := queue.releaseStaleJobs(ctx); err != nil {
+		return false, err
+	}
+
+	job, err := queue.claim(ctx)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	// a job cancelled part way is still recorded, so it's retried instead of waiting out its lock
+	return true, queue.finish(context.WithoutCancel(ctx), *job, queue.run(ctx, *job))
+}
+
+// errWorkerLost is recorded on jobs whose worker stopped before finishing them.
+var errWorkerLost = errors.New("worker lost")
+
+// releaseStaleJobs deals with jobs that have been running for longer than LockTimeout the way
+// finish deals with failed ones: they're retried after the usual backoff, or dead once they've
+// used up their attempts, so a job that keeps killing its worker doesn't run forever.
+func (queue *Queue) releaseStaleJobs(ctx context.Context) error {
+	var stale []Job
+	err := queue.db.WithContext(ctx).
+		Where("status = ? AND locked_at < ?", StatusRunning, time.Now().Add(-queue.LockTimeout)).
+		Find(&stale).Error
+	if err != nil {
+		return err
+	}
+
+	for _, job := range stale {
+		now := time.Now()
+		updates := map[string]any{"locked_by": "", "locked_at": nil, "last_error": errWorkerLost.Error()}
+		if job.Attempts >= job.MaxAttempts {
+			updates["status"] = StatusDead
+			updates["finished_at"] = now
+			queue.logger().Error("Job failed for good", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", errWorkerLost)
+		} else {
+			updates["status"] = StatusPending
+			updates["run_at"] = now.Add(queue.backoff(job.Attempts))
+			queue.logger().Warn("Job failed, retrying", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "run_at", updates["run_at"], "error", errWorkerLost)
+		}
+
+		// another worker may have released it already
+		err := queue.db.WithContext(ctx).Model(&Job{}).
+			Where("id = ? AND status = ? AND locked_by = ?", job.ID, StatusRunning, job.LockedBy).
+			Updates(updates).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim picks a due job and marks it running. The update only matches while the job is
+// still pending, so when two workers race for a job only one of them gets it.
+func (queue *Queue) claim(ctx context.Context) (*Job, error) {
+	var candidates []Job
+	err := queue.db.WithContext(ctx).
+		Where("status = ? AND run_at <= ?", StatusPending, time.Now()).
+		Order("run_at").
+		Limit(10).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range candidates {
+		now := time.Now()
+		result := queue.db.WithContext(ctx).Model(&Job{}).
+			Where("id = ? AND status = ?", job.ID, StatusPending).
+			Updates(map[string]any{
+				"status":    StatusRunning,
+				"locked_by": queue.workerId,
+				"locked_at": now,
+				"attempts":  gorm.Expr("attempts + 1"),
+			})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			job.Status = StatusRunning
+			job.LockedBy = queue.workerId
+			job.LockedAt = &now
+			job.Attempts++
+			return &job, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (queue *Queue) run(ctx context.Context, job Job) (err error) {
+	handler, ok := queue.handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("no handler for job type %q", job.Type)
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// backoff doubles the wait after every failed attempt, with some jitter so retries spread out.
+func (queue *Queue) backoff(attempts int) time.Duration {
+	delay := queue.BaseBackoff << min(attempts-1, 20)
+	if delay <= 0 || delay > queue.MaxBackoff {
+		delay = queue.MaxBackoff
+	}
+	return delay + rand.N(delay/4+1)
+}
+
+func (queue *Queue) finish(ctx context.Context, job Job, jobErr error) error {
+	now := time.Now()
+	updates := map[string]any{"locked_by": "", "locked_at": nil}
+
+	_, known := queue.handlers[job.Type]
+	switch {
+	case jobErr == nil:
+		updates["status"] = StatusSucceeded
+		updates["finished_at"] = now
+		updates["last_error"] = ""
+	case job.Attempts >= job.MaxAttempts || !known:
+		updates["status"] = StatusDead
+		updates["finished_at"] = now
+		updates["last_error"] = jobErr.Error()
+		queue.logger().Error("Job failed for good", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", jobErr)
+	default:
+		updates["status"] = StatusPending
+		updates["run_at"] = now.Add(queue.backoff(job.Attempts))
+		updates["last_error"] = jobErr.Error()
+		queue.logger().Warn("Job failed, retrying", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "run_at", updates["run_at"], "error", jobErr)
+	}
+
+	// only touch the job if this worker still holds it
+	return queue.db.WithContext(ctx).Model(&Job{}).
+		Where("id = ? AND locked_by = ?", job.ID, queue.workerId).
+		Updates(updates).Error
+}
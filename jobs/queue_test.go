@@ -0,0 +1,273 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupQueue(t *testing.T) *Queue {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "jobs.db")), &gorm.Config{Logger: logger.Discard})
+	assert.NoError(t, err)
+	assert.NoError(t, db.AutoMigrate(&Job{}))
+
+	queue := NewQueue(db)
+	queue.BaseBackoff = time.Millisecond
+	queue.MaxBackoff = time.Millisecond
+	queue.PollInterval = 10 * time.Millisecond
+	return queue
+}
+
+func TestRetriesUntilDead(t *testing.T) {
+	ctx := context.Background()
+	queue := setupQueue(t)
+
+	var payloads []string
+	queue.Handle("fail", func(ctx context.Context, job Job) error {
+		var payload struct{ Name string }
+		assert.NoError(t, job.Decode(&payload))
+		payloads = append(payloads, payload.Name)
+		return errors.New("broken")
+	})
+
+	job, err := queue.Enqueue(ctx, Spec{Type: "fail", Payload: map[string]string{"Name": "a"}, MaxAttempts: 2})
+	assert.NoError(t, err)
+
+	ran, err := queue.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ran)
+
+	// not due again until the backoff has passed
+	assert.NoError(t, queue.db.First(&job, job.ID).Error)
+	assert.Equal(t, StatusPending, job.Status)
+	assert.Equal(t, "broken", job.LastError)
+	assert.True(t, job.RunAt.After(job.CreatedAt))
+
+	time.Sleep(5 * time.Millisecond)
+	ran, err = queue.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ran)
+
+	assert.NoError(t, queue.db.First(&job, job.ID).Error)
+	assert.Equal(t, StatusDead, job.Status)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Equal(t, []string{"a", "a"}, payloads)
+
+	ran, err = queue.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.False(t, ran)
+
+	// retrying gives it a fresh set of attempts
+	job, err = queue.Retry(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, job.Status)
+	assert.Equal(t, 0, job.Attempts)
+	_, err = queue.Retry(ctx, job.ID)
+	assert.ErrorIs(t, err, ErrNotRetryable)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	queue := setupQueue(t)
+
+	first, err := queue.Enqueue(ctx, Spec{Type: "a", IdempotencyKey: "once"})
+	assert.NoError(t, err)
+	second, err := queue.Enqueue(ctx, Spec{Type: "a", IdempotencyKey: "once"})
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, second.ID)
+
+	// jobs without keys don't clash
+	third, err := queue.Enqueue(ctx, Spec{Type: "a"})
+	assert.NoError(t, err)
+	fourth, err := queue.Enqueue(ctx, Spec{Type: "a"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, third.ID, fourth.ID)
+}
+
+func TestEnqueueTxWakesAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	queue := setupQueue(t)
+
+	// a worker woken inside the transaction couldn't see the job yet
+	err := queue.db.Transaction(func(tx *gorm.DB) error {
+		_, err := queue.EnqueueTx(tx, Spec{Type: "noop"})
+		assert.Empty(t, queue.wake)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, queue.wake)
+
+	queue.Notify()
+	assert.Len(t, queue.wake, 1)
+	<-queue.wake
+
+	_, err = queue.Enqueue(ctx, Spec{Type: "noop"})
+	assert.NoError(t, err)
+	assert.Len(t, queue.wake, 1)
+}
+
+func TestUnknownTypeAndPanics(t *testing.T) {
+	ctx := context.Background()
+	queue := setupQueue(t)
+	queue.Handle("panic", func(ctx context.Context, job Job) error {
+		panic("oops")
+	})
+
+	unknown, err := queue.Enqueue(ctx, Spec{Type: "unknown"})
+	assert.NoError(t, err)
+	panics, err := queue.Enqueue(ctx, Spec{Type: "panic", MaxAttempts: 1})
+	assert.NoError(t, err)
+
+	for range 2 {
+		_, err := queue.RunOnce(ctx)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, queue.db.First(&unknown, unknown.ID).Error)
+	assert.Equal(t, StatusDead, unknown.Status)
+	assert.NoError(t, queue.db.First(&panics, panics.ID).Error)
+	assert.Equal(t, StatusDead, panics.Status)
+	assert.Contains(t, panics.LastError, "oops")
+}
+
+func TestWorkers(t *testing.T) {
+	queue := setupQueue(t)
+
+	var count atomic.Int32
+	queue.Handle("count", func(ctx context.Context, job Job) error {
+		count.Add(1)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue.Start(ctx, 3)
+
+	for range 10 {
+		_, err := queue.Enqueue(ctx, Spec{Type: "count"})
+		assert.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool { return count.Load() == 10 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, queue.Wait(context.Background()))
+
+	// every job ran exactly once
+	var succeeded int64
+	assert.NoError(t, queue.db.Model(&Job{}).Where("status = ?", StatusSucceeded).Count(&succeeded).Error)
+	assert.Equal(t, int64(10), succeeded)
+	assert.Equal(t, int32(10), count.Load())
+}
+
+func TestStaleJobsAreReleased(t *testing.T) {
+	ctx := context.Background()
+	queue := setupQueue(t)
+	queue.LockTimeout = time.Millisecond
+	queue.Handle("a", func(ctx context.Context, job Job) error { return nil })
+
+	job, err := queue.Enqueue(ctx, Spec{Type: "a"})
+	assert.NoError(t, err)
+
+	// a worker that claimed the job and died
+	claimed, err := queue.claim(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, job.ID, claimed.ID)
+
+	// it's retried after the backoff, like a job that failed
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, queue.releaseStaleJobs(ctx))
+	assert.NoError(t, queue.db.First(&job, job.ID).Error)
+	assert.Equal(t, StatusPending, job.Status)
+	assert.Equal(t, "worker lost", job.LastError)
+	assert.True(t, job.RunAt.After(*claimed.LockedAt))
+
+	time.Sleep(5 * time.Millisecond)
+	ran, err := queue.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ran)
+
+	assert.NoError(t, queue.db.First(&job, job.ID).Error)
+	assert.Equal(t, StatusSucceeded, job.Status)
+
+	// a job that keeps losing its worker runs out of attempts
+	job, err = queue.Enqueue(ctx, Spec{Type: "a", MaxAttempts: 1})
+	assert.NoError(t, err)
+	_, err = queue.claim(ctx)
+	assert.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	ran, err = queue.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.False(t, ran)
+
+	assert.NoError(t, queue.db.First(&job, job.ID).Error)
+	assert.Equal(t, StatusDead, job.Status)
+	assert.Equal(t, "worker lost", job.LastError)
+	assert.NotNil(t, job.FinishedAt)
+}
+
+func TestWaitCancelsRunningJobs(t *testing.T) {
+	queue := setupQueue(t)
+
+	started := make(chan struct{})
+	queue.Handle("slow", func(ctx context.Context, job Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue.Start(ctx, 1)
+	job, err := queue.Enqueue(ctx, Spec{Type: "slow"})
+	assert.NoError(t, err)
+	<-started
+
+	cancel()
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelWait()
+	assert.ErrorIs(t, queue.Wait(waitCtx), context.DeadlineExceeded)
+
+	// the job gave up and was put back to run again
+	assert.NoError(t, queue.db.First(&job, job.ID).Error)
+	assert.Equal(t, StatusPending, job.Status)
+	assert.Equal(t, context.Canceled.Error(), job.LastError)
+}
+
+func TestWaitGivesUpOnJobsIgnoringCancel(t *testing.T) {
+	queue := setupQueue(t)
+	queue.CancelGrace = 20 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	queue.Handle("stubborn", func(ctx context.Context, job Job) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue.Start(ctx, 1)
+	_, err := queue.Enqueue(ctx, Spec{Type: "stubborn"})
+	assert.NoError(t, err)
+	<-started
+
+	cancel()
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelWait()
+	waited := make(chan error, 1)
+	go func() { waited <- queue.Wait(waitCtx) }()
+	select {
+	case err := <-waited:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't give up on a job that ignores being cancelled")
+	}
+}
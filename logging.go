@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIdHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+// redacted replaces anything that looks like a credential in log output.
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute names whose values are never logged, matched case-insensitively anywhere in the name.
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie", "jwt", "signature", "dsn"}
+
+// jwtPattern catches JWTs that end up inside other values, like error messages.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+
+// validRequestId keeps client supplied request IDs short and printable, so they can't break the log format.
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func parseLogLevel(raw string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(raw)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// newLogger writes to w at the configured level (info if it isn't one),
+// as JSON when the format is json and as key=value text otherwise.
+func newLogger(w io.Writer, config LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level:       parseLogLevel(config.Level),
+		ReplaceAttr: redactAttr,
+	}
+
+	if strings.EqualFold(config.Format, "json") {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// setupLogger makes the configured logger the default, for the app and for packages that use slog directly.
+func setupLogger(w io.Writer, config LogConfig) {
+	slog.SetDefault(newLogger(w, config))
+}
+
+// redactAttr hides the values of sensitive attributes and any JWTs in the rest.
+func redactAttr(_ []string, attr slog.Attr) slog.Attr {
+	key := strings.ToLower(attr.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(attr.Key, redacted)
+		}
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(redactString(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			attr.Value = slog.StringValue(redactString(err.Error()))
+		}
+	}
+	return attr
+}
+
+func redactString(s string) string {
+	return jwtPattern.ReplaceAllString(s, redacted)
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestLogging gives every request an ID, taken from X-Request-ID when the client sent a usable
+// one, echoes it back, and logs the request when it's done. Handlers log through logFor(c) so their
+// lines carry the same ID.
+func requestLogging(c *gin.Context) {
+	requestId := c.GetHeader(requestIdHeader)
+	if !validRequestId.MatchString(requestId) {
+		requestId = newRequestId()
+	}
+	c.Header(requestIdHeader, requestId)
+
+	logger := slog.Default().With("request_id", requestId)
+	if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.IsValid() {
+		logger = logger.With("trace_id", spanContext.TraceID().String())
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), loggerKey{}, logger))
+
+	start := time.Now()
+	c.Next()
+
+	// the query is left out, presigned urls carry their signature in it
+	attrs := []any{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"ip", c.ClientIP(),
+	}
+	if user, ok := currentUser(c); ok {
+		attrs = append(attrs, "user_id", user.ID)
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, "errors", c.Errors.String())
+	}
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	logger.Log(c.Request.Context(), level, "Request", attrs...)
+}
+
+// recoverPanic turns a panicking handler into a 500. Unlike gin's recovery it logs through slog,
+// so the request ID is attached and request headers like the token cookie aren't dumped.
+func recoverPanic(c *gin.Context) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logFor(c).Error("Handler panicked", "error", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}()
+
+	c.Next()
+}
+
+// logFor returns the logger for the request ctx belongs to, or the default logger outside of requests.
+func logFor(ctx context.Context) *slog.Logger {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs sends the default logger to a buffer as JSON until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&buffer, LogConfig{Level: "debug", Format: "json"}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buffer
+}
+
+func TestRequestId(t *testing.T) {
+	defer cleanUp()
+
+	_, router := setupTestApp()
+	logs := captureLogs(t)
+
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set(requestIdHeader, "client-id.123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "client-id.123", w.Header().Get(requestIdHeader))
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &line))
+	assert.Equal(t, "Request", line["msg"])
+	assert.Equal(t, "client-id.123", line["request_id"])
+	assert.Equal(t, "/ping", line["path"])
+	assert.Equal(t, float64(http.StatusOK), line["status"])
+
+	// ids that could break the log format are replaced
+	for _, requestId := range []string{"", "has spaces", strings.Repeat("a", 129)} {
+		req, _ = http.NewRequest("GET", "/ping", nil)
+		req.Header.Set(requestIdHeader, requestId)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Regexp(t, "^[0-9a-f]{32}$", w.Header().Get(requestIdHeader))
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	defer cleanUp()
+
+	_, router := setupTestApp()
+	logs := captureLogs(t)
+
+	cookie := registerTestUser(t, router, "test@test.com")
+	w := performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "secret"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", "/me/usage?token="+cookie.Value, nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	slog.Info("Testing", "password", "hunter2", "Authorization", "Bearer abc", "error", errors.New("bad jwt "+cookie.Value))
+
+	assert.NotEmpty(t, cookie.Value)
+	assert.NotContains(t, logs.String(), cookie.Value)
+	assert.NotContains(t, logs.String(), "hunter2")
+	assert.NotContains(t, logs.String(), "Bearer abc")
+	assert.Contains(t, logs.String(), `"error":"bad jwt [REDACTED]"`)
+	assert.Contains(t, logs.String(), `"user_id":1`)
+}
+
+func TestParseLogLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, parseLogLevel("debug"))
+	assert.Equal(t, slog.LevelWarn, parseLogLevel("WARN"))
+	assert.Equal(t, slog.LevelInfo, parseLogLevel(""))
+	assert.Equal(t, slog.LevelInfo, parseLogLevel("loud"))
+}
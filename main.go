@@ -1,165 +1,250 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"sync/atomic"
 
 	"github.com/backend-project/auth"
+	"github.com/backend-project/jobs"
+	"github.com/backend-project/scan"
+	"github.com/backend-project/storage"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
-	"gorm.io/driver/mysql"
-	"gorm.io/driver/sqlite"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"gorm.io/gorm"
 )
 
-var currentClaims jwt.Claims
-
-func authMiddleware(c *gin.Context) {
+// authMiddleware identifies the user from the token cookie, if there is one.
+// Routes that need a logged-in user should also use requireAuth.
+func (app *App) authMiddleware(c *gin.Context) {
 	// find the jwt from cookies
 	tokenString, err := c.Cookie("token")
 
 	if err != nil {
-		fmt.Println("JWT missing in cookies")
-		//c.Redirect(http.StatusSeeOther, "/login")
-		c.Abort()
+		c.Next()
 		return
 	}
 
 	// verify jwt
-	token, err := auth.VerifyJWT(tokenString)
+	token, err := auth.VerifyJWT(app.config.Auth.JWTSecret, tokenString)
 
 	if err != nil {
-		fmt.Printf("JWT verification failed: %v\n", err)
-		//c.Redirect(http.StatusSeeOther, "/login")
-		c.Abort()
+		logFor(c).Debug("JWT verification failed", "error", err)
+		c.Next()
 		return
 	}
 
-	currentClaims = token.Claims
+	email, err := token.Claims.GetSubject()
+	if err != nil {
+		c.Next()
+		return
+	}
+
+	user, err := app.users.Authenticate(c, email)
+	if err != nil {
+		logFor(c).Debug("JWT user not accepted", "email", email, "error", err)
+		c.Next()
+		return
+	}
+
+	c.Set("claims", token.Claims)
+	c.Set("user", user)
 
-	fmt.Printf("JWT verified. Claims: %+v\\n", token.Claims)
 	// continue on to the next middleware / route handler
 	c.Next()
 }
 
-type App struct {
-	db *gorm.DB
+// requireAuth rejects requests that authMiddleware couldn't identify.
+func requireAuth(c *gin.Context) {
+	if _, ok := currentUser(c); !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not logged in"})
+		return
+	}
+
+	c.Next()
 }
 
-func (app *App) register(c *gin.Context) {
-	var user User
-
-	if err := c.BindJSON(&user); err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
-	} else {
-		// check if email already exists
-		// TODO: change this to use .Where("email = ?", user.Email)
-		var users []User
-		result := app.db.Find(&users)
-
-		if result.Error == nil && len(users) > 0 {
-			for _, foundUser := range users {
-				if foundUser.Email == user.Email {
-					c.AbortWithStatus(http.StatusFound)
-					return
-				}
-			}
-		}
+// requireAdmin rejects requests from anyone but admins, use it after requireAuth.
+func requireAdmin(c *gin.Context) {
+	if user, ok := currentUser(c); !ok || userRole(user) != "admin" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admins only"})
+		return
+	}
 
-		// hash password
-		hash, err := auth.HashPassword(user.Password)
+	c.Next()
+}
 
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
+func userRole(user User) string {
+	if user.Role != "" {
+		return user.Role
+	}
+	return auth.GetRole(user.Email)
+}
 
-		user.Password = hash
+// currentUser returns the user set by authMiddleware.
+func currentUser(c *gin.Context) (User, bool) {
+	value, ok := c.Get("user")
+	if !ok {
+		return User{}, false
+	}
 
-		tx := app.db.Create(&user)
-		if tx.Error != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": tx.Error.Error()})
-			return
-		}
-		// generate JWT so we don't have to login again for 1 hour
-		tokenString, err := auth.GenerateJWT(user.Email)
+	user, ok := value.(User)
+	return user, ok
+}
 
-		if err != nil {
-			c.String(http.StatusInternalServerError, "Error creating JWT")
-			return
-		}
+type App struct {
+	config  *Config
+	db      *gorm.DB
+	scanner scan.Scanner
+	storage storage.Storage
+	jobs    *jobs.Queue
+	metrics *Metrics
+	files   *FileService
+	users   *UserService
+	// draining is closed when the server starts shutting down
+	draining chan struct{}
+	// eventsAppended counts the change events this process has logged, to trim the log every so often
+	eventsAppended atomic.Uint64
+}
 
-		fmt.Printf("JWT created: %s\n", tokenString)
-		c.SetCookie("token", tokenString, 3600, "/", "localhost", false, true)
-		// redirect to home page from login page
-		//c.Redirect(http.StatusSeeOther, "/")
+func (app *App) register(c *gin.Context) {
+	var request User
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
 
-		// TODO: There must be a better way of doing this, just don't want to return the hash
-		user.Password = ""
+	user, err := app.users.Register(c, request.Email, request.Password)
+	if errors.Is(err, errEmailTaken) {
+		c.AbortWithStatus(http.StatusFound)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.publishEventLater(c, eventUserRegistered, registeredUser{ID: user.ID, Email: user.Email, CreatedAt: user.CreatedAt})
+	app.auditAs(c, user, "user.register", user.ID, nil, auditedUser{ID: user.ID, Email: user.Email})
 
-		c.JSON(http.StatusCreated, user)
+	// generate JWT so we don't have to login again for 1 hour
+	tokenString, err := auth.GenerateJWT(app.config.Auth.JWTSecret, user.Email)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error creating JWT")
+		return
 	}
+	app.setTokenCookie(c, tokenString, 3600)
+
+	// the hash stays on the server
+	user.Password = ""
+	c.JSON(http.StatusCreated, user)
 }
 
 func (app *App) login(c *gin.Context) {
-	var user User
-
-	if err := c.BindJSON(&user); err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
-	} else {
-		// check if email is in database
-		databaseUser, err := gorm.G[User](app.db).Where("email = ?", user.Email).First(c)
+	var request User
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
 
-		if err != nil {
+	user, err := app.users.Login(c, request.Email, request.Password)
+	if err != nil {
+		app.metrics.logins.WithLabelValues("failure").Inc()
+		app.auditAs(c, user, "user.login_failed", user.ID, nil, nil)
+		switch {
+		case errors.Is(err, errInvalidCredentials):
 			c.String(http.StatusUnauthorized, "Invalid Credentials")
-		} else {
-			// check if password is correct
-			hashedPassword := databaseUser.Password
-
-			correctPassword := auth.CheckPasswordHash(user.Password, hashedPassword)
-
-			if !correctPassword {
-				c.String(http.StatusUnauthorized, "Invalid Credentials")
-				return
-			} else {
-				// generate JWT so we don't have to login again for 1 hour
-				tokenString, err := auth.GenerateJWT(user.Email)
-
-				if err != nil {
-					c.String(http.StatusInternalServerError, "Error creating JWT")
-					return
-				}
-
-				fmt.Printf("JWT created: %s\n", tokenString)
-				c.SetCookie("token", tokenString, 3600, "/", "localhost", false, true)
-				c.JSON(http.StatusOK, gin.H{"success": true})
-				// redirect to home page from login page
-				//c.Redirect(http.StatusSeeOther, "/")
-			}
+		case errors.Is(err, errAccountDisabled):
+			c.String(http.StatusForbidden, "Account Disabled")
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		}
+		return
 	}
+
+	// generate JWT so we don't have to login again for 1 hour
+	tokenString, err := auth.GenerateJWT(app.config.Auth.JWTSecret, user.Email)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error creating JWT")
+		return
+	}
+
+	app.setTokenCookie(c, tokenString, 3600)
+	app.metrics.logins.WithLabelValues("success").Inc()
+	app.auditAs(c, user, "user.login", user.ID, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 func (app *App) logout(c *gin.Context) {
-	c.SetCookie("token", "", -1, "/", "localhost", false, true)
+	app.setTokenCookie(c, "", -1)
+	if user, ok := currentUser(c); ok {
+		app.audit(c, "user.logout", user.ID, nil, nil)
+	}
 }
 
-func (app *App) setupRouter() *gin.Engine {
-	err := godotenv.Load()
-	if err != nil {
-		fmt.Println("Failed to load .env file")
+// setTokenCookie sets the token cookie on the configured domain, maxAge -1 removes it.
+func (app *App) setTokenCookie(c *gin.Context, tokenString string, maxAge int) {
+	c.SetCookie("token", tokenString, maxAge, "/", app.config.Auth.CookieDomain, app.config.Auth.CookieSecure, true)
+}
+
+// loadEnv reads .env into the environment, variables that are already set win.
+func loadEnv() {
+	if err := godotenv.Load(); err != nil {
+		slog.Debug("No .env file loaded", "error", err)
+	}
+}
+
+// setupServices puts the database behind the services, unless they've been given other repositories
+// already, like the in-memory ones in tests.
+func (app *App) setupServices() {
+	if app.files == nil {
+		app.files = newFileService(gormFileRepository{db: app.db, changed: app.fileChanged, committed: app.jobs.Notify}, gormTagRepository{db: app.db}, app.userQuota)
 	}
+	if app.users == nil {
+		app.users = newUserService(gormUserRepository{db: app.db})
+	}
+}
 
-	fmt.Println("Setting up router...")
+func (app *App) setupRouter() *gin.Engine {
+	if app.config == nil {
+		// main validates the config before it gets here, this is for tests and tools, which shouldn't
+		// run with settings main would refuse
+		config, err := loadConfig("")
+		if err != nil {
+			panic(fmt.Errorf("invalid configuration: %w", err))
+		}
+		app.config = config
+	}
+	if app.jobs == nil {
+		app.jobs = app.newJobQueue()
+	}
+	if app.metrics == nil {
+		app.metrics = newMetrics(app.db)
+	}
+	if app.draining == nil {
+		app.draining = make(chan struct{})
+	}
+	app.setupServices()
 
-	router := gin.Default()
+	router := gin.New()
 	router.MaxMultipartMemory = 10 * 1_073_741_824 // 10 GiB
+	// handlers pass the gin context to gorm and storage, this lets the request's span through it
+	router.ContextWithFallback = true
+	router.Use(otelgin.Middleware(serviceName), requestLogging, app.metrics.instrument, recoverPanic, app.authMiddleware)
 
 	router.GET("/ping", func(c *gin.Context) {
 		c.String(200, "pong")
 	})
+	router.GET("/healthz", getHealth)
+	router.GET("/readyz", app.getReadiness)
+
+	// with METRICS_ADDRESS set, main serves /metrics there instead
+	if app.config.Metrics.Address == "" {
+		router.GET("/metrics", app.requireMetricsAccess, gin.WrapH(app.metrics.handler()))
+	}
 
 	// auth
 	router.POST("/register", app.register)
@@ -170,55 +255,139 @@ func (app *App) setupRouter() *gin.Engine {
 	router.GET("/files/:id", app.getFile)
 	router.GET("/files", app.getFiles)
 	router.POST("/files", app.createFile)
+	router.POST("/files/bulk", requireAuth, app.bulkFiles)
+	router.POST("/files/archive", app.createArchive)
+	router.POST("/files/import", requireAuth, app.importArchive)
 	router.PATCH("/files/:id", app.updateFile)
 	router.DELETE("/files/:id", app.deleteFile)
+	router.GET("/files/:id/content", app.getFileContent)
+	router.GET("/files/:id/thumbnail", app.getFileThumbnail)
+	router.POST("/files/:id/move", requireAuth, app.moveFile)
+	router.POST("/files/:id/presign", app.presignFile)
+	router.DELETE("/files/:id/purge", requireAuth, app.purgeFile)
+
+	// quotas
+	router.GET("/me/usage", requireAuth, app.getMyUsage)
+
+	router.GET("/events", requireAuth, app.streamEvents)
+
+	admin := router.Group("/admin", requireAuth, requireAdmin)
+	admin.PUT("/users/:id/quota", app.setUserQuota)
+	admin.GET("/jobs", app.getJobs)
+	admin.GET("/jobs/:id", app.getJob)
+	admin.POST("/jobs/:id/retry", app.retryJob)
+	admin.GET("/webhooks", app.getWebhooks)
+	admin.POST("/webhooks", app.createWebhook)
+	admin.DELETE("/webhooks/:id", app.deleteWebhook)
+	admin.GET("/webhooks/:id/deliveries", app.getWebhookDeliveries)
+	admin.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", app.redeliverWebhook)
+	admin.GET("/audit", app.getAuditLogs)
+	admin.GET("/audit/export", app.exportAuditLogs)
+
+	// sharing
+	router.GET("/files/:id/grants", requireAuth, app.getFileGrants)
+	router.POST("/files/:id/grants", requireAuth, app.createFileGrant)
+	router.DELETE("/files/:id/grants/:grantId", requireAuth, app.deleteFileGrant)
+	router.GET("/files/:id/links", requireAuth, app.getShareLinks)
+	router.POST("/files/:id/links", requireAuth, app.createShareLink)
+	router.DELETE("/files/:id/links/:linkId", requireAuth, app.revokeShareLink)
+	router.GET("/s/:token", app.downloadShareLink)
+	router.POST("/s/:token", app.downloadShareLink)
+
+	groups := router.Group("/groups", requireAuth)
+	groups.GET("", app.getGroups)
+	groups.POST("", app.createGroup)
+	groups.POST("/:id/members", app.addGroupMember)
+	groups.DELETE("/:id/members/:userId", app.removeGroupMember)
+
+	// folders
+	folders := router.Group("/folders", requireAuth)
+	folders.GET("", app.getRootFolder)
+	folders.POST("", app.createFolder)
+	folders.GET("/by-path/*path", app.getFolderByPath)
+	folders.GET("/:id", app.getFolder)
+	folders.GET("/:id/contents", app.getFolderContents)
+	folders.PATCH("/:id", app.updateFolder)
+	folders.POST("/:id/move", app.moveFolder)
+	folders.DELETE("/:id", app.deleteFolder)
 	return router
 }
 
-func setupDatabase() *gorm.DB {
-	environment := os.Getenv("ENVIRONMENT")
-	if environment == "" {
-		environment = "PRODUCTION"
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		flag.PrintDefaults()
+	}
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML `file` to read settings from, .env and the environment override it")
+	printConfig := flag.Bool("print-config", false, "print the settings in use with secrets redacted, then exit, the same as the config print command")
+	flag.Parse()
+
+	name, args := "serve", flag.Args()
+	if *printConfig {
+		args = []string{"config", "print"}
+	}
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
-	fmt.Printf("Running in %s\n", environment)
 
-	var db *gorm.DB
-	var err error
-	if environment == "TEST" {
-		fmt.Println("Using SQLite.")
-		db, err = gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
-		if err != nil {
-			panic("failed to connect database")
-		}
-	} else {
-		fmt.Println("Using MySQL.")
-		dsn := os.Getenv("DSN")
-		if dsn == "" {
-			panic("DSN environment variable not set.")
-		}
-		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
-		if err != nil {
-			panic("failed to connect database")
+	config, err := loadConfig(*configFile)
+	if name == "config" {
+		// this one is for looking at the config, so it runs whether or not it's valid
+		if err := configCommand(config, err, args, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	run, ok := commands[name]
+	if !ok && name != "serve" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// commands print their results on stdout, so their logs go to stderr
+	logOutput := os.Stderr
+	if name == "serve" {
+		logOutput = os.Stdout
 	}
+	setupLogger(logOutput, config.Log)
 
-	// Migrate the schema
-	err = db.AutoMigrate(&File{}, &Tag{}, &User{})
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		panic("failed to run database migrations")
+		panic(err)
 	}
 
-	return db
+	err = runCommand(config, name, run, args)
+	if err != nil {
+		slog.Error("Failed", "command", name, "error", err)
+	}
+	// os.Exit skips deferred calls, so the spans of a failed run are flushed first
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Flushing traces failed", "error", err)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
-func main() {
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	fmt.Println("Running on localhost:8080")
-	err := router.Run("localhost:8080")
+// runCommand opens the database and serves the app, or runs the command run, the one called name.
+func runCommand(config *Config, name string, run command, args []string) error {
+	db, err := openDatabase(context.Background(), config)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("opening the database: %w", err)
+	}
+
+	app := &App{config: config, db: db}
+	if name == "serve" {
+		app.scanner = setupScanner(config.Uploads.ClamAVAddress)
+		return app.run()
 	}
+	app.jobs = app.newJobQueue()
+	app.setupServices()
+	return run(context.Background(), app, args, os.Stdout)
 }
@@ -20,16 +20,53 @@ import (
 	"gorm.io/gorm"
 )
 
+// testDB is the database setupDatabase last opened.
+var testDB *gorm.DB
+
 func cleanUp() {
-	err := os.Remove("./test.db")
+	if testDB != nil && testDB.Dialector.Name() != driverSQLite {
+		sqlDB, err := testDB.DB()
+		if err != nil {
+			panic(err)
+		}
+		_ = sqlDB.Close()
+	} else {
+		err := os.Remove("./test.db")
+		if err != nil {
+			panic(err)
+		}
+	}
+	testDB = nil
+
+	err := os.RemoveAll("./files")
 	if err != nil {
 		panic(err)
 	}
+}
 
-	err = os.RemoveAll("./files")
+// setupDatabase opens and migrates the database the environment points at, which is test.db with ENVIRONMENT=TEST.
+// To run the tests against MySQL or Postgres set DATABASE_DRIVER and DSN to an empty database, it's emptied
+// again at the start of every test.
+func setupDatabase() *gorm.DB {
+	config, _ := loadConfig("")
+	db, err := openDatabase(context.Background(), config)
 	if err != nil {
 		panic(err)
 	}
+	if db.Dialector.Name() != driverSQLite {
+		migrator, err := newMigrator(db)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := migrator.Down(context.Background(), len(migrator.Migrations)); err != nil {
+			panic(err)
+		}
+	}
+	if err := migrateDatabase(context.Background(), db); err != nil {
+		panic(err)
+	}
+	testDB = db
+	return db
 }
 
 func TestPingRoute(t *testing.T) {
@@ -52,552 +89,604 @@ func TestPingRoute(t *testing.T) {
 }
 
 func TestUploadFileRoute(t *testing.T) {
-	defer cleanUp()
-
-	err := os.Setenv("ENVIRONMENT", "TEST")
-	if err != nil {
-		panic(err)
-	}
-
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	// Create a dummy file for testing
-	dummyFileContent := []byte("This is a test file content.")
-	dummyFileName := "testfile.txt"
-	err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
-	assert.NoError(t, err)
-	defer func(name string) {
-		err := os.Remove(name)
+	forEachBackend(t, func(t *testing.T, app *App) {
+		var err error
+		router := app.setupRouter()
+
+		// Create a dummy file for testing
+		dummyFileContent := []byte("This is a test file content.")
+		dummyFileName := "testfile.txt"
+		err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
+		assert.NoError(t, err)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				panic(err)
+			}
+		}(dummyFileName) // Clean up the dummy file
+
+		// Create a new multipart writer
+		fileBody := new(bytes.Buffer)
+		writer := multipart.NewWriter(fileBody)
+
+		// Create a form file field
+		file, err := os.Open(dummyFileName)
+		assert.NoError(t, err)
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				panic(err)
+			}
+		}(file)
+
+		_, err = writer.CreateFormField("name")
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(dummyFileName) // Clean up the dummy file
-
-	// Create a new multipart writer
-	fileBody := new(bytes.Buffer)
-	writer := multipart.NewWriter(fileBody)
-
-	// Create a form file field
-	file, err := os.Open(dummyFileName)
-	assert.NoError(t, err)
-	defer func(file *os.File) {
-		err := file.Close()
+		err = writer.WriteField("name", "test-filename")
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(file)
 
-	_, err = writer.CreateFormField("name")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("name", "test-filename")
-	if err != nil {
-		return
-	}
-
-	_, err = writer.CreateFormField("description")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "this is a test file")
-	if err != nil {
-		return
-	}
+		_, err = writer.CreateFormField("description")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "this is a test file")
+		if err != nil {
+			return
+		}
 
-	_, err = writer.CreateFormField("tags")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "[]")
-	if err != nil {
-		return
-	}
+		_, err = writer.CreateFormField("tags")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "[]")
+		if err != nil {
+			return
+		}
 
-	part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
+		part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
 
-	assert.NoError(t, err)
-	_, err = io.Copy(part, file)
-	assert.NoError(t, err)
+		assert.NoError(t, err)
+		_, err = io.Copy(part, file)
+		assert.NoError(t, err)
 
-	// Close the multipart writer
-	err = writer.Close()
-	assert.NoError(t, err)
+		// Close the multipart writer
+		err = writer.Close()
+		assert.NoError(t, err)
 
-	w := httptest.NewRecorder()
+		w := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("POST", "/files", fileBody)
-	req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
-	router.ServeHTTP(w, req)
+		req, _ := http.NewRequest("POST", "/files", fileBody)
+		req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
+		router.ServeHTTP(w, req)
 
-	assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 200, w.Code)
 
-	expected, err := gorm.G[File](app.db).Order("created_at desc").First(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	expectedJson, err := json.Marshal(expected)
-	if err != nil {
-		panic(err)
-	}
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		expected := latestFile(t, app)
+		expectedJson, err := json.Marshal(expected)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, string(expectedJson), w.Body.String())
+	})
 }
 
 func TestGetFiles(t *testing.T) {
-	defer cleanUp()
-
-	err := os.Setenv("ENVIRONMENT", "TEST")
-	if err != nil {
-		panic(err)
-	}
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/files", nil)
-	router.ServeHTTP(w, req)
-
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "[]", w.Body.String())
-
-	// upload a file
-	// Create a dummy file for testing
-	dummyFileContent := []byte("This is a test file content.")
-	dummyFileName := "testfile.txt"
-	err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
-	assert.NoError(t, err)
-	defer func(name string) {
-		err := os.Remove(name)
+	forEachBackend(t, func(t *testing.T, app *App) {
+		var err error
+		router := app.setupRouter()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/files", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "[]", w.Body.String())
+
+		// upload a file
+		// Create a dummy file for testing
+		dummyFileContent := []byte("This is a test file content.")
+		dummyFileName := "testfile.txt"
+		err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
+		assert.NoError(t, err)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				panic(err)
+			}
+		}(dummyFileName) // Clean up the dummy file
+
+		// Create a new multipart writer
+		fileBody := new(bytes.Buffer)
+		writer := multipart.NewWriter(fileBody)
+
+		// Create a form file field
+		file, err := os.Open(dummyFileName)
+		assert.NoError(t, err)
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				panic(err)
+			}
+		}(file)
+
+		_, err = writer.CreateFormField("name")
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(dummyFileName) // Clean up the dummy file
-
-	// Create a new multipart writer
-	fileBody := new(bytes.Buffer)
-	writer := multipart.NewWriter(fileBody)
-
-	// Create a form file field
-	file, err := os.Open(dummyFileName)
-	assert.NoError(t, err)
-	defer func(file *os.File) {
-		err := file.Close()
+		err = writer.WriteField("name", "test-filename")
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(file)
-
-	_, err = writer.CreateFormField("name")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("name", "test-filename")
-	if err != nil {
-		return
-	}
 
-	_, err = writer.CreateFormField("description")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "this is a test file")
-	if err != nil {
-		return
-	}
+		_, err = writer.CreateFormField("description")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "this is a test file")
+		if err != nil {
+			return
+		}
 
-	_, err = writer.CreateFormField("tags")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "[]")
-	if err != nil {
-		return
-	}
+		_, err = writer.CreateFormField("tags")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "[]")
+		if err != nil {
+			return
+		}
 
-	part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
+		part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
 
-	assert.NoError(t, err)
-	_, err = io.Copy(part, file)
-	assert.NoError(t, err)
+		assert.NoError(t, err)
+		_, err = io.Copy(part, file)
+		assert.NoError(t, err)
 
-	// Close the multipart writer
-	err = writer.Close()
-	assert.NoError(t, err)
+		// Close the multipart writer
+		err = writer.Close()
+		assert.NoError(t, err)
 
-	w = httptest.NewRecorder()
+		w = httptest.NewRecorder()
 
-	req, _ = http.NewRequest("POST", "/files", fileBody)
-	req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
-	router.ServeHTTP(w, req)
+		req, _ = http.NewRequest("POST", "/files", fileBody)
+		req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
+		router.ServeHTTP(w, req)
 
-	assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 200, w.Code)
 
-	expected, err := gorm.G[File](app.db).Order("created_at desc").First(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	expectedJson, err := json.Marshal(expected)
-	if err != nil {
-		panic(err)
-	}
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		expected := latestFile(t, app)
+		expectedJson, err := json.Marshal(expected)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, string(expectedJson), w.Body.String())
 
-	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/files", nil)
-	router.ServeHTTP(w, req)
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/files", nil)
+		router.ServeHTTP(w, req)
 
-	assert.Equal(t, 200, w.Code)
-	expectedJson, err = json.Marshal([]File{expected})
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		assert.Equal(t, 200, w.Code)
+		expectedJson, err = json.Marshal([]File{expected})
+		assert.Equal(t, string(expectedJson), w.Body.String())
+	})
 }
 
 func TestGetFile(t *testing.T) {
-	defer cleanUp()
-
-	err := os.Setenv("ENVIRONMENT", "TEST")
-	if err != nil {
-		panic(err)
-	}
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/files", nil)
-	router.ServeHTTP(w, req)
-
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "[]", w.Body.String())
-
-	// upload a file
-	// Create a dummy file for testing
-	dummyFileContent := []byte("This is a test file content.")
-	dummyFileName := "testfile.txt"
-	err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
-	assert.NoError(t, err)
-	defer func(name string) {
-		err := os.Remove(name)
+	forEachBackend(t, func(t *testing.T, app *App) {
+		var err error
+		router := app.setupRouter()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/files", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "[]", w.Body.String())
+
+		// upload a file
+		// Create a dummy file for testing
+		dummyFileContent := []byte("This is a test file content.")
+		dummyFileName := "testfile.txt"
+		err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
+		assert.NoError(t, err)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				panic(err)
+			}
+		}(dummyFileName) // Clean up the dummy file
+
+		// Create a new multipart writer
+		fileBody := new(bytes.Buffer)
+		writer := multipart.NewWriter(fileBody)
+
+		// Create a form file field
+		file, err := os.Open(dummyFileName)
+		assert.NoError(t, err)
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				panic(err)
+			}
+		}(file)
+
+		_, err = writer.CreateFormField("name")
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(dummyFileName) // Clean up the dummy file
-
-	// Create a new multipart writer
-	fileBody := new(bytes.Buffer)
-	writer := multipart.NewWriter(fileBody)
-
-	// Create a form file field
-	file, err := os.Open(dummyFileName)
-	assert.NoError(t, err)
-	defer func(file *os.File) {
-		err := file.Close()
+		err = writer.WriteField("name", "test-filename")
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(file)
 
-	_, err = writer.CreateFormField("name")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("name", "test-filename")
-	if err != nil {
-		return
-	}
-
-	_, err = writer.CreateFormField("description")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "this is a test file")
-	if err != nil {
-		return
-	}
+		_, err = writer.CreateFormField("description")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "this is a test file")
+		if err != nil {
+			return
+		}
 
-	_, err = writer.CreateFormField("tags")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "[]")
-	if err != nil {
-		return
-	}
+		_, err = writer.CreateFormField("tags")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "[]")
+		if err != nil {
+			return
+		}
 
-	part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
+		part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
 
-	assert.NoError(t, err)
-	_, err = io.Copy(part, file)
-	assert.NoError(t, err)
+		assert.NoError(t, err)
+		_, err = io.Copy(part, file)
+		assert.NoError(t, err)
 
-	// Close the multipart writer
-	err = writer.Close()
-	assert.NoError(t, err)
+		// Close the multipart writer
+		err = writer.Close()
+		assert.NoError(t, err)
 
-	w = httptest.NewRecorder()
+		w = httptest.NewRecorder()
 
-	req, _ = http.NewRequest("POST", "/files", fileBody)
-	req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
-	router.ServeHTTP(w, req)
+		req, _ = http.NewRequest("POST", "/files", fileBody)
+		req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
+		router.ServeHTTP(w, req)
 
-	assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 200, w.Code)
 
-	expected, err := gorm.G[File](app.db).Order("created_at desc").First(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	expectedJson, err := json.Marshal(expected)
-	if err != nil {
-		panic(err)
-	}
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		expected := latestFile(t, app)
+		expectedJson, err := json.Marshal(expected)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, string(expectedJson), w.Body.String())
 
-	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), nil)
-	router.ServeHTTP(w, req)
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), nil)
+		router.ServeHTTP(w, req)
 
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, string(expectedJson), w.Body.String())
+	})
 }
 
 func TestDeleteFile(t *testing.T) {
-	defer cleanUp()
-
-	err := os.Setenv("ENVIRONMENT", "TEST")
-	if err != nil {
-		panic(err)
-	}
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/files", nil)
-	router.ServeHTTP(w, req)
-
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "[]", w.Body.String())
-
-	// upload a file
-	// Create a dummy file for testing
-	dummyFileContent := []byte("This is a test file content.")
-	dummyFileName := "testfile.txt"
-	err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
-	assert.NoError(t, err)
-	defer func(name string) {
-		err := os.Remove(name)
+	forEachBackend(t, func(t *testing.T, app *App) {
+		var err error
+		router := app.setupRouter()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/files", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "[]", w.Body.String())
+
+		// upload a file
+		// Create a dummy file for testing
+		dummyFileContent := []byte("This is a test file content.")
+		dummyFileName := "testfile.txt"
+		err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
+		assert.NoError(t, err)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				panic(err)
+			}
+		}(dummyFileName) // Clean up the dummy file
+
+		// Create a new multipart writer
+		fileBody := new(bytes.Buffer)
+		writer := multipart.NewWriter(fileBody)
+
+		// Create a form file field
+		file, err := os.Open(dummyFileName)
+		assert.NoError(t, err)
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				panic(err)
+			}
+		}(file)
+
+		_, err = writer.CreateFormField("name")
 		if err != nil {
-			panic(err)
+			return
+		}
+		err = writer.WriteField("name", "test-filename")
+		if err != nil {
+			return
 		}
-	}(dummyFileName) // Clean up the dummy file
 
-	// Create a new multipart writer
-	fileBody := new(bytes.Buffer)
-	writer := multipart.NewWriter(fileBody)
+		_, err = writer.CreateFormField("description")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "this is a test file")
+		if err != nil {
+			return
+		}
 
-	// Create a form file field
-	file, err := os.Open(dummyFileName)
-	assert.NoError(t, err)
-	defer func(file *os.File) {
-		err := file.Close()
+		_, err = writer.CreateFormField("tags")
 		if err != nil {
-			panic(err)
+			return
+		}
+		err = writer.WriteField("description", "[]")
+		if err != nil {
+			return
 		}
-	}(file)
 
-	_, err = writer.CreateFormField("name")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("name", "test-filename")
-	if err != nil {
-		return
-	}
+		part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
 
-	_, err = writer.CreateFormField("description")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "this is a test file")
-	if err != nil {
-		return
-	}
+		assert.NoError(t, err)
+		_, err = io.Copy(part, file)
+		assert.NoError(t, err)
 
-	_, err = writer.CreateFormField("tags")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "[]")
-	if err != nil {
-		return
-	}
+		// Close the multipart writer
+		err = writer.Close()
+		assert.NoError(t, err)
 
-	part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
+		w = httptest.NewRecorder()
 
-	assert.NoError(t, err)
-	_, err = io.Copy(part, file)
-	assert.NoError(t, err)
+		req, _ = http.NewRequest("POST", "/files", fileBody)
+		req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
+		router.ServeHTTP(w, req)
 
-	// Close the multipart writer
-	err = writer.Close()
-	assert.NoError(t, err)
+		assert.Equal(t, 200, w.Code)
 
-	w = httptest.NewRecorder()
+		expected := latestFile(t, app)
+		expectedJson, err := json.Marshal(expected)
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, string(expectedJson), w.Body.String())
 
-	req, _ = http.NewRequest("POST", "/files", fileBody)
-	req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
-	router.ServeHTTP(w, req)
+		// files uploaded without logging in can only be deleted by an admin
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
 
-	assert.Equal(t, 200, w.Code)
+		adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), nil)
+		req.AddCookie(adminCookie)
+		router.ServeHTTP(w, req)
 
-	expected, err := gorm.G[File](app.db).Order("created_at desc").First(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	expectedJson, err := json.Marshal(expected)
-	if err != nil {
-		panic(err)
-	}
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		expectedJson, err = json.Marshal(gin.H{"success": true})
 
-	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), nil)
-	router.ServeHTTP(w, req)
-
-	expectedJson, err = json.Marshal(gin.H{"success": true})
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, string(expectedJson), w.Body.String())
 
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, string(expectedJson), w.Body.String())
-
-	_, err = gorm.G[File](app.db).Where("id = ?", expected.ID).First(context.TODO())
-	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+		_, err = app.files.Get(context.TODO(), expected.ID)
+		assert.True(t, errors.Is(err, errNotFound))
+	})
 }
 
 func TestUpdateFile(t *testing.T) {
-	defer cleanUp()
-
-	err := os.Setenv("ENVIRONMENT", "TEST")
-	if err != nil {
-		panic(err)
-	}
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/files", nil)
-	router.ServeHTTP(w, req)
+	forEachBackend(t, func(t *testing.T, app *App) {
+		var err error
+		router := app.setupRouter()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/files", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "[]", w.Body.String())
+
+		// upload a file
+		// Create a dummy file for testing
+		dummyFileContent := []byte("This is a test file content.")
+		dummyFileName := "testfile.txt"
+		err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
+		assert.NoError(t, err)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				panic(err)
+			}
+		}(dummyFileName) // Clean up the dummy file
+
+		// Create a new multipart writer
+		fileBody := new(bytes.Buffer)
+		writer := multipart.NewWriter(fileBody)
+
+		// Create a form file field
+		file, err := os.Open(dummyFileName)
+		assert.NoError(t, err)
+		defer func(file *os.File) {
+			err := file.Close()
+			if err != nil {
+				panic(err)
+			}
+		}(file)
+
+		_, err = writer.CreateFormField("name")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("name", "test-filename")
+		if err != nil {
+			return
+		}
 
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "[]", w.Body.String())
+		_, err = writer.CreateFormField("description")
+		if err != nil {
+			return
+		}
+		err = writer.WriteField("description", "this is a test file")
+		if err != nil {
+			return
+		}
 
-	// upload a file
-	// Create a dummy file for testing
-	dummyFileContent := []byte("This is a test file content.")
-	dummyFileName := "testfile.txt"
-	err = os.WriteFile(dummyFileName, dummyFileContent, 0644)
-	assert.NoError(t, err)
-	defer func(name string) {
-		err := os.Remove(name)
+		_, err = writer.CreateFormField("tags")
 		if err != nil {
-			panic(err)
+			return
+		}
+		err = writer.WriteField("description", "[]")
+		if err != nil {
+			return
 		}
-	}(dummyFileName) // Clean up the dummy file
 
-	// Create a new multipart writer
-	fileBody := new(bytes.Buffer)
-	writer := multipart.NewWriter(fileBody)
+		part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
 
-	// Create a form file field
-	file, err := os.Open(dummyFileName)
-	assert.NoError(t, err)
-	defer func(file *os.File) {
-		err := file.Close()
+		assert.NoError(t, err)
+		_, err = io.Copy(part, file)
+		assert.NoError(t, err)
+
+		// Close the multipart writer
+		err = writer.Close()
+		assert.NoError(t, err)
+
+		w = httptest.NewRecorder()
+
+		req, _ = http.NewRequest("POST", "/files", fileBody)
+		req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		expected := latestFile(t, app)
+		expectedJson, err := json.Marshal(expected)
 		if err != nil {
 			panic(err)
 		}
-	}(file)
+		assert.Equal(t, string(expectedJson), w.Body.String())
 
-	_, err = writer.CreateFormField("name")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("name", "test-filename")
-	if err != nil {
-		return
-	}
+		w = httptest.NewRecorder()
 
-	_, err = writer.CreateFormField("description")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "this is a test file")
-	if err != nil {
-		return
-	}
+		updatedFile := File{Name: "new name", Description: "new description"}
+		updatedFileJson, _ := json.Marshal(updatedFile)
+		req, _ = http.NewRequest("PATCH", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), strings.NewReader(string(updatedFileJson)))
+		router.ServeHTTP(w, req)
+		// files uploaded without logging in can only be changed by an admin
+		assert.Equal(t, http.StatusForbidden, w.Code)
 
-	_, err = writer.CreateFormField("tags")
-	if err != nil {
-		return
-	}
-	err = writer.WriteField("description", "[]")
-	if err != nil {
-		return
-	}
+		adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("PATCH", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), strings.NewReader(string(updatedFileJson)))
+		req.AddCookie(adminCookie)
+		router.ServeHTTP(w, req)
 
-	part, err := writer.CreateFormFile("file", dummyFileName) // "myFile" must match the name in the handler
+		expectedJson, err = json.Marshal(gin.H{"success": true})
 
-	assert.NoError(t, err)
-	_, err = io.Copy(part, file)
-	assert.NoError(t, err)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, string(expectedJson), w.Body.String())
 
-	// Close the multipart writer
-	err = writer.Close()
-	assert.NoError(t, err)
+		fetchedUpdatedFile, err := app.files.Get(context.TODO(), expected.ID)
+		if err != nil {
+			panic(err)
+		}
+		assert.EqualValues(t, fetchedUpdatedFile.Name, updatedFile.Name)
+		assert.EqualValues(t, fetchedUpdatedFile.Description, updatedFile.Description)
+	})
+}
 
-	w = httptest.NewRecorder()
+func TestRegister(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, app *App) {
+		var err error
+		router := app.setupRouter()
 
-	req, _ = http.NewRequest("POST", "/files", fileBody)
-	req.Header.Set("Content-Type", writer.FormDataContentType()) // Set the correct Content-Type header
-	router.ServeHTTP(w, req)
+		w := httptest.NewRecorder()
 
-	assert.Equal(t, 200, w.Code)
+		user := User{Email: "test@test.com", Password: "secret"}
+		userJson, _ := json.Marshal(user)
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(string(userJson)))
+		router.ServeHTTP(w, req)
 
-	expected, err := gorm.G[File](app.db).Order("created_at desc").First(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	expectedJson, err := json.Marshal(expected)
-	if err != nil {
-		panic(err)
-	}
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		fetchedUser, err := app.users.users.ByEmail(context.TODO(), user.Email)
+		if err != nil {
+			panic(err)
+		}
 
-	w = httptest.NewRecorder()
+		assert.Equal(t, http.StatusCreated, w.Code)
 
-	updatedFile := File{Name: "new name", Description: "new description"}
-	updatedFileJson, _ := json.Marshal(updatedFile)
-	req, _ = http.NewRequest("PATCH", fmt.Sprintf("/files/%s", strconv.Itoa(int(expected.ID))), strings.NewReader(string(updatedFileJson)))
-	router.ServeHTTP(w, req)
+		var returnedUser User
+		err = json.Unmarshal(w.Body.Bytes(), &returnedUser)
+		fmt.Println(user)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, user.Email, fetchedUser.Email)
+		assert.Equal(t, user.Email, returnedUser.Email)
+		assert.Equal(t, "token", w.Result().Cookies()[0].Name)
+	})
+}
 
-	expectedJson, err = json.Marshal(gin.H{"success": true})
+func TestLogin(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, app *App) {
+		router := app.setupRouter()
 
-	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, string(expectedJson), w.Body.String())
+		// create a user (have to hit the endpoint, so the password gets hashed)
+		w := httptest.NewRecorder()
+		user := User{Email: "test@test.com", Password: "secret"}
+		userJson, _ := json.Marshal(user)
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(string(userJson)))
+		router.ServeHTTP(w, req)
 
-	fetchedUpdatedFile, err := gorm.G[File](app.db).Where("id = ?", expected.ID).First(context.TODO())
-	if err != nil {
-		panic(err)
-	}
-	assert.EqualValues(t, fetchedUpdatedFile.Name, updatedFile.Name)
-	assert.EqualValues(t, fetchedUpdatedFile.Description, updatedFile.Description)
+		w = httptest.NewRecorder()
+
+		req, _ = http.NewRequest("POST", "/login", strings.NewReader(string(userJson)))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "{\"success\":true}", w.Body.String())
+		assert.Equal(t, "token", w.Result().Cookies()[0].Name)
+	})
 }
 
-func TestRegister(t *testing.T) {
-	defer cleanUp()
+func TestLogout(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, app *App) {
+		router := app.setupRouter()
+
+		// create a user (have to hit the endpoint, so the password gets hashed)
+		w := httptest.NewRecorder()
+		user := User{Email: "test@test.com", Password: "secret"}
+		userJson, _ := json.Marshal(user)
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(string(userJson)))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, "token", w.Result().Cookies()[0].Name)
+
+		cookie := w.Result().Cookies()[0]
+		w = httptest.NewRecorder()
+
+		req, _ = http.NewRequest("POST", "/logout", strings.NewReader(string(userJson)))
+		req.AddCookie(cookie)
+		router.ServeHTTP(w, req)
+
+		assert.Len(t, w.Result().Cookies(), 0)
+	})
+}
 
+// forEachBackend runs a scenario against the database the environment points at, and again with the
+// in-memory file, user and tag repositories. Only those are faked: jobs, change events, tag links, the
+// audit log and webhooks still need the in-memory SQLite database newMemoryApp opens.
+func forEachBackend(t *testing.T, scenario func(t *testing.T, app *App)) {
 	err := os.Setenv("ENVIRONMENT", "TEST")
 	if err != nil {
 		panic(err)
@@ -606,38 +695,34 @@ func TestRegister(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
-
-	w := httptest.NewRecorder()
 
-	user := User{Email: "test@test.com", Password: "secret"}
-	userJson, _ := json.Marshal(user)
-	req, _ := http.NewRequest("POST", "/register", strings.NewReader(string(userJson)))
-	router.ServeHTTP(w, req)
+	t.Run("database", func(t *testing.T) {
+		defer cleanUp()
+		scenario(t, &App{db: setupDatabase()})
+	})
+	t.Run("memory", func(t *testing.T) {
+		scenario(t, newMemoryApp(t))
+	})
+}
 
-	fetchedUser, err := gorm.G[User](app.db).Where("email = ?", user.Email).First(context.TODO())
-	if err != nil {
-		panic(err)
+// latestFile is the file uploaded last without logging in, read back through the app's repository.
+func latestFile(t *testing.T, app *App) File {
+	files, err := app.files.List(context.TODO(), User{}, false, 1, 100)
+	assert.NoError(t, err)
+	if len(files) == 0 {
+		t.Fatal("no files uploaded")
 	}
-
-	assert.Equal(t, http.StatusCreated, w.Code)
-
-	var returnedUser User
-	err = json.Unmarshal(w.Body.Bytes(), &returnedUser)
-	fmt.Println(user)
-	if err != nil {
-		return
+	latest := files[0]
+	for _, file := range files {
+		if file.ID > latest.ID {
+			latest = file
+		}
 	}
-	assert.Equal(t, user.Email, fetchedUser.Email)
-	assert.Equal(t, user.Email, returnedUser.Email)
-	assert.Equal(t, "token", w.Result().Cookies()[0].Name)
+	return latest
 }
 
-func TestLogin(t *testing.T) {
-	defer cleanUp()
-
+// setupTestApp opens a fresh test database and router, callers should defer cleanUp.
+func setupTestApp() (*App, *gin.Engine) {
 	err := os.Setenv("ENVIRONMENT", "TEST")
 	if err != nil {
 		panic(err)
@@ -646,56 +731,82 @@ func TestLogin(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
+
 	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
+	app := &App{db: db}
+	return app, app.setupRouter()
+}
 
-	// create a user (have to hit the endpoint, so the password gets hashed)
-	w := httptest.NewRecorder()
-	user := User{Email: "test@test.com", Password: "secret"}
-	userJson, _ := json.Marshal(user)
-	req, _ := http.NewRequest("POST", "/register", strings.NewReader(string(userJson)))
-	router.ServeHTTP(w, req)
+// performJSON sends body (if any) as JSON, with cookie (if any) attached.
+func performJSON(router *gin.Engine, method string, path string, body any, cookie *http.Cookie) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		bodyJson, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		reader = bytes.NewReader(bodyJson)
+	}
 
-	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
 
-	req, _ = http.NewRequest("POST", "/login", strings.NewReader(string(userJson)))
+	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	return w
+}
 
-	assert.Equal(t, http.StatusOK, w.Code)
-	assert.Equal(t, "{\"success\":true}", w.Body.String())
-	assert.Equal(t, "token", w.Result().Cookies()[0].Name)
+// registerTestUser registers email and returns the token cookie for them.
+func registerTestUser(t *testing.T, router *gin.Engine, email string) *http.Cookie {
+	w := performJSON(router, "POST", "/register", User{Email: email, Password: "secret"}, nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	return w.Result().Cookies()[0]
 }
 
-func TestLogout(t *testing.T) {
-	defer cleanUp()
+// uploadTestFile uploads content through POST /files with the extra form fields.
+func uploadTestFile(t *testing.T, router *gin.Engine, cookie *http.Cookie, fileName string, content []byte, fields map[string]string) *httptest.ResponseRecorder {
+	return postTestFile(t, router, "/files", cookie, fileName, content, fields)
+}
 
-	err := os.Setenv("ENVIRONMENT", "TEST")
-	if err != nil {
-		panic(err)
-	}
-	err = os.Setenv("JWT_SECRET", "very-secret")
-	if err != nil {
-		panic(err)
+// postTestFile posts a multipart form with content in the "file" field to path.
+func postTestFile(t *testing.T, router *gin.Engine, path string, cookie *http.Cookie, fileName string, content []byte, fields map[string]string) *httptest.ResponseRecorder {
+	fileBody := new(bytes.Buffer)
+	writer := multipart.NewWriter(fileBody)
+
+	for key, value := range fields {
+		err := writer.WriteField(key, value)
+		assert.NoError(t, err)
 	}
-	db := setupDatabase()
-	app := App{db: db}
-	router := app.setupRouter()
 
-	// create a user (have to hit the endpoint, so the password gets hashed)
-	w := httptest.NewRecorder()
-	user := User{Email: "test@test.com", Password: "secret"}
-	userJson, _ := json.Marshal(user)
-	req, _ := http.NewRequest("POST", "/register", strings.NewReader(string(userJson)))
-	router.ServeHTTP(w, req)
-	assert.Equal(t, "token", w.Result().Cookies()[0].Name)
+	part, err := writer.CreateFormFile("file", fileName)
+	assert.NoError(t, err)
+	_, err = part.Write(content)
+	assert.NoError(t, err)
+
+	err = writer.Close()
+	assert.NoError(t, err)
 
-	cookie := w.Result().Cookies()[0]
-	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, fileBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
 
-	req, _ = http.NewRequest("POST", "/logout", strings.NewReader(string(userJson)))
-	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	return w
+}
 
-	assert.Len(t, w.Result().Cookies(), 0)
+// runJobs runs queued jobs until there are none left that are due.
+func runJobs(t *testing.T, app *App) {
+	for {
+		ran, err := app.jobs.RunOnce(context.TODO())
+		assert.NoError(t, err)
+		if !ran {
+			return
+		}
+	}
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// memoryFileRepository keeps files in a map, for tests that don't need a database. It only knows
+// about grants made to users directly, not through groups.
+type memoryFileRepository struct {
+	mu     sync.Mutex
+	files  map[uint]File
+	usage  map[uint]Usage
+	grants []FileGrant
+	nextId uint
+	// events are the change events the database would have published, in order
+	events []string
+}
+
+func newMemoryFileRepository() *memoryFileRepository {
+	return &memoryFileRepository{files: map[uint]File{}, usage: map[uint]Usage{}}
+}
+
+func (repo *memoryFileRepository) Get(ctx context.Context, id uint) (File, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	file, ok := repo.files[id]
+	if !ok || file.DeletedAt.Valid {
+		return File{}, errNotFound
+	}
+	return file, nil
+}
+
+func (repo *memoryFileRepository) GetDeleted(ctx context.Context, id uint) (File, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	file, ok := repo.files[id]
+	if !ok {
+		return File{}, errNotFound
+	}
+	return file, nil
+}
+
+func (repo *memoryFileRepository) List(ctx context.Context, user User, loggedIn bool, page int, pageSize int) ([]File, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	files := []File{}
+	for _, file := range repo.files {
+		if file.DeletedAt.Valid {
+			continue
+		}
+		if file.UserId == 0 || (loggedIn && (file.UserId == user.ID || repo.granted(file.ID, user.ID))) {
+			files = append(files, file)
+		}
+	}
+	slices.SortFunc(files, func(a, b File) int { return int(a.ID) - int(b.ID) })
+
+	start := min((page-1)*pageSize, len(files))
+	return files[start:min(start+pageSize, len(files))], nil
+}
+
+func (repo *memoryFileRepository) granted(fileId uint, userId uint) bool {
+	return slices.ContainsFunc(repo.grants, func(grant FileGrant) bool {
+		return grant.FileId == fileId && grant.UserId != nil && *grant.UserId == userId
+	})
+}
+
+func (repo *memoryFileRepository) PathExists(ctx context.Context, path string) (bool, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, file := range repo.files {
+		if file.FilePath == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (repo *memoryFileRepository) Grants(ctx context.Context, fileId uint, userId uint) ([]FileGrant, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var grants []FileGrant
+	for _, grant := range repo.grants {
+		if grant.FileId == fileId && grant.UserId != nil && *grant.UserId == userId {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+// grant gives a user a role on a file, the fake's stand in for the grants endpoints.
+func (repo *memoryFileRepository) grant(fileId uint, userId uint, role string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.grants = append(repo.grants, FileGrant{FileId: fileId, UserId: &userId, Role: role})
+}
+
+func (repo *memoryFileRepository) Usage(ctx context.Context, userId uint) (Usage, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	usage, ok := repo.usage[userId]
+	if !ok {
+		usage = Usage{UserId: userId}
+	}
+	return usage, nil
+}
+
+func (repo *memoryFileRepository) Create(ctx context.Context, file *File, quota Quota) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if file.UserId != 0 {
+		usage := repo.usage[file.UserId]
+		if !quota.allows(usage, file.Size, 1) {
+			return errQuotaExceeded
+		}
+		repo.usage[file.UserId] = Usage{UserId: file.UserId, UpdatedAt: time.Now(), Bytes: usage.Bytes + file.Size, Files: usage.Files + 1}
+	}
+
+	repo.nextId++
+	now := time.Now()
+	file.ID, file.CreatedAt, file.UpdatedAt = repo.nextId, now, now
+	repo.files[file.ID] = *file
+	repo.events = append(repo.events, eventFileCreated)
+	return nil
+}
+
+func (repo *memoryFileRepository) Update(ctx context.Context, id uint, name string, description string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	file := repo.files[id]
+	if name != "" {
+		file.Name = name
+	}
+	if description != "" {
+		file.Description = description
+	}
+	file.UpdatedAt = time.Now()
+	repo.files[id] = file
+	repo.events = append(repo.events, eventFileUpdated)
+	return nil
+}
+
+func (repo *memoryFileRepository) Delete(ctx context.Context, id uint) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	file := repo.files[id]
+	file.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	repo.files[id] = file
+	repo.events = append(repo.events, eventFileDeleted)
+	return nil
+}
+
+func (repo *memoryFileRepository) Purge(ctx context.Context, file File) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.files, file.ID)
+	repo.grants = slices.DeleteFunc(repo.grants, func(grant FileGrant) bool { return grant.FileId == file.ID })
+	if usage, ok := repo.usage[file.UserId]; ok {
+		repo.usage[file.UserId] = Usage{UserId: file.UserId, UpdatedAt: time.Now(), Bytes: usage.Bytes - file.Size, Files: usage.Files - 1}
+	}
+	repo.events = append(repo.events, eventFilePurged)
+	return nil
+}
+
+type memoryUserRepository struct {
+	mu     sync.Mutex
+	users  []User
+	nextId uint
+}
+
+func (repo *memoryUserRepository) ByEmail(ctx context.Context, email string) (User, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, user := range repo.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (repo *memoryUserRepository) Create(ctx context.Context, user *User) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	// like the unique index on users.email
+	for _, existing := range repo.users {
+		if existing.Email == user.Email {
+			return errors.New("a user with that email exists already")
+		}
+	}
+
+	repo.nextId++
+	now := time.Now()
+	user.ID, user.CreatedAt, user.UpdatedAt = repo.nextId, now, now
+	repo.users = append(repo.users, *user)
+	return nil
+}
+
+type memoryTagRepository struct {
+	mu   sync.Mutex
+	tags []Tag
+}
+
+func (repo *memoryTagRepository) FindOrCreate(ctx context.Context, names []string) ([]Tag, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		index := slices.IndexFunc(repo.tags, func(tag Tag) bool { return tag.Name == name })
+		if index < 0 {
+			repo.tags = append(repo.tags, Tag{ID: uint(len(repo.tags) + 1), Name: name})
+			index = len(repo.tags) - 1
+		}
+		tags = append(tags, repo.tags[index])
+	}
+	return tags, nil
+}
+
+// newMemoryApp is an app whose files, users and tags are kept in memory. What isn't behind a
+// repository yet, like jobs, change events, tag links, the audit log and webhooks, is in an
+// in-memory SQLite database, so nothing but uploads is written to disk, and they're removed when
+// the test ends.
+func newMemoryApp(t *testing.T) *App {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+	// every connection to :memory: is a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := migrateDatabase(context.Background(), db); err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() {
+		_ = sqlDB.Close()
+		_ = os.RemoveAll("./files")
+	})
+
+	app := &App{
+		db:    db,
+		users: newUserService(&memoryUserRepository{}),
+	}
+	app.files = newFileService(newMemoryFileRepository(), &memoryTagRepository{}, app.userQuota)
+	return app
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// Metrics are the app's Prometheus collectors, each app has its own registry.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestsInFlight prometheus.Gauge
+	uploadedBytes    prometheus.Counter
+	downloadedBytes  prometheus.Counter
+	logins           *prometheus.CounterVec
+	dbErrors         *prometheus.CounterVec
+}
+
+func newMetrics(db *gorm.DB) *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by route template and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "How long HTTP requests took, by route template.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests being handled right now.",
+		}),
+		uploadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "files_uploaded_bytes_total",
+			Help: "Bytes of file content stored from uploads and imports.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "files_downloaded_bytes_total",
+			Help: "Bytes of file content, thumbnails and archives sent to clients.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logins_total",
+			Help: "Login attempts, by result.",
+		}, []string{"result"}),
+		dbErrors: databaseErrors(db),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.requests,
+		metrics.requestDuration,
+		metrics.requestsInFlight,
+		metrics.uploadedBytes,
+		metrics.downloadedBytes,
+		metrics.logins,
+		metrics.dbErrors,
+		&storageCollector{db: db},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	// both result labels show up from the start, so rate() works before the first failure
+	metrics.logins.WithLabelValues("success")
+	metrics.logins.WithLabelValues("failure")
+
+	return metrics
+}
+
+// dbErrorsPlugin hooks into gorm so every failed statement is counted, wherever it came from. It's
+// a plugin so it's installed once per database, with a counter that every Metrics for that database
+// shares, however many are made.
+type dbErrorsPlugin struct {
+	counter *prometheus.CounterVec
+}
+
+func (plugin *dbErrorsPlugin) Name() string {
+	return "metrics:db_errors"
+}
+
+func (plugin *dbErrorsPlugin) Initialize(db *gorm.DB) error {
+	count := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				plugin.counter.WithLabelValues(operation).Inc()
+			}
+		}
+	}
+
+	return errors.Join(
+		db.Callback().Create().After("*").Register("metrics:create", count("create")),
+		db.Callback().Query().After("*").Register("metrics:query", count("query")),
+		db.Callback().Update().After("*").Register("metrics:update", count("update")),
+		db.Callback().Delete().After("*").Register("metrics:delete", count("delete")),
+		db.Callback().Row().After("*").Register("metrics:row", count("row")),
+		db.Callback().Raw().After("*").Register("metrics:raw", count("raw")),
+	)
+}
+
+// databaseErrors is the failed statement counter for db, installing the plugin the first time.
+func databaseErrors(db *gorm.DB) *prometheus.CounterVec {
+	plugin := &dbErrorsPlugin{counter: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_errors_total",
+		Help: "Database statements that failed, by operation. Not found isn't counted.",
+	}, []string{"operation"})}
+
+	err := db.Use(plugin)
+	if errors.Is(err, gorm.ErrRegistered) {
+		return db.Config.Plugins[plugin.Name()].(*dbErrorsPlugin).counter
+	}
+	if err != nil {
+		slog.Error("Counting database errors failed", "error", err)
+	}
+	return plugin.counter
+}
+
+// instrument records every request under its route template, so /files/1 and /files/2 are both /files/:id.
+func (metrics *Metrics) instrument(c *gin.Context) {
+	metrics.requestsInFlight.Inc()
+	defer metrics.requestsInFlight.Dec()
+
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metrics.requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	metrics.requestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
+
+func (metrics *Metrics) handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// countDownload adds the response body written so far to the downloaded bytes.
+func (metrics *Metrics) countDownload(c *gin.Context) {
+	if size := c.Writer.Size(); size > 0 {
+		metrics.downloadedBytes.Add(float64(size))
+	}
+}
+
+var (
+	storageBytesDesc = prometheus.NewDesc("storage_used_bytes", "Bytes used by stored files, including soft deleted ones.", nil, nil)
+	storageFilesDesc = prometheus.NewDesc("storage_files", "Stored files, including soft deleted ones.", nil, nil)
+)
+
+// storageCollector reads storage usage from the usage table when scraped, so every server reports the same totals.
+type storageCollector struct {
+	db *gorm.DB
+}
+
+func (collector *storageCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- storageBytesDesc
+	descs <- storageFilesDesc
+}
+
+func (collector *storageCollector) Collect(metrics chan<- prometheus.Metric) {
+	var totals struct {
+		Bytes int64
+		Files int64
+	}
+	err := collector.db.Model(&Usage{}).Select("COALESCE(SUM(bytes), 0) AS bytes, COALESCE(SUM(files), 0) AS files").Scan(&totals).Error
+	if err != nil {
+		metrics <- prometheus.NewInvalidMetric(storageBytesDesc, err)
+		return
+	}
+
+	metrics <- prometheus.MustNewConstMetric(storageBytesDesc, prometheus.GaugeValue, float64(totals.Bytes))
+	metrics <- prometheus.MustNewConstMetric(storageFilesDesc, prometheus.GaugeValue, float64(totals.Files))
+}
+
+// requireMetricsAccess lets in scrapers sending "Authorization: Bearer <METRICS_TOKEN>", and otherwise admins.
+func (app *App) requireMetricsAccess(c *gin.Context) {
+	token := app.config.Metrics.Token
+	bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token != "" && ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+		c.Next()
+		return
+	}
+
+	if _, ok := currentUser(c); !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not logged in"})
+		return
+	}
+	requireAdmin(c)
+}
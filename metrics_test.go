@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	defer cleanUp()
+	t.Setenv("METRICS_TOKEN", "scrape-me")
+
+	_, router := setupTestApp()
+	adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	w := performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "wrong"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "POST", "/login", User{Email: "test@test.com", Password: "secret"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	content := []byte("This is a test file content.")
+	w = uploadTestFile(t, router, cookie, "testfile.txt", content, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for range 2 {
+		w = performJSON(router, "GET", "/files/1/content", nil, cookie)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = performJSON(router, "GET", "/files/2", nil, cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performJSON(router, "GET", "/metrics", nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+
+	// routes are labelled by template, not by the ids in them
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/files/:id/content",status="200"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/files/:id",status="404"} 1`)
+	assert.NotContains(t, body, `route="/files/1`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="POST",route="/files"} 1`)
+	assert.Contains(t, body, `logins_total{result="failure"} 1`)
+	assert.Contains(t, body, `logins_total{result="success"} 1`)
+	assert.Contains(t, body, fmt.Sprintf("files_uploaded_bytes_total %d", len(content)))
+	assert.Contains(t, body, fmt.Sprintf("files_downloaded_bytes_total %d", 2*len(content)))
+	assert.Contains(t, body, fmt.Sprintf("storage_used_bytes %d", len(content)))
+	assert.Contains(t, body, "storage_files 1")
+
+	// scrapers use the token instead of logging in
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape-me")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "GET", "/metrics", nil, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestDatabaseErrorsCountedOnce(t *testing.T) {
+	defer cleanUp()
+	app, _ := setupTestApp()
+
+	// a reloaded or second app on the same database shares the callbacks instead of adding more
+	first, second := newMetrics(app.db), newMetrics(app.db)
+	assert.Same(t, first.dbErrors, second.dbErrors)
+
+	assert.Error(t, app.db.Exec("SELECT * FROM missing_table").Error)
+	w := httptest.NewRecorder()
+	second.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `db_errors_total{operation="raw"} 1`+"\n")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/backend-project/jobs"
+	"github.com/backend-project/migrations"
+	"gorm.io/gorm"
+)
+
+// migratedModels are the models with tables. The migrations in migrations/ create their tables,
+// readiness checks they all exist.
+var migratedModels = []any{&File{}, &Tag{}, &User{}, &Folder{}, &Group{}, &FileGrant{}, &ShareLink{}, &Usage{}, &jobs.Job{}, &Webhook{}, &WebhookDelivery{}, &ChangeEvent{}, &AuditLog{}}
+
+// newMigrator is the migrator with the migrations for the database's dialect.
+func newMigrator(db *gorm.DB) (*migrations.Migrator, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	return migrations.New(sqlDB, db.Dialector.Name())
+}
+
+// migrateDatabase applies any pending migrations, waiting for other processes doing the same.
+func migrateDatabase(ctx context.Context, db *gorm.DB) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(ctx)
+	for _, migration := range applied {
+		slog.Info("Applied migration", "version", migration.Version, "name", migration.Name)
+	}
+	return err
+}
+
+// migrateCommand runs "migrate up", "migrate down [steps]" or "migrate status" and writes what it did to w.
+// down undoes one migration unless it's told how many.
+func migrateCommand(ctx context.Context, db *gorm.DB, args []string, w io.Writer) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [steps] | status")
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Fprintf(w, "applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "already up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("steps must be a positive number, not %q", args[1])
+			}
+		}
+		undone, err := migrator.Down(ctx, steps)
+		for _, migration := range undone {
+			fmt.Fprintf(w, "undid %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return table.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, it's up, down or status", args[0])
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/backend-project/jobs"
+	"github.com/backend-project/storage"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// TestMigrationsMatchModels catches model changes that were made without a migration.
+func TestMigrationsMatchModels(t *testing.T) {
+	defer cleanUp()
+
+	app, _ := setupTestApp()
+	assertSchemaMatchesModels(t, app.db)
+}
+
+func assertSchemaMatchesModels(t *testing.T, db *gorm.DB) {
+	for _, model := range migratedModels {
+		statement := &gorm.Statement{DB: db}
+		assert.NoError(t, statement.Parse(model))
+
+		for _, field := range statement.Schema.Fields {
+			if field.DBName != "" {
+				assert.True(t, db.Migrator().HasColumn(model, field.DBName), "%s.%s", statement.Schema.Table, field.DBName)
+			}
+		}
+		for _, index := range statement.Schema.ParseIndexes() {
+			assert.True(t, db.Migrator().HasIndex(model, index.Name), "%s", index.Name)
+		}
+	}
+}
+
+// baselineFile, baselineTag and baselineUser are the models as they were when AutoMigrate made the tables.
+type baselineFile struct {
+	gorm.Model
+	Name        string
+	Description string
+	FilePath    string        `gorm:"index"`
+	Tags        []baselineTag `gorm:"many2many:user_tags;joinForeignKey:file_id;joinReferences:tag_id"`
+	UserId      uint8
+}
+
+func (baselineFile) TableName() string { return "files" }
+
+type baselineTag struct {
+	gorm.Model
+	Name string
+}
+
+func (baselineTag) TableName() string { return "tags" }
+
+type baselineUser struct {
+	gorm.Model
+	Email    string `gorm:"uniqueIndex"`
+	Password string
+	Files    []baselineFile `gorm:"foreignKey:UserId"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+// TestMigrateBaselineDatabase migrates a database made before there were migrations, on SQLite and on
+// the servers in TEST_MYSQL_DSN and TEST_POSTGRES_DSN when they're set.
+func TestMigrateBaselineDatabase(t *testing.T) {
+	dialectors := map[string]gorm.Dialector{driverSQLite: sqlite.Open(filepath.Join(t.TempDir(), "baseline.db"))}
+	for _, driver := range []string{driverMySQL, driverPostgres} {
+		if dsn := os.Getenv("TEST_" + strings.ToUpper(driver) + "_DSN"); dsn != "" {
+			dialector, err := dialectorFor(driver, dsn)
+			assert.NoError(t, err)
+			dialectors[driver] = dialector
+		}
+	}
+
+	for driver, dialector := range dialectors {
+		t.Run(driver, func(t *testing.T) {
+			ctx := context.Background()
+			db, err := gorm.Open(dialector, &gorm.Config{})
+			assert.NoError(t, err)
+			dropTables := func() {
+				tables := append([]any{"schema_migrations", "user_tags"}, migratedModels...)
+				assert.NoError(t, db.Migrator().DropTable(tables...))
+			}
+			dropTables()
+			t.Cleanup(dropTables)
+
+			assert.NoError(t, db.AutoMigrate(&baselineFile{}, &baselineTag{}, &baselineUser{}))
+			owner := baselineUser{Email: "test@test.com"}
+			assert.NoError(t, db.Create(&owner).Error)
+			assert.NoError(t, db.Create(&baselineFile{Name: "old", FilePath: "old-key", UserId: uint8(owner.ID), Tags: []baselineTag{{Name: "red"}}}).Error)
+			store := storage.NewDisk(t.TempDir())
+			_, err = store.Put(ctx, "old-key", strings.NewReader("old content"))
+			assert.NoError(t, err)
+
+			var output bytes.Buffer
+			assert.NoError(t, migrateCommand(ctx, db, []string{"up"}, &output))
+			assert.Equal(t, "applied 1_initial\napplied 2_user_roles\napplied 3_file_integrity\n", output.String())
+			assertSchemaMatchesModels(t, db)
+
+			// the old rows are still there, and user ids no longer stop at 255
+			file, err := gorm.G[File](db).Preload("Tags", nil).Where("name = ?", "old").First(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, owner.ID, file.UserId)
+			assert.Len(t, file.Tags, 1)
+
+			// old files have no size until reindex reads it from storage, and then count towards usage
+			var unsized int64
+			assert.NoError(t, db.Model(&File{}).Where("size IS NULL").Count(&unsized).Error)
+			assert.Equal(t, int64(1), unsized)
+			app := &App{db: db, storage: store, jobs: jobs.NewQueue(db)}
+			assert.NoError(t, app.reindexFiles(ctx, io.Discard))
+			file, err = gorm.G[File](db).Where("name = ?", "old").First(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len("old content")), file.Size)
+			usage, err := gorm.G[Usage](db).Where("user_id = ?", owner.ID).First(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len("old content")), usage.Bytes)
+			big := User{ID: 1000, Email: "big@test.com"}
+			assert.NoError(t, db.Create(&big).Error)
+			assert.NoError(t, db.Create(&File{Name: "new", FilePath: "new-key", UserId: big.ID}).Error)
+			file, err = gorm.G[File](db).Where("name = ?", "new").First(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, big.ID, file.UserId)
+
+			output.Reset()
+			assert.NoError(t, migrateCommand(ctx, db, []string{"up"}, &output))
+			assert.Equal(t, "already up to date\n", output.String())
+		})
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	ctx := context.Background()
+	migrate := func(args ...string) (string, error) {
+		var output bytes.Buffer
+		err := migrateCommand(ctx, app.db, args, &output)
+		return output.String(), err
+	}
+
+	output, err := migrate("status")
+	assert.NoError(t, err)
+	assert.Regexp(t, `VERSION\s+NAME\s+APPLIED\n1\s+initial\s+\d{4}-.*\n2\s+user_roles\s+\d{4}-.*\n3\s+file_integrity\s+\d{4}-`, output)
+
+	output, err = migrate("up")
+	assert.NoError(t, err)
+	assert.Equal(t, "already up to date\n", output)
+
+	output, err = migrate("down")
+	assert.NoError(t, err)
+	assert.Equal(t, "undid 3_file_integrity\n", output)
+	assert.False(t, app.db.Migrator().HasColumn(&File{}, "integrity_status"))
+
+	output, err = migrate("down", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "undid 2_user_roles\nundid 1_initial\n", output)
+	assert.False(t, app.db.Migrator().HasTable(&File{}))
+
+	output, err = migrate("status")
+	assert.NoError(t, err)
+	assert.Regexp(t, `1\s+initial\s+pending\n2\s+user_roles\s+pending\n3\s+file_integrity\s+pending`, output)
+
+	// the instance isn't ready until it's migrated again
+	code, result := getReadinessResult(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "3 migrations haven't been applied", result.Checks["migrations"].Error)
+
+	output, err = migrate("up")
+	assert.NoError(t, err)
+	assert.Equal(t, "applied 1_initial\napplied 2_user_roles\napplied 3_file_integrity\n", output)
+	code, _ = getReadinessResult(t, router)
+	assert.Equal(t, http.StatusOK, code)
+
+	_, err = migrate("down", "none")
+	assert.Error(t, err)
+	_, err = migrate("sideways")
+	assert.Error(t, err)
+	_, err = migrate()
+	assert.Error(t, err)
+}
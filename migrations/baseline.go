@@ -0,0 +1,201 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Baseline is what the first migration expects of tables that AutoMigrate created before there were
+// migrations. The first migration only creates tables that don't exist yet, so before migrating, Up
+// brings tables that do exist up to it: missing columns and indexes are added and columns that were
+// made too narrow are widened. Tables that don't exist are left to the migrations.
+type Baseline struct {
+	Columns []Column
+	Indexes []Index
+}
+
+// Column is added with Type when it's missing. Widen also changes an existing column to Type when its
+// data type is something else, on MySQL and Postgres, SQLite doesn't mind.
+type Column struct {
+	Table string
+	Name  string
+	Type  string
+	Widen bool
+}
+
+type Index struct {
+	Table   string
+	Name    string
+	Columns []string
+}
+
+// baselines are the differences between 0001_initial and the users, files, tags and user_tags tables
+// AutoMigrate made, where files.user_id was a uint8.
+var baselines = map[string]Baseline{
+	"mysql": {
+		Columns: []Column{
+			{Table: "users", Name: "quota_bytes", Type: "bigint"},
+			{Table: "users", Name: "quota_files", Type: "bigint"},
+			{Table: "files", Name: "user_id", Type: "bigint unsigned", Widen: true},
+			{Table: "files", Name: "folder_id", Type: "bigint unsigned"},
+			{Table: "files", Name: "size", Type: "bigint"},
+			{Table: "files", Name: "content_type", Type: "longtext"},
+			{Table: "files", Name: "scan_status", Type: "longtext"},
+			{Table: "files", Name: "checksum", Type: "varchar(64)"},
+		},
+		Indexes: baselineIndexes,
+	},
+	"postgres": {
+		Columns: []Column{
+			{Table: "users", Name: "quota_bytes", Type: "bigint"},
+			{Table: "users", Name: "quota_files", Type: "bigint"},
+			{Table: "files", Name: "user_id", Type: "bigint", Widen: true},
+			{Table: "files", Name: "folder_id", Type: "bigint"},
+			{Table: "files", Name: "size", Type: "bigint"},
+			{Table: "files", Name: "content_type", Type: "text"},
+			{Table: "files", Name: "scan_status", Type: "text"},
+			{Table: "files", Name: "checksum", Type: "varchar(64)"},
+		},
+		Indexes: baselineIndexes,
+	},
+	"sqlite": {
+		Columns: []Column{
+			{Table: "users", Name: "quota_bytes", Type: "integer"},
+			{Table: "users", Name: "quota_files", Type: "integer"},
+			{Table: "files", Name: "folder_id", Type: "integer"},
+			{Table: "files", Name: "size", Type: "integer"},
+			{Table: "files", Name: "content_type", Type: "text"},
+			{Table: "files", Name: "scan_status", Type: "text"},
+			{Table: "files", Name: "checksum", Type: "text"},
+		},
+		Indexes: baselineIndexes,
+	},
+}
+
+var baselineIndexes = []Index{
+	{Table: "files", Name: "idx_files_folder_id", Columns: []string{"folder_id"}},
+	{Table: "files", Name: "idx_files_user_id", Columns: []string{"user_id"}},
+}
+
+// adoptBaseline makes the changes in migrator.Baseline that tables still need, so it can run before
+// every migration and only does something the first time.
+func (migrator *Migrator) adoptBaseline(ctx context.Context, conn *sql.Conn) error {
+	for _, column := range migrator.Baseline.Columns {
+		exists, err := migrator.tableExists(ctx, conn, column.Table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		dataType, err := migrator.columnType(ctx, conn, column.Table, column.Name)
+		if err != nil {
+			return err
+		}
+
+		var statement string
+		switch {
+		case dataType == "":
+			statement = fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", migrator.quote(column.Table), migrator.quote(column.Name), column.Type)
+		case column.Widen && migrator.Dialect == "mysql" && !sameType(dataType, column.Type):
+			statement = fmt.Sprintf("ALTER TABLE %s MODIFY %s %s", migrator.quote(column.Table), migrator.quote(column.Name), column.Type)
+		case column.Widen && migrator.Dialect == "postgres" && !sameType(dataType, column.Type):
+			statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", migrator.quote(column.Table), migrator.quote(column.Name), column.Type)
+		default:
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("adopting %s.%s: %w", column.Table, column.Name, err)
+		}
+	}
+
+	for _, index := range migrator.Baseline.Indexes {
+		tableExists, err := migrator.tableExists(ctx, conn, index.Table)
+		if err != nil {
+			return err
+		}
+		indexExists, err := migrator.indexExists(ctx, conn, index.Table, index.Name)
+		if err != nil {
+			return err
+		}
+		if !tableExists || indexExists {
+			continue
+		}
+
+		columns := make([]string, len(index.Columns))
+		for i, column := range index.Columns {
+			columns[i] = migrator.quote(column)
+		}
+		statement := fmt.Sprintf("CREATE INDEX %s ON %s (%s)", migrator.quote(index.Name), migrator.quote(index.Table), strings.Join(columns, ","))
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("adopting %s: %w", index.Name, err)
+		}
+	}
+	return nil
+}
+
+// sameType compares a data type from the database, like bigint, with the start of a column type like
+// bigint unsigned.
+func sameType(dataType string, columnType string) bool {
+	name, _, _ := strings.Cut(columnType, " ")
+	name, _, _ = strings.Cut(name, "(")
+	return strings.EqualFold(dataType, name)
+}
+
+// columnType is the data type of a column, "" when there's no such column.
+func (migrator *Migrator) columnType(ctx context.Context, db querier, table string, column string) (string, error) {
+	var query string
+	switch migrator.Dialect {
+	case "mysql":
+		query = "SELECT data_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	case "postgres":
+		query = "SELECT data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?"
+	default:
+		query = "SELECT type FROM pragma_table_info(?) WHERE name = ?"
+	}
+
+	rows, err := db.QueryContext(ctx, migrator.bind(query), table, column)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var dataType string
+	if rows.Next() {
+		if err := rows.Scan(&dataType); err != nil {
+			return "", err
+		}
+		// SQLite columns can be declared without a type
+		if dataType == "" {
+			dataType = "any"
+		}
+	}
+	return dataType, rows.Err()
+}
+
+func (migrator *Migrator) indexExists(ctx context.Context, db querier, table string, index string) (bool, error) {
+	var query string
+	switch migrator.Dialect {
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?"
+	case "postgres":
+		query = "SELECT COUNT(*) FROM pg_indexes WHERE schemaname = current_schema() AND tablename = ? AND indexname = ?"
+	default:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+	}
+
+	var count int
+	err := db.QueryRowContext(ctx, migrator.bind(query), table, index).Scan(&count)
+	return count > 0, err
+}
+
+// quote quotes an identifier, with double quotes for Postgres and backticks for the others.
+func (migrator *Migrator) quote(name string) string {
+	if migrator.Dialect == "postgres" {
+		return `"` + name + `"`
+	}
+	return "`" + name + "`"
+}
@@ -0,0 +1,381 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed mysql postgres sqlite
+var files embed.FS
+
+// table records which migrations have been applied to a database.
+const table = "schema_migrations"
+
+// postgresLock is the key of the advisory lock held while migrating Postgres, any number that
+// nothing else uses.
+const postgresLock = 4_212_377_519
+
+var ErrLocked = errors.New("another process is migrating the database")
+
+// Migration is a pair of files like 0002_add_roles.up.sql and 0002_add_roles.down.sql.
+// Down is empty for migrations that can't be undone.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and whether it has been applied to the database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in the top directory of fsys, in version order.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is called both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return int(a.Version - b.Version) })
+	return migrations, nil
+}
+
+// statements splits a migration into the statements in it, which end with a semicolon at the end of a line.
+// Lines starting with -- are comments.
+func statements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// Migrator applies the migrations for one database. Runs in other processes wait for each other,
+// so every replica can migrate on start.
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    string
+	Migrations []Migration
+	// LockTimeout is how long to wait for another process that's migrating.
+	LockTimeout time.Duration
+	// Baseline is applied to existing tables before migrating, see Baseline.
+	Baseline Baseline
+}
+
+// New returns a migrator with the built in migrations for dialect, mysql, postgres or sqlite.
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	dir, err := fs.Sub(files, dialect)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations for %s", dialect)
+	}
+	return &Migrator{DB: db, Dialect: dialect, Migrations: migrations, LockTimeout: time.Minute, Baseline: baselines[dialect]}, nil
+}
+
+// Status lists every migration and whether it has been applied, without changing anything.
+func (migrator *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := migrator.applied(ctx, migrator.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(migrator.Migrations))
+	for i, migration := range migrator.Migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = Status{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+// Pending is how many migrations haven't been applied yet.
+func (migrator *Migrator) Pending(ctx context.Context) (int, error) {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order and returns the ones it applied. Tables created before
+// there were migrations are brought up to the Baseline first, even when there's nothing pending, so
+// databases that applied the first migration without it are caught up too.
+func (migrator *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := migrator.locked(ctx, func(conn *sql.Conn) error {
+		if err := migrator.adoptBaseline(ctx, conn); err != nil {
+			return err
+		}
+
+		applied, err := migrator.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrator.Migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := migrator.run(ctx, conn, migration, migration.Up); err != nil {
+				return err
+			}
+			_, err := conn.ExecContext(ctx, migrator.bind("INSERT INTO "+table+" (version, name, applied_at) VALUES (?, ?, ?)"),
+				migration.Version, migration.Name, time.Now().Unix())
+			if err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down undoes the last steps applied migrations, newest first, and returns the ones it undid.
+func (migrator *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := migrator.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := migrator.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range slices.Backward(migrator.Migrations) {
+			if len(done) == steps {
+				break
+			}
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s can't be undone, it has no down file", migration.Version, migration.Name)
+			}
+			if err := migrator.run(ctx, conn, migration, migration.Down); err != nil {
+				return err
+			}
+			if _, err := conn.ExecContext(ctx, migrator.bind("DELETE FROM "+table+" WHERE version = ?"), migration.Version); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func (migrator *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, script string) error {
+	for i, statement := range statements(script) {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %d_%s, statement %d: %w", migration.Version, migration.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// applied is when each applied migration was applied. A database without the table has none applied.
+func (migrator *Migrator) applied(ctx context.Context, db querier) (map[int64]time.Time, error) {
+	applied := map[int64]time.Time{}
+
+	exists, err := migrator.tableExists(ctx, db, table)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version, appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+	return applied, rows.Err()
+}
+
+func (migrator *Migrator) tableExists(ctx context.Context, db querier, name string) (bool, error) {
+	var query string
+	switch migrator.Dialect {
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	case "postgres":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	default:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	}
+
+	var count int
+	err := db.QueryRowContext(ctx, migrator.bind(query), name).Scan(&count)
+	return count > 0, err
+}
+
+// bind rewrites the ? placeholders in query as $1, $2... for Postgres.
+func (migrator *Migrator) bind(query string) string {
+	if migrator.Dialect != "postgres" {
+		return query
+	}
+
+	var bound strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&bound, "$%d", n)
+			continue
+		}
+		bound.WriteRune(r)
+	}
+	return bound.String()
+}
+
+// locked runs migrate on a connection of its own while holding the migration lock. SQLite takes the
+// database's write lock, so the whole run is one transaction. MySQL uses a named lock instead, because
+// its schema changes commit straight away. Postgres takes an advisory lock and, as its schema changes
+// are transactional too, runs in one transaction like SQLite.
+func (migrator *Migrator) locked(ctx context.Context, migrate func(conn *sql.Conn) error) (err error) {
+	conn, err := migrator.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch migrator.Dialect {
+	case "mysql":
+		var acquired sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", table, int(migrator.LockTimeout.Seconds())).Scan(&acquired)
+		if err != nil {
+			return err
+		}
+		if acquired.Int64 != 1 {
+			return ErrLocked
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", table)
+		}()
+	case "postgres":
+		lockCtx := ctx
+		if migrator.LockTimeout > 0 {
+			var cancel context.CancelFunc
+			lockCtx, cancel = context.WithTimeout(ctx, migrator.LockTimeout)
+			defer cancel()
+		}
+		if _, err := conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", postgresLock); err != nil {
+			if lockCtx.Err() != nil && ctx.Err() == nil {
+				return ErrLocked
+			}
+			return err
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", postgresLock)
+		}()
+		if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+			return err
+		}
+		defer migrator.commitOrRollback(ctx, conn, &err)
+	case "sqlite":
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			return fmt.Errorf("%w: %w", ErrLocked, err)
+		}
+		defer migrator.commitOrRollback(ctx, conn, &err)
+	default:
+		return fmt.Errorf("migrations don't support %s", migrator.Dialect)
+	}
+
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)")
+	if err != nil {
+		return err
+	}
+	return migrate(conn)
+}
+
+// commitOrRollback ends the transaction locked started, rolling it back if *err is set.
+func (migrator *Migrator) commitOrRollback(ctx context.Context, conn *sql.Conn, err *error) {
+	if *err != nil {
+		_, _ = conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK")
+		return
+	}
+	_, *err = conn.ExecContext(ctx, "COMMIT")
+}
@@ -0,0 +1,209 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func hasTable(t *testing.T, db *sql.DB, name string) bool {
+	var count int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count))
+	return count > 0
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(fstest.MapFS{
+		"0002_add_roles.up.sql":   {Data: []byte("ALTER TABLE users ADD role text;")},
+		"0001_initial.up.sql":     {Data: []byte("CREATE TABLE users (id integer);")},
+		"0001_initial.down.sql":   {Data: []byte("DROP TABLE users;")},
+		"README.md":               {Data: []byte("not a migration")},
+		"0003_backfill.down.sql2": {Data: []byte("not a migration either")},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, migrations, 2) {
+		assert.Equal(t, Migration{Version: 1, Name: "initial", Up: "CREATE TABLE users (id integer);", Down: "DROP TABLE users;"}, migrations[0])
+		assert.Equal(t, int64(2), migrations[1].Version)
+		assert.Empty(t, migrations[1].Down)
+	}
+
+	_, err = Load(fstest.MapFS{"0001_initial.down.sql": {Data: []byte("DROP TABLE users;")}})
+	assert.ErrorContains(t, err, "no up file")
+
+	assert.Equal(t, []string{"CREATE TABLE a (\n  id integer\n);", "INSERT INTO a VALUES (1);"}, statements(`
+-- two statements
+CREATE TABLE a (
+  id integer
+);
+
+INSERT INTO a VALUES (1);
+`))
+}
+
+func TestUpAndDown(t *testing.T) {
+	db := openTestDB(t)
+	migrator, err := New(db, "sqlite")
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	pending, err := migrator.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrator.Migrations), pending)
+	assert.False(t, hasTable(t, db, table), "status doesn't create anything")
+
+	applied, err := migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(migrator.Migrations))
+	assert.True(t, hasTable(t, db, "users"))
+
+	statuses, err := migrator.Status(ctx)
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+
+	// nothing left to do the second time
+	applied, err = migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	undone, err := migrator.Down(ctx, 1)
+	assert.NoError(t, err)
+	assert.Len(t, undone, 1)
+	pending, err = migrator.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pending)
+
+	_, err = migrator.Down(ctx, len(migrator.Migrations))
+	assert.NoError(t, err)
+	assert.False(t, hasTable(t, db, "users"))
+
+	_, err = migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.True(t, hasTable(t, db, "users"))
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	migrations, err := Load(fstest.MapFS{
+		"0001_initial.up.sql": {Data: []byte("CREATE TABLE a (id integer);")},
+		"0002_broken.up.sql":  {Data: []byte("CREATE TABLE b (id integer);\nCREATE TABLE oops (;")},
+	})
+	assert.NoError(t, err)
+	migrator := &Migrator{DB: db, Dialect: "sqlite", Migrations: migrations}
+	ctx := context.Background()
+
+	_, err = migrator.Up(ctx)
+	assert.ErrorContains(t, err, "migration 2_broken, statement 2")
+
+	// on SQLite the whole run is undone
+	assert.False(t, hasTable(t, db, "a"))
+	assert.False(t, hasTable(t, db, "b"))
+	pending, err := migrator.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pending)
+
+	_, err = migrator.Down(ctx, 1)
+	assert.NoError(t, err)
+
+	migrator.Migrations = migrations[:1]
+	_, err = migrator.Up(ctx)
+	assert.NoError(t, err)
+	_, err = migrator.Down(ctx, 1)
+	assert.ErrorContains(t, err, "can't be undone")
+}
+
+func TestConcurrentUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var wg sync.WaitGroup
+	results := make(chan int, 4)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every replica has its own pool
+			db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000")
+			assert.NoError(t, err)
+			defer db.Close()
+
+			migrator, err := New(db, "sqlite")
+			assert.NoError(t, err)
+			applied, err := migrator.Up(context.Background())
+			assert.NoError(t, err)
+			results <- len(applied)
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	// each migration ran exactly once between them
+	total := 0
+	for applied := range results {
+		total += applied
+	}
+	migrations, err := New(nil, "sqlite")
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations.Migrations), total)
+}
+
+// TestServerDatabases applies and undoes every migration on MySQL and Postgres, given an empty database
+// in TEST_MYSQL_DSN or TEST_POSTGRES_DSN.
+func TestServerDatabases(t *testing.T) {
+	for dialect, driver := range map[string]string{"mysql": "mysql", "postgres": "pgx"} {
+		t.Run(dialect, func(t *testing.T) {
+			dsn := os.Getenv("TEST_" + strings.ToUpper(dialect) + "_DSN")
+			if dsn == "" {
+				t.Skipf("TEST_%s_DSN isn't set", strings.ToUpper(dialect))
+			}
+			db, err := sql.Open(driver, dsn)
+			assert.NoError(t, err)
+			defer db.Close()
+			migrator, err := New(db, dialect)
+			assert.NoError(t, err)
+			ctx := context.Background()
+
+			applied, err := migrator.Up(ctx)
+			assert.NoError(t, err)
+			assert.Len(t, applied, len(migrator.Migrations))
+			pending, err := migrator.Pending(ctx)
+			assert.NoError(t, err)
+			assert.Zero(t, pending)
+
+			undone, err := migrator.Down(ctx, len(migrator.Migrations))
+			assert.NoError(t, err)
+			assert.Len(t, undone, len(migrator.Migrations))
+		})
+	}
+}
+
+func TestBind(t *testing.T) {
+	migrator := &Migrator{Dialect: "postgres"}
+	assert.Equal(t, "INSERT INTO t (a, b) VALUES ($1, $2)", migrator.bind("INSERT INTO t (a, b) VALUES (?, ?)"))
+	migrator.Dialect = "mysql"
+	assert.Equal(t, "DELETE FROM t WHERE a = ?", migrator.bind("DELETE FROM t WHERE a = ?"))
+}
+
+func TestSameType(t *testing.T) {
+	assert.True(t, sameType("bigint", "bigint unsigned"))
+	assert.True(t, sameType("VARCHAR", "varchar(64)"))
+	assert.False(t, sameType("tinyint", "bigint unsigned"))
+	assert.False(t, sameType("smallint", "bigint"))
+}
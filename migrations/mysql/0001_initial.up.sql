@@ -0,0 +1,212 @@
+-- The schema AutoMigrate used to create. IF NOT EXISTS lets databases it already created adopt this as their starting point,
+-- after Up has added what their tables are missing, see baseline.go.
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `email` varchar(191),
+  `password` longtext,
+  `quota_bytes` bigint,
+  `quota_files` bigint,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `idx_users_email` (`email`),
+  INDEX `idx_users_deleted_at` (`deleted_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `files` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `name` longtext,
+  `description` longtext,
+  `file_path` varchar(191),
+  `user_id` bigint unsigned,
+  `folder_id` bigint unsigned,
+  `size` bigint,
+  `content_type` longtext,
+  `scan_status` longtext,
+  `checksum` varchar(64),
+  PRIMARY KEY (`id`),
+  INDEX `idx_files_folder_id` (`folder_id`),
+  INDEX `idx_files_user_id` (`user_id`),
+  INDEX `idx_files_file_path` (`file_path`),
+  INDEX `idx_files_deleted_at` (`deleted_at`),
+  CONSTRAINT `fk_users_files` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `tags` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `name` longtext,
+  PRIMARY KEY (`id`),
+  INDEX `idx_tags_deleted_at` (`deleted_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_tags` (
+  `tag_id` bigint unsigned,
+  `file_id` bigint unsigned,
+  PRIMARY KEY (`tag_id`, `file_id`),
+  CONSTRAINT `fk_user_tags_tag` FOREIGN KEY (`tag_id`) REFERENCES `tags`(`id`),
+  CONSTRAINT `fk_user_tags_file` FOREIGN KEY (`file_id`) REFERENCES `files`(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `folders` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `name` longtext,
+  `parent_id` bigint unsigned,
+  `user_id` bigint unsigned,
+  PRIMARY KEY (`id`),
+  INDEX `idx_folders_user_id` (`user_id`),
+  INDEX `idx_folders_parent_id` (`parent_id`),
+  INDEX `idx_folders_deleted_at` (`deleted_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `groups` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `name` longtext,
+  `user_id` bigint unsigned,
+  PRIMARY KEY (`id`),
+  INDEX `idx_groups_user_id` (`user_id`),
+  INDEX `idx_groups_deleted_at` (`deleted_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `group_members` (
+  `group_id` bigint unsigned,
+  `user_id` bigint unsigned,
+  PRIMARY KEY (`group_id`, `user_id`),
+  CONSTRAINT `fk_group_members_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`),
+  CONSTRAINT `fk_group_members_group` FOREIGN KEY (`group_id`) REFERENCES `groups`(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `file_grants` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `file_id` bigint unsigned,
+  `user_id` bigint unsigned,
+  `group_id` bigint unsigned,
+  `role` longtext,
+  PRIMARY KEY (`id`),
+  INDEX `idx_file_grants_group_id` (`group_id`),
+  INDEX `idx_file_grants_user_id` (`user_id`),
+  INDEX `idx_file_grants_file_id` (`file_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `share_links` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `file_id` bigint unsigned,
+  `token_hash` varchar(64),
+  `password` longtext,
+  `expires_at` datetime(3) NULL,
+  `max_downloads` bigint,
+  `downloads` bigint,
+  `revoked_at` datetime(3) NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `idx_share_links_token_hash` (`token_hash`),
+  INDEX `idx_share_links_file_id` (`file_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `usages` (
+  `user_id` bigint unsigned,
+  `updated_at` datetime(3) NULL,
+  `bytes` bigint,
+  `files` bigint,
+  PRIMARY KEY (`user_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `jobs` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `type` varchar(100),
+  `payload` text,
+  `status` varchar(20),
+  `run_at` datetime(3) NULL,
+  `attempts` bigint,
+  `max_attempts` bigint,
+  `last_error` text,
+  `idempotency_key` varchar(191),
+  `locked_by` varchar(100),
+  `locked_at` datetime(3) NULL,
+  `finished_at` datetime(3) NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `idx_jobs_idempotency_key` (`idempotency_key`),
+  INDEX `idx_jobs_status_run_at` (`status`, `run_at`),
+  INDEX `idx_jobs_type` (`type`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhooks` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `url` longtext,
+  `events` longtext,
+  `secret` longtext,
+  `user_id` bigint unsigned,
+  PRIMARY KEY (`id`),
+  INDEX `idx_webhooks_user_id` (`user_id`),
+  INDEX `idx_webhooks_deleted_at` (`deleted_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `webhook_id` bigint unsigned,
+  `event_id` varchar(36),
+  `event` varchar(100),
+  `payload` text,
+  `status` varchar(20),
+  `attempts` bigint,
+  `response_status` bigint,
+  `response_body` text,
+  `last_error` text,
+  `delivered_at` datetime(3) NULL,
+  PRIMARY KEY (`id`),
+  INDEX `idx_webhook_deliveries_event_id` (`event_id`),
+  INDEX `idx_webhook_deliveries_webhook_id` (`webhook_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `change_events` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `type` varchar(100),
+  `file_id` bigint unsigned,
+  `user_id` bigint unsigned,
+  `data` text,
+  PRIMARY KEY (`id`),
+  INDEX `idx_change_events_user_id` (`user_id`),
+  INDEX `idx_change_events_file_id` (`file_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `audit_logs` (
+  `id` bigint unsigned AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `actor_id` bigint unsigned,
+  `actor_email` longtext,
+  `action` varchar(100),
+  `target_type` varchar(50),
+  `target_id` bigint unsigned,
+  `ip` varchar(45),
+  `user_agent` longtext,
+  `before` text,
+  `after` text,
+  PRIMARY KEY (`id`),
+  INDEX `idx_audit_logs_target` (`target_type`, `target_id`),
+  INDEX `idx_audit_logs_action` (`action`),
+  INDEX `idx_audit_logs_actor_id` (`actor_id`),
+  INDEX `idx_audit_logs_created_at` (`created_at`)
+);
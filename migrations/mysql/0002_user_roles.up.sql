@@ -0,0 +1,3 @@
+-- Roles used to come from the email address alone, the admin keeps theirs.
+ALTER TABLE `users` ADD COLUMN `role` varchar(20), ADD COLUMN `disabled_at` datetime(3) NULL;
+UPDATE `users` SET `role` = 'admin' WHERE `email` = 'damien.z.hall@gmail.com';
@@ -0,0 +1 @@
+ALTER TABLE `files` ADD COLUMN `integrity_status` varchar(20);
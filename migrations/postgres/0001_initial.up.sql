@@ -0,0 +1,211 @@
+-- Postgres was added after the move to migrations, so this is where its schema starts.
+CREATE TABLE IF NOT EXISTS "users" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "email" varchar(191),
+  "password" text,
+  "quota_bytes" bigint,
+  "quota_files" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_email" ON "users" ("email");
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "files" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "name" text,
+  "description" text,
+  "file_path" varchar(191),
+  "user_id" bigint,
+  "folder_id" bigint,
+  "size" bigint,
+  "content_type" text,
+  "scan_status" text,
+  "checksum" varchar(64),
+  PRIMARY KEY ("id"),
+  CONSTRAINT "fk_users_files" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_files_folder_id" ON "files" ("folder_id");
+CREATE INDEX IF NOT EXISTS "idx_files_user_id" ON "files" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_files_file_path" ON "files" ("file_path");
+CREATE INDEX IF NOT EXISTS "idx_files_deleted_at" ON "files" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "tags" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "name" text,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_tags_deleted_at" ON "tags" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "user_tags" (
+  "tag_id" bigint,
+  "file_id" bigint,
+  PRIMARY KEY ("tag_id", "file_id"),
+  CONSTRAINT "fk_user_tags_tag" FOREIGN KEY ("tag_id") REFERENCES "tags"("id"),
+  CONSTRAINT "fk_user_tags_file" FOREIGN KEY ("file_id") REFERENCES "files"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "folders" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "name" text,
+  "parent_id" bigint,
+  "user_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_folders_user_id" ON "folders" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_folders_parent_id" ON "folders" ("parent_id");
+CREATE INDEX IF NOT EXISTS "idx_folders_deleted_at" ON "folders" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "groups" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "name" text,
+  "user_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_groups_user_id" ON "groups" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_groups_deleted_at" ON "groups" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "group_members" (
+  "group_id" bigint,
+  "user_id" bigint,
+  PRIMARY KEY ("group_id", "user_id"),
+  CONSTRAINT "fk_group_members_user" FOREIGN KEY ("user_id") REFERENCES "users"("id"),
+  CONSTRAINT "fk_group_members_group" FOREIGN KEY ("group_id") REFERENCES "groups"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "file_grants" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "file_id" bigint,
+  "user_id" bigint,
+  "group_id" bigint,
+  "role" text,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_file_grants_group_id" ON "file_grants" ("group_id");
+CREATE INDEX IF NOT EXISTS "idx_file_grants_user_id" ON "file_grants" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_file_grants_file_id" ON "file_grants" ("file_id");
+
+CREATE TABLE IF NOT EXISTS "share_links" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "file_id" bigint,
+  "token_hash" varchar(64),
+  "password" text,
+  "expires_at" timestamptz,
+  "max_downloads" bigint,
+  "downloads" bigint,
+  "revoked_at" timestamptz,
+  PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_share_links_token_hash" ON "share_links" ("token_hash");
+CREATE INDEX IF NOT EXISTS "idx_share_links_file_id" ON "share_links" ("file_id");
+
+CREATE TABLE IF NOT EXISTS "usages" (
+  "user_id" bigint,
+  "updated_at" timestamptz,
+  "bytes" bigint,
+  "files" bigint,
+  PRIMARY KEY ("user_id")
+);
+
+CREATE TABLE IF NOT EXISTS "jobs" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "type" varchar(100),
+  "payload" text,
+  "status" varchar(20),
+  "run_at" timestamptz,
+  "attempts" bigint,
+  "max_attempts" bigint,
+  "last_error" text,
+  "idempotency_key" varchar(191),
+  "locked_by" varchar(100),
+  "locked_at" timestamptz,
+  "finished_at" timestamptz,
+  PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_jobs_idempotency_key" ON "jobs" ("idempotency_key");
+CREATE INDEX IF NOT EXISTS "idx_jobs_status_run_at" ON "jobs" ("status", "run_at");
+CREATE INDEX IF NOT EXISTS "idx_jobs_type" ON "jobs" ("type");
+
+CREATE TABLE IF NOT EXISTS "webhooks" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "deleted_at" timestamptz,
+  "url" text,
+  "events" text,
+  "secret" text,
+  "user_id" bigint,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_webhooks_user_id" ON "webhooks" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_webhooks_deleted_at" ON "webhooks" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "updated_at" timestamptz,
+  "webhook_id" bigint,
+  "event_id" varchar(36),
+  "event" varchar(100),
+  "payload" text,
+  "status" varchar(20),
+  "attempts" bigint,
+  "response_status" bigint,
+  "response_body" text,
+  "last_error" text,
+  "delivered_at" timestamptz,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_event_id" ON "webhook_deliveries" ("event_id");
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_webhook_id" ON "webhook_deliveries" ("webhook_id");
+
+CREATE TABLE IF NOT EXISTS "change_events" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "type" varchar(100),
+  "file_id" bigint,
+  "user_id" bigint,
+  "data" text,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_change_events_user_id" ON "change_events" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_change_events_file_id" ON "change_events" ("file_id");
+
+CREATE TABLE IF NOT EXISTS "audit_logs" (
+  "id" bigserial,
+  "created_at" timestamptz,
+  "actor_id" bigint,
+  "actor_email" text,
+  "action" varchar(100),
+  "target_type" varchar(50),
+  "target_id" bigint,
+  "ip" varchar(45),
+  "user_agent" text,
+  "before" text,
+  "after" text,
+  PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_target" ON "audit_logs" ("target_type", "target_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_action" ON "audit_logs" ("action");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_actor_id" ON "audit_logs" ("actor_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_created_at" ON "audit_logs" ("created_at");
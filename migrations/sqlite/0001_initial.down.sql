@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS `audit_logs`;
+DROP TABLE IF EXISTS `change_events`;
+DROP TABLE IF EXISTS `webhook_deliveries`;
+DROP TABLE IF EXISTS `webhooks`;
+DROP TABLE IF EXISTS `jobs`;
+DROP TABLE IF EXISTS `usages`;
+DROP TABLE IF EXISTS `share_links`;
+DROP TABLE IF EXISTS `file_grants`;
+DROP TABLE IF EXISTS `group_members`;
+DROP TABLE IF EXISTS `groups`;
+DROP TABLE IF EXISTS `folders`;
+DROP TABLE IF EXISTS `user_tags`;
+DROP TABLE IF EXISTS `tags`;
+DROP TABLE IF EXISTS `files`;
+DROP TABLE IF EXISTS `users`;
@@ -0,0 +1,61 @@
+-- The schema AutoMigrate used to create. IF NOT EXISTS lets databases it already created adopt this as their starting point,
+-- after Up has added what their tables are missing, see baseline.go.
+CREATE TABLE IF NOT EXISTS `users` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`email` text,`password` text,`quota_bytes` integer,`quota_files` integer);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_users_email` ON `users`(`email`);
+CREATE INDEX IF NOT EXISTS `idx_users_deleted_at` ON `users`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `files` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`description` text,`file_path` text,`user_id` integer,`folder_id` integer,`size` integer,`content_type` text,`scan_status` text,`checksum` text,CONSTRAINT `fk_users_files` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`));
+CREATE INDEX IF NOT EXISTS `idx_files_folder_id` ON `files`(`folder_id`);
+CREATE INDEX IF NOT EXISTS `idx_files_user_id` ON `files`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_files_file_path` ON `files`(`file_path`);
+CREATE INDEX IF NOT EXISTS `idx_files_deleted_at` ON `files`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `tags` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text);
+CREATE INDEX IF NOT EXISTS `idx_tags_deleted_at` ON `tags`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `user_tags` (`tag_id` integer,`file_id` integer,PRIMARY KEY (`tag_id`,`file_id`),CONSTRAINT `fk_user_tags_tag` FOREIGN KEY (`tag_id`) REFERENCES `tags`(`id`),CONSTRAINT `fk_user_tags_file` FOREIGN KEY (`file_id`) REFERENCES `files`(`id`));
+
+CREATE TABLE IF NOT EXISTS `folders` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`parent_id` integer,`user_id` integer);
+CREATE INDEX IF NOT EXISTS `idx_folders_user_id` ON `folders`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_folders_parent_id` ON `folders`(`parent_id`);
+CREATE INDEX IF NOT EXISTS `idx_folders_deleted_at` ON `folders`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `groups` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`user_id` integer);
+CREATE INDEX IF NOT EXISTS `idx_groups_user_id` ON `groups`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_groups_deleted_at` ON `groups`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `group_members` (`group_id` integer,`user_id` integer,PRIMARY KEY (`group_id`,`user_id`),CONSTRAINT `fk_group_members_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`),CONSTRAINT `fk_group_members_group` FOREIGN KEY (`group_id`) REFERENCES `groups`(`id`));
+
+CREATE TABLE IF NOT EXISTS `file_grants` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`file_id` integer,`user_id` integer,`group_id` integer,`role` text);
+CREATE INDEX IF NOT EXISTS `idx_file_grants_group_id` ON `file_grants`(`group_id`);
+CREATE INDEX IF NOT EXISTS `idx_file_grants_user_id` ON `file_grants`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_file_grants_file_id` ON `file_grants`(`file_id`);
+
+CREATE TABLE IF NOT EXISTS `share_links` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`file_id` integer,`token_hash` text,`password` text,`expires_at` datetime,`max_downloads` integer,`downloads` integer,`revoked_at` datetime);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_share_links_token_hash` ON `share_links`(`token_hash`);
+CREATE INDEX IF NOT EXISTS `idx_share_links_file_id` ON `share_links`(`file_id`);
+
+CREATE TABLE IF NOT EXISTS `usages` (`user_id` integer,`updated_at` datetime,`bytes` integer,`files` integer,PRIMARY KEY (`user_id`));
+
+CREATE TABLE IF NOT EXISTS `jobs` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`type` text,`payload` text,`status` text,`run_at` datetime,`attempts` integer,`max_attempts` integer,`last_error` text,`idempotency_key` text,`locked_by` text,`locked_at` datetime,`finished_at` datetime);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_jobs_idempotency_key` ON `jobs`(`idempotency_key`);
+CREATE INDEX IF NOT EXISTS `idx_jobs_status_run_at` ON `jobs`(`status`,`run_at`);
+CREATE INDEX IF NOT EXISTS `idx_jobs_type` ON `jobs`(`type`);
+
+CREATE TABLE IF NOT EXISTS `webhooks` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`url` text,`events` text,`secret` text,`user_id` integer);
+CREATE INDEX IF NOT EXISTS `idx_webhooks_user_id` ON `webhooks`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_webhooks_deleted_at` ON `webhooks`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`webhook_id` integer,`event_id` text,`event` text,`payload` text,`status` text,`attempts` integer,`response_status` integer,`response_body` text,`last_error` text,`delivered_at` datetime);
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_event_id` ON `webhook_deliveries`(`event_id`);
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_webhook_id` ON `webhook_deliveries`(`webhook_id`);
+
+CREATE TABLE IF NOT EXISTS `change_events` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`type` text,`file_id` integer,`user_id` integer,`data` text);
+CREATE INDEX IF NOT EXISTS `idx_change_events_user_id` ON `change_events`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_change_events_file_id` ON `change_events`(`file_id`);
+
+CREATE TABLE IF NOT EXISTS `audit_logs` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`actor_id` integer,`actor_email` text,`action` text,`target_type` text,`target_id` integer,`ip` text,`user_agent` text,`before` text,`after` text);
+CREATE INDEX IF NOT EXISTS `idx_audit_logs_target` ON `audit_logs`(`target_type`,`target_id`);
+CREATE INDEX IF NOT EXISTS `idx_audit_logs_action` ON `audit_logs`(`action`);
+CREATE INDEX IF NOT EXISTS `idx_audit_logs_actor_id` ON `audit_logs`(`actor_id`);
+CREATE INDEX IF NOT EXISTS `idx_audit_logs_created_at` ON `audit_logs`(`created_at`);
@@ -0,0 +1,4 @@
+-- Roles used to come from the email address alone, the admin keeps theirs.
+ALTER TABLE `users` ADD COLUMN `role` text;
+ALTER TABLE `users` ADD COLUMN `disabled_at` datetime;
+UPDATE `users` SET `role` = 'admin' WHERE `email` = 'damien.z.hall@gmail.com';
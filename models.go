@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -16,7 +17,14 @@ type File struct {
 	Description string         ``
 	FilePath    string         `gorm:"index"`
 	Tags        []Tag          `gorm:"many2many:user_tags"`
-	UserId      uint8          ``
+	UserId      uint           `gorm:"index"`
+	FolderId    *uint          `gorm:"index"`
+	Size        int64          ``
+	ContentType string         ``
+	ScanStatus  string         ``
+	Checksum    string         `gorm:"size:64"`
+	// IntegrityStatus is set by the storage verifier when the file's content is missing or damaged
+	IntegrityStatus string `gorm:"size:20"`
 }
 
 type Tag struct {
@@ -29,6 +37,58 @@ type Tag struct {
 	Files []File `gorm:"many2many:user_tags"`
 }
 
+// Folder nests files and other folders for a single owner. A nil ParentId
+// means the folder sits at the owner's root.
+type Folder struct {
+	ID        uint           `gorm:"primarykey"`
+	CreatedAt time.Time      ``
+	UpdatedAt time.Time      ``
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	Name      string         ``
+	ParentId  *uint          `gorm:"index"`
+	UserId    uint           `gorm:"index"`
+}
+
+// Group is a named set of users that files can be shared with.
+type Group struct {
+	ID        uint           `gorm:"primarykey"`
+	CreatedAt time.Time      ``
+	UpdatedAt time.Time      ``
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	Name      string         ``
+	UserId    uint           `gorm:"index"`
+
+	Members []User `gorm:"many2many:group_members"`
+}
+
+// FileGrant gives a user, or every member of a group, a role on a file.
+type FileGrant struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time ``
+	UpdatedAt time.Time ``
+	FileId    uint      `gorm:"index"`
+	UserId    *uint     `gorm:"index"`
+	GroupId   *uint     `gorm:"index"`
+	Role      string    ``
+}
+
+// ShareLink lets anyone holding the token download a file without logging in.
+// Only a hash of the token is stored, the token itself is returned once on creation.
+type ShareLink struct {
+	ID           uint       `gorm:"primarykey"`
+	CreatedAt    time.Time  ``
+	UpdatedAt    time.Time  ``
+	FileId       uint       `gorm:"index"`
+	TokenHash    string     `gorm:"uniqueIndex;size:64" json:"-"`
+	Token        string     `gorm:"-" json:",omitempty"`
+	Password     string     `json:"-"`
+	HasPassword  bool       `gorm:"-"`
+	ExpiresAt    *time.Time ``
+	MaxDownloads int        ``
+	Downloads    int        ``
+	RevokedAt    *time.Time ``
+}
+
 type User struct {
 	ID        uint           `gorm:"primarykey"`
 	CreatedAt time.Time      ``
@@ -36,6 +96,79 @@ type User struct {
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 	Email     string         `gorm:"uniqueIndex" json:"email"`
 	Password  string         ``
+	// Role is set with "user promote", empty falls back to the role for the email address
+	Role       string     `gorm:"size:20" json:"-"`
+	DisabledAt *time.Time `json:"-"`
+
+	// QuotaBytes and QuotaFiles override the quota for the user's role when set, -1 is unlimited
+	QuotaBytes *int64 ``
+	QuotaFiles *int64 ``
 
 	Files []File
 }
+
+// Usage is how much storage a user's files take up, soft deleted files count until they're purged.
+type Usage struct {
+	UserId    uint      `gorm:"primarykey;autoIncrement:false"`
+	UpdatedAt time.Time ``
+	Bytes     int64     ``
+	Files     int64     ``
+}
+
+// Webhook posts signed events to URL. Events is a comma separated list of event types, "*" for all of them.
+// The secret is only returned once, when the webhook is created.
+type Webhook struct {
+	ID            uint           `gorm:"primarykey"`
+	CreatedAt     time.Time      ``
+	UpdatedAt     time.Time      ``
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
+	URL           string         ``
+	Events        string         ``
+	Secret        string         `json:"-"`
+	SigningSecret string         `gorm:"-" json:",omitempty"`
+	UserId        uint           `gorm:"index"`
+}
+
+// WebhookDelivery is one event sent, or being sent, to a webhook.
+// Redelivering creates a new delivery with the same EventId.
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primarykey"`
+	CreatedAt      time.Time  ``
+	UpdatedAt      time.Time  ``
+	WebhookId      uint       `gorm:"index"`
+	EventId        string     `gorm:"size:36;index"`
+	Event          string     `gorm:"size:100"`
+	Payload        string     `gorm:"type:text"`
+	Status         string     `gorm:"size:20"`
+	Attempts       int        ``
+	ResponseStatus int        ``
+	ResponseBody   string     `gorm:"type:text"`
+	LastError      string     `gorm:"type:text"`
+	DeliveredAt    *time.Time ``
+}
+
+// ChangeEvent is an entry in the log of file changes that /events streams to clients.
+// UserId is the owner of the file at the time, for working out who can see the event.
+type ChangeEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time ``
+	Type      string    `gorm:"size:100"`
+	FileId    uint      `gorm:"index"`
+	UserId    uint      `gorm:"index"`
+	Data      string    `gorm:"type:text"`
+}
+
+// AuditLog records who did what to which target. Rows are only ever inserted, see audit.go.
+type AuditLog struct {
+	ID         uint            `gorm:"primarykey"`
+	CreatedAt  time.Time       `gorm:"index"`
+	ActorId    *uint           `gorm:"index"`
+	ActorEmail string          ``
+	Action     string          `gorm:"size:100;index"`
+	TargetType string          `gorm:"size:50;index:idx_audit_logs_target"`
+	TargetId   uint            `gorm:"index:idx_audit_logs_target"`
+	IP         string          `gorm:"size:45"`
+	UserAgent  string          ``
+	Before     json.RawMessage `gorm:"type:text"`
+	After      json.RawMessage `gorm:"type:text"`
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/backend-project/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+
+	defaultPresignExpiry = time.Hour
+	maxPresignExpiry     = 7 * 24 * time.Hour
+)
+
+type presignRequest struct {
+	ExpiresIn   int    `json:"expires_in"`
+	Disposition string `json:"disposition"`
+}
+
+// publicURL is where clients reach the API, PUBLIC_URL or else the host the request came in on.
+func (app *App) publicURL(c *gin.Context) string {
+	if publicURL := app.config.PublicURL; publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, c.Request.Host)
+}
+
+// presignFile returns a time limited URL for the file content that works without the token cookie,
+// for links in emails and other tools. expires_in is in seconds.
+func (app *App) presignFile(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleViewer)
+	if !ok {
+		return
+	}
+
+	var request presignRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if request.Disposition != "" && request.Disposition != dispositionInline && request.Disposition != dispositionAttachment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "disposition must be inline or attachment"})
+		return
+	}
+
+	expiresIn := defaultPresignExpiry
+	if request.ExpiresIn != 0 {
+		expiresIn = time.Duration(request.ExpiresIn) * time.Second
+	}
+	if expiresIn <= 0 || expiresIn > maxPresignExpiry {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 1 and %d seconds", int(maxPresignExpiry.Seconds()))})
+		return
+	}
+
+	expiresAt := time.Now().Add(expiresIn)
+	query, err := auth.SignFileURL(app.config.Auth.URLSigningKeys, file.ID, expiresAt, request.Disposition)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	url := fmt.Sprintf("%s/files/%d/content?%s", app.publicURL(c), file.ID, query.Encode())
+	app.audit(c, "file.presign", file.ID, nil, gin.H{"expires_at": expiresAt.UTC().Truncate(time.Second), "disposition": request.Disposition})
+	c.JSON(http.StatusOK, gin.H{"url": url, "expires_at": expiresAt.UTC().Truncate(time.Second)})
+}
+
+// getSignedFileContent serves a URL made by presignFile, the signature stands in for the login.
+func (app *App) getSignedFileContent(c *gin.Context) {
+	file, err := gorm.G[File](app.db).Where("id = ?", c.Param("id")).First(c)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.VerifyFileURL(app.config.Auth.URLSigningKeys, file.ID, c.Request.URL.Query()); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.sendFileContent(c, file, c.Query("disposition"))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/backend-project/jobs"
+	"github.com/backend-project/scan"
+	"github.com/backend-project/thumbnail"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Job types for the work done on files after they're uploaded.
+const (
+	jobHashFile       = "file.hash"
+	jobFileThumbnails = "file.thumbnails"
+	jobScanFile       = "file.scan"
+)
+
+type fileJobPayload struct {
+	FileId uint `json:"file_id"`
+}
+
+// newJobQueue creates the queue with a handler for every job type the app enqueues.
+func (app *App) newJobQueue() *jobs.Queue {
+	queue := jobs.NewQueue(app.db)
+	queue.Handle(jobHashFile, app.fileJob(app.hashFile))
+	queue.Handle(jobFileThumbnails, app.fileJob(app.generateThumbnails))
+	queue.Handle(jobScanFile, app.fileJob(app.rescanFile))
+	queue.Handle(jobDeliverWebhook, app.deliverWebhook)
+	queue.Handle(jobVerifyStorage, app.runStorageVerify)
+	return queue
+}
+
+// fileJob adapts a function of a file into a job handler. Files that were purged before the
+// job ran are skipped rather than retried.
+func (app *App) fileJob(process func(ctx context.Context, file File) error) jobs.Handler {
+	return func(ctx context.Context, job jobs.Job) error {
+		var payload fileJobPayload
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+
+		var file File
+		err := app.db.WithContext(ctx).Unscoped().First(&file, payload.FileId).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return process(ctx, file)
+	}
+}
+
+// enqueueFileProcessing queues the slow work for a new upload as part of tx,
+// so the jobs exist exactly when the file does.
+func (app *App) enqueueFileProcessing(tx *gorm.DB, file File) error {
+	if file.ScanStatus == scan.StatusInfected {
+		return nil
+	}
+
+	jobTypes := []string{jobHashFile}
+	if file.ScanStatus == scan.StatusError {
+		jobTypes = append(jobTypes, jobScanFile)
+	}
+	if thumbnail.Supported(file.ContentType) {
+		jobTypes = append(jobTypes, jobFileThumbnails)
+	}
+
+	for _, jobType := range jobTypes {
+		_, err := app.jobs.EnqueueTx(tx, jobs.Spec{
+			Type:           jobType,
+			Payload:        fileJobPayload{FileId: file.ID},
+			IdempotencyKey: fmt.Sprintf("%s:%d", jobType, file.ID),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hashFile records the sha256 of a file's content.
+func (app *App) hashFile(ctx context.Context, file File) error {
+	content, err := app.store().Open(ctx, storageKey(file))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	return app.db.WithContext(ctx).Model(&File{}).Where("id = ?", file.ID).Update("checksum", checksum).Error
+}
+
+func (app *App) getJobs(c *gin.Context) {
+	query := app.db.WithContext(c).Order("id desc")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if jobType := c.Query("type"); jobType != "" {
+		query = query.Where("type = ?", jobType)
+	}
+
+	var jobList []jobs.Job
+	if err := query.Scopes(Paginate(c.Request)).Find(&jobList).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobList)
+}
+
+func (app *App) getJob(c *gin.Context) {
+	job, err := gorm.G[jobs.Job](app.db).Where("id = ?", c.Param("id")).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+func (app *App) retryJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	job, err := app.jobs.Retry(c, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	if errors.Is(err, jobs.ErrNotRetryable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "job.retry", job.ID, nil, gin.H{"type": job.Type})
+
+	c.JSON(http.StatusOK, job)
+}
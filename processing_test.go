@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/backend-project/jobs"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestFileProcessingJobs(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+
+	w := uploadTestFile(t, router, nil, "testfile.txt", []byte("This is a test file content."), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Empty(t, file.Checksum)
+
+	runJobs(t, app)
+
+	file, err := gorm.G[File](app.db).Where("id = ?", file.ID).First(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "dddb3cd3dbaf57421a0b001e3f8224c71d742133e1482ba3211f70e8f794796a", file.Checksum)
+
+	var jobList []jobs.Job
+	w = performJSON(router, "GET", "/admin/jobs?status=succeeded", nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &jobList))
+	assert.Len(t, jobList, 1)
+	assert.Equal(t, jobHashFile, jobList[0].Type)
+
+	// jobs that keep failing end up dead and can be retried by an admin
+	dead, err := app.jobs.Enqueue(context.TODO(), jobs.Spec{Type: "unknown"})
+	assert.NoError(t, err)
+	runJobs(t, app)
+
+	w = performJSON(router, "POST", fmt.Sprintf("/admin/jobs/%d/retry", dead.ID), nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "POST", fmt.Sprintf("/admin/jobs/%d/retry", dead.ID), nil, adminCookie)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = performJSON(router, "GET", "/admin/jobs", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
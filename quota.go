@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// multipartOverhead is how far past the remaining quota an upload request can go,
+// to leave room for the multipart boundaries and the other form fields.
+const multipartOverhead = 1 << 20 // 1 MiB
+
+// quotaUnlimited is how a per user override lifts a limit, 0 isn't accepted there so an admin
+// can't lift one by accident thinking it blocks uploads.
+const quotaUnlimited = -1
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// Quota limits the total size and number of a user's files, 0 means unlimited.
+type Quota struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+type quotaRequest struct {
+	Bytes *int64 `json:"bytes"`
+	Files *int64 `json:"files"`
+}
+
+// allows reports whether usage can grow by bytes and files without going over the quota.
+func (quota Quota) allows(usage Usage, bytes int64, files int64) bool {
+	if quota.Bytes > 0 && usage.Bytes+bytes > quota.Bytes {
+		return false
+	}
+	if quota.Files > 0 && usage.Files+files > quota.Files {
+		return false
+	}
+	return true
+}
+
+// userQuota is the quota for the user's role, with any per user override from an admin applied.
+func (app *App) userQuota(user User) Quota {
+	quota := app.config.Quotas[strings.ToLower(userRole(user))]
+	if user.QuotaBytes != nil {
+		quota.Bytes = max(*user.QuotaBytes, 0)
+	}
+	if user.QuotaFiles != nil {
+		quota.Files = max(*user.QuotaFiles, 0)
+	}
+	return quota
+}
+
+// validQuotaOverride accepts a positive limit, quotaUnlimited or null for the role quota.
+func validQuotaOverride(limit *int64) bool {
+	return limit == nil || *limit > 0 || *limit == quotaUnlimited
+}
+
+// adjustUsage adds bytes and files to a user's usage as part of tx. Growing past the quota
+// fails with errQuotaExceeded instead, the check and update are one statement so concurrent
+// uploads can't both squeeze in. Pass negative amounts to free up space.
+func adjustUsage(tx *gorm.DB, userId uint, bytes int64, files int64, quota Quota) error {
+	if userId == 0 {
+		return nil
+	}
+
+	err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Usage{UserId: userId}).Error
+	if err != nil {
+		return err
+	}
+
+	query := tx.Model(&Usage{}).Where("user_id = ?", userId)
+	if bytes > 0 && quota.Bytes > 0 {
+		query = query.Where("bytes + ? <= ?", bytes, quota.Bytes)
+	}
+	if files > 0 && quota.Files > 0 {
+		query = query.Where("files + ? <= ?", files, quota.Files)
+	}
+
+	result := query.Updates(map[string]any{
+		"bytes": gorm.Expr("bytes + ?", bytes),
+		"files": gorm.Expr("files + ?", files),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errQuotaExceeded
+	}
+
+	return nil
+}
+
+func quotaExceeded(c *gin.Context, quota Quota, usage Usage) {
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error": errQuotaExceeded.Error(),
+		"quota": quota,
+		"usage": gin.H{"bytes": usage.Bytes, "files": usage.Files},
+	})
+}
+
+func (app *App) getMyUsage(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	usage, err := app.files.Usage(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bytes": usage.Bytes,
+		"files": usage.Files,
+		"quota": app.userQuota(user),
+	})
+}
+
+// setUserQuota lets an admin override a user's quota, -1 lifts the limit and null goes back to
+// the quota for their role.
+func (app *App) setUserQuota(c *gin.Context) {
+	user, err := gorm.G[User](app.db).Where("id = ?", c.Param("id")).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	var request quotaRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validQuotaOverride(request.Bytes) || !validQuotaOverride(request.Files) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quotas must be positive, -1 for unlimited or null for the role quota"})
+		return
+	}
+
+	before := gin.H{"quota_bytes": user.QuotaBytes, "quota_files": user.QuotaFiles}
+	err = app.db.WithContext(c).Model(&user).Updates(map[string]any{
+		"quota_bytes": request.Bytes,
+		"quota_files": request.Files,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user.QuotaBytes = request.Bytes
+	user.QuotaFiles = request.Files
+	app.audit(c, "user.set_quota", user.ID, before, gin.H{"quota_bytes": user.QuotaBytes, "quota_files": user.QuotaFiles})
+
+	usage, err := app.files.Usage(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": user.ID,
+		"bytes":   usage.Bytes,
+		"files":   usage.Files,
+		"quota":   app.userQuota(user),
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotas(t *testing.T) {
+	defer cleanUp()
+	t.Setenv("QUOTA_BYTES_DEFAULT", "40")
+	t.Setenv("QUOTA_FILES_DEFAULT", "5")
+
+	_, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+	adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+	content := []byte("This is a test file content.")
+
+	w := uploadTestFile(t, router, cookie, "testfile.txt", content, map[string]string{"name": "first"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, int64(len(content)), file.Size)
+
+	// the second copy doesn't fit
+	w = uploadTestFile(t, router, cookie, "testfile.txt", content, map[string]string{"name": "second"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// a big upload is cut off part way through
+	w = uploadTestFile(t, router, cookie, "big.bin", bytes.Repeat([]byte("x"), 4*multipartOverhead), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	var usage struct {
+		Bytes int64 `json:"bytes"`
+		Files int64 `json:"files"`
+		Quota Quota `json:"quota"`
+	}
+	w = performJSON(router, "GET", "/me/usage", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, int64(len(content)), usage.Bytes)
+	assert.Equal(t, int64(1), usage.Files)
+	assert.Equal(t, Quota{Bytes: 40, Files: 5}, usage.Quota)
+
+	// soft deleted files still count, purging frees the space
+	w = performJSON(router, "DELETE", fmt.Sprintf("/files/%d", file.ID), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", "/me/usage", nil, cookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, int64(1), usage.Files)
+
+	w = performJSON(router, "DELETE", fmt.Sprintf("/files/%d/purge", file.ID), nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", "/me/usage", nil, cookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, int64(0), usage.Bytes)
+	assert.Equal(t, int64(0), usage.Files)
+
+	// admins can override the quota for one user
+	unlimited := int64(quotaUnlimited)
+	w = performJSON(router, "PUT", "/admin/users/1/quota", quotaRequest{Bytes: &unlimited}, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	// 0 is unlimited for roles, but too easy to mistake for "no uploads" here
+	for _, invalid := range []int64{0, -2} {
+		w = performJSON(router, "PUT", "/admin/users/1/quota", quotaRequest{Bytes: &invalid}, adminCookie)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+	w = performJSON(router, "PUT", "/admin/users/1/quota", quotaRequest{Bytes: &unlimited}, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for range 2 {
+		w = uploadTestFile(t, router, cookie, "testfile.txt", content, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = performJSON(router, "GET", "/me/usage", nil, cookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, Quota{Bytes: 0, Files: 5}, usage.Quota)
+	assert.Equal(t, int64(2*len(content)), usage.Bytes)
+}
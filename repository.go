@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// errNotFound is what repositories return for rows that don't exist, whatever keeps them.
+var errNotFound = errors.New("not found")
+
+// FileRepository keeps files, who they're shared with and the usage they count towards. Changes
+// that have to happen together, like a new file and its owner's usage, are made together.
+type FileRepository interface {
+	// Get returns a file that hasn't been deleted.
+	Get(ctx context.Context, id uint) (File, error)
+	// GetDeleted returns a file whether or not it's been soft deleted.
+	GetDeleted(ctx context.Context, id uint) (File, error)
+	// List returns a page of the files the user can see, only public ones when nobody's logged in.
+	List(ctx context.Context, user User, loggedIn bool, page int, pageSize int) ([]File, error)
+	// PathExists reports whether any file, deleted or not, is stored under path.
+	PathExists(ctx context.Context, path string) (bool, error)
+	// Grants are the grants on a file for the user, directly or through their groups.
+	Grants(ctx context.Context, fileId uint, userId uint) ([]FileGrant, error)
+	Usage(ctx context.Context, userId uint) (Usage, error)
+	// Create saves a new file with its tags and charges it to the owner's usage, failing with
+	// errQuotaExceeded when that would go over quota.
+	Create(ctx context.Context, file *File, quota Quota) error
+	// Update changes the name and description, empty ones are left as they are.
+	Update(ctx context.Context, id uint, name string, description string) error
+	Delete(ctx context.Context, id uint) error
+	// Purge removes a file's row, tags, grants and share links, and gives back its usage.
+	Purge(ctx context.Context, file File) error
+}
+
+// UserRepository keeps user accounts.
+type UserRepository interface {
+	ByEmail(ctx context.Context, email string) (User, error)
+	Create(ctx context.Context, user *User) error
+}
+
+// TagRepository keeps the tags files are labelled with, one per name.
+type TagRepository interface {
+	// FindOrCreate returns the tags with these names, creating the ones that don't exist yet.
+	FindOrCreate(ctx context.Context, names []string) ([]Tag, error)
+}
+
+// notFound turns gorm's error for a missing row into errNotFound.
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errNotFound
+	}
+	return err
+}
+
+type gormFileRepository struct {
+	db *gorm.DB
+	// changed runs in the transaction of every change, for the jobs and events that go with it
+	changed func(tx *gorm.DB, eventType string, file File) error
+	// committed runs after every change has committed, to wake the workers for its jobs
+	committed func()
+}
+
+func (repo gormFileRepository) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	if err := repo.db.WithContext(ctx).Transaction(fn); err != nil {
+		return err
+	}
+	if repo.committed != nil {
+		repo.committed()
+	}
+	return nil
+}
+
+func (repo gormFileRepository) Get(ctx context.Context, id uint) (File, error) {
+	file, err := gorm.G[File](repo.db).Where("id = ?", id).First(ctx)
+	return file, notFound(err)
+}
+
+func (repo gormFileRepository) GetDeleted(ctx context.Context, id uint) (File, error) {
+	var file File
+	err := repo.db.WithContext(ctx).Unscoped().Where("id = ?", id).First(&file).Error
+	return file, notFound(err)
+}
+
+// List reads from a replica when there is one, listings don't need the latest writes.
+func (repo gormFileRepository) List(ctx context.Context, user User, loggedIn bool, page int, pageSize int) ([]File, error) {
+	var files []File
+	err := repo.db.WithContext(ctx).Scopes(readReplica, visibleTo(repo.db, user, loggedIn)).
+		Offset((page - 1) * pageSize).Limit(pageSize).Find(&files).Error
+	return files, err
+}
+
+// PathExists compares the whole path, LIKE would treat _ as a wildcard and ignore case on some databases.
+func (repo gormFileRepository) PathExists(ctx context.Context, path string) (bool, error) {
+	var count int64
+	err := repo.db.WithContext(ctx).Unscoped().Model(&File{}).Where("file_path = ?", path).Count(&count).Error
+	return count > 0, err
+}
+
+func (repo gormFileRepository) Grants(ctx context.Context, fileId uint, userId uint) ([]FileGrant, error) {
+	var grants []FileGrant
+	err := repo.db.WithContext(ctx).
+		Where("file_id = ?", fileId).
+		Where("user_id = ? OR group_id IN (?)", userId, memberGroupIds(repo.db, userId)).
+		Find(&grants).Error
+	return grants, err
+}
+
+func (repo gormFileRepository) Usage(ctx context.Context, userId uint) (Usage, error) {
+	usage := Usage{UserId: userId}
+	err := repo.db.WithContext(ctx).Where("user_id = ?", userId).Limit(1).Find(&usage).Error
+	return usage, err
+}
+
+// Create also queues the file's processing and publishes it, in the same transaction.
+func (repo gormFileRepository) Create(ctx context.Context, file *File, quota Quota) error {
+	return repo.transaction(ctx, func(tx *gorm.DB) error {
+		// the tags exist already, only the links to them are new
+		if err := tx.Omit("Tags.*").Create(file).Error; err != nil {
+			return err
+		}
+
+		// checked again here, in case other uploads used up the quota while this one was in flight
+		if err := adjustUsage(tx, file.UserId, file.Size, 1, quota); err != nil {
+			return err
+		}
+
+		return repo.changed(tx, eventFileCreated, *file)
+	})
+}
+
+func (repo gormFileRepository) Update(ctx context.Context, id uint, name string, description string) error {
+	return repo.transaction(ctx, func(tx *gorm.DB) error {
+		if _, err := gorm.G[File](tx).Where("id = ?", id).Updates(ctx, File{Name: name, Description: description}); err != nil {
+			return err
+		}
+		return repo.changed(tx, eventFileUpdated, File{ID: id})
+	})
+}
+
+func (repo gormFileRepository) Delete(ctx context.Context, id uint) error {
+	return repo.transaction(ctx, func(tx *gorm.DB) error {
+		if _, err := gorm.G[File](tx).Where("id = ?", id).Delete(ctx); err != nil {
+			return err
+		}
+		return repo.changed(tx, eventFileDeleted, File{ID: id})
+	})
+}
+
+func (repo gormFileRepository) Purge(ctx context.Context, file File) error {
+	return repo.transaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Table("user_tags").Where("file_id = ?", file.ID).Delete(nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", file.ID).Delete(&FileGrant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", file.ID).Delete(&ShareLink{}).Error; err != nil {
+			return err
+		}
+		// published while the row is still there to say what was purged
+		if err := repo.changed(tx, eventFilePurged, file); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&file).Error; err != nil {
+			return err
+		}
+		return adjustUsage(tx, file.UserId, -file.Size, -1, Quota{})
+	})
+}
+
+type gormUserRepository struct {
+	db *gorm.DB
+}
+
+func (repo gormUserRepository) ByEmail(ctx context.Context, email string) (User, error) {
+	user, err := gorm.G[User](repo.db).Where("email = ?", email).First(ctx)
+	return user, notFound(err)
+}
+
+func (repo gormUserRepository) Create(ctx context.Context, user *User) error {
+	return gorm.G[User](repo.db).Create(ctx, user)
+}
+
+type gormTagRepository struct {
+	db *gorm.DB
+}
+
+func (repo gormTagRepository) FindOrCreate(ctx context.Context, names []string) ([]Tag, error) {
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		var tag Tag
+		if err := repo.db.WithContext(ctx).Where(Tag{Name: name}).FirstOrCreate(&tag).Error; err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
@@ -0,0 +1,101 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultChunkSize = 64 * 1024
+
+// ClamAV scans content with a clamd daemon using its INSTREAM command.
+type ClamAV struct {
+	// Network and Address are passed to net.Dial, e.g. "tcp" and "127.0.0.1:3310" or "unix" and "/run/clamav/clamd.ctl".
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamAV parses an address like tcp://127.0.0.1:3310 or unix:///run/clamav/clamd.ctl.
+func NewClamAV(address string, timeout time.Duration) (*ClamAV, error) {
+	network, target, found := strings.Cut(address, "://")
+	if !found || (network != "tcp" && network != "unix") || target == "" {
+		return nil, fmt.Errorf("invalid clamd address %q, expected tcp://host:port or unix:///path", address)
+	}
+
+	return &ClamAV{Network: network, Address: target, Timeout: timeout}, nil
+}
+
+func (clam *ClamAV) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	dialer := net.Dialer{Timeout: clam.Timeout}
+	conn, err := dialer.DialContext(ctx, clam.Network, clam.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else if clam.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(clam.Timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("sending INSTREAM: %w", err)
+	}
+
+	// the stream is sent as chunks prefixed with their length, a zero length chunk ends it
+	chunk := make([]byte, defaultChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return Result{}, fmt.Errorf("sending chunk: %w", err)
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return Result{}, fmt.Errorf("sending chunk: %w", err)
+			}
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return Result{}, readErr
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return Result{}, fmt.Errorf("ending stream: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Result{}, fmt.Errorf("reading reply: %w", err)
+	}
+
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseReply understands "stream: OK", "stream: <signature> FOUND" and "<message> ERROR".
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
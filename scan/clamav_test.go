@@ -0,0 +1,100 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClamd speaks enough of the clamd protocol to flag anything containing "EICAR".
+func fakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+
+				command, err := reader.ReadString('\x00')
+				if err != nil || command != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND ERROR\x00"))
+					return
+				}
+
+				var content bytes.Buffer
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(reader, size); err != nil {
+						return
+					}
+					length := binary.BigEndian.Uint32(size)
+					if length == 0 {
+						break
+					}
+					if _, err := io.CopyN(&content, reader, int64(length)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(content.String(), "EICAR") {
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClamAV(t *testing.T) {
+	clam, err := NewClamAV("tcp://"+fakeClamd(t), time.Second)
+	assert.NoError(t, err)
+
+	result, err := clam.Scan(context.Background(), strings.NewReader("hello world"))
+	assert.NoError(t, err)
+	assert.False(t, result.Infected)
+
+	// bigger than one chunk, with the signature straddling the chunk boundary
+	infected := strings.Repeat("x", defaultChunkSize-2) + "EICAR"
+	result, err = clam.Scan(context.Background(), strings.NewReader(infected))
+	assert.NoError(t, err)
+	assert.True(t, result.Infected)
+	assert.Equal(t, "Eicar-Test-Signature", result.Signature)
+}
+
+func TestNewClamAV(t *testing.T) {
+	clam, err := NewClamAV("unix:///run/clamav/clamd.ctl", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "unix", clam.Network)
+	assert.Equal(t, "/run/clamav/clamd.ctl", clam.Address)
+
+	_, err = NewClamAV("127.0.0.1:3310", 0)
+	assert.Error(t, err)
+
+	// the error names the address as it was configured
+	_, err = NewClamAV("udp://127.0.0.1:3310", 0)
+	assert.ErrorContains(t, err, `"udp://127.0.0.1:3310"`)
+}
+
+func TestParseReply(t *testing.T) {
+	_, err := parseReply("INSTREAM size limit exceeded. ERROR")
+	assert.Error(t, err)
+}
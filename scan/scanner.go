@@ -0,0 +1,26 @@
+package scan
+
+import (
+	"context"
+	"io"
+)
+
+// Scan statuses recorded on uploaded files.
+const (
+	StatusSkipped  = "skipped"
+	StatusPending  = "pending"
+	StatusClean    = "clean"
+	StatusInfected = "infected"
+	StatusError    = "error"
+)
+
+type Result struct {
+	Infected bool
+	// Signature names what was found, it's empty when the content is clean.
+	Signature string
+}
+
+// Scanner checks content for malware.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
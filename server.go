@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerConfig is how the HTTP server listens, the server section of Config.
+type ServerConfig struct {
+	Address string `yaml:"address" env:"HTTP_ADDRESS"`
+	// ReadHeaderTimeout bounds slow clients before a handler runs. ReadTimeout and WriteTimeout
+	// cover the whole body, so they're off by default to leave room for large uploads and downloads.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	// ShutdownTimeout is how long in-flight requests and running jobs get to finish after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	TLSCertFile     string        `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile      string        `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+}
+
+func (config ServerConfig) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              config.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// certReloader serves the certificate from CertFile and KeyFile, picking up renewed files
+// without a restart. It checks the files at most every checkInterval, or right away on SIGHUP.
+type certReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu            sync.Mutex
+	certificate   *tls.Certificate
+	modTime       time.Time
+	checkedAt     time.Time
+	checkInterval time.Duration
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{CertFile: certFile, KeyFile: keyFile, checkInterval: 10 * time.Second}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload loads the certificate and key again. The old certificate stays in use if they can't be loaded.
+func (reloader *certReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(reloader.CertFile, reloader.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.certificate = &certificate
+	reloader.modTime = reloader.filesModTime()
+	reloader.checkedAt = time.Now()
+	return nil
+}
+
+// filesModTime is the newer of the two files' modification times.
+func (reloader *certReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{reloader.CertFile, reloader.KeyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is for tls.Config, it reloads the files first if they've changed.
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.Lock()
+	stale := false
+	if time.Since(reloader.checkedAt) >= reloader.checkInterval {
+		reloader.checkedAt = time.Now()
+		stale = !reloader.filesModTime().Equal(reloader.modTime)
+	}
+	reloader.mu.Unlock()
+
+	if stale {
+		if err := reloader.Reload(); err != nil {
+			slog.Error("Reloading TLS certificate failed, keeping the old one", "error", err)
+		} else {
+			slog.Info("Reloaded TLS certificate", "cert_file", reloader.CertFile)
+		}
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	return reloader.certificate, nil
+}
+
+// reloadOnHangup reloads the certificate whenever the process gets SIGHUP, until ctx is done.
+func (reloader *certReloader) reloadOnHangup(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			if err := reloader.Reload(); err != nil {
+				slog.Error("Reloading TLS certificate failed, keeping the old one", "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "cert_file", reloader.CertFile)
+			}
+		}
+	}
+}
+
+// serve runs server on listener until ctx is done, then stops accepting connections and
+// waits up to shutdownTimeout for the requests in flight to finish. drain, when it's given, runs
+// alongside with a context that ends at the same deadline.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration, drain func(ctx context.Context)) error {
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			served <- server.ServeTLS(listener, "", "")
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// drain shares the deadline, so shutting down takes shutdownTimeout at most
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if drain != nil {
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			drain(shutdownCtx)
+		}()
+		defer func() { <-drained }()
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// out of time, cut off whatever is left
+		_ = server.Close()
+		return err
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// run migrates the database when MigrateOnStart is set and serves the app until SIGINT or SIGTERM,
+// then drains requests, stops the job workers and closes the database.
+func (app *App) run() error {
+	config := app.config.Server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if app.config.MigrateOnStart {
+		if err := migrateDatabase(ctx, app.db); err != nil {
+			return err
+		}
+	}
+
+	server := config.newServer(app.setupRouter())
+	// streams never finish on their own, so they're told to stop as soon as shutdown starts
+	server.RegisterOnShutdown(func() { close(app.draining) })
+
+	scheme := "http"
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		go reloader.reloadOnHangup(ctx)
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+		scheme = "https"
+	}
+
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	app.jobs.Start(jobsCtx, app.config.JobWorkers)
+	if err := app.scheduleStorageVerify(ctx, time.Now()); err != nil {
+		slog.Error("Scheduling storage verification failed", "error", err)
+	}
+
+	var metricsServer *http.Server
+	if address := app.config.Metrics.Address; address != "" {
+		metricsServer = config.newServer(app.metrics.handler())
+		metricsServer.Addr = address
+		go func() {
+			slog.Info("Serving metrics", "address", address)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Serving metrics failed", "error", err)
+			}
+		}()
+	}
+
+	// workers finish the job they're on before stopping, jobs still running at the deadline are
+	// cancelled and retried later
+	drained := false
+	drainJobs := func(ctx context.Context) {
+		drained = true
+		stopJobs()
+		if err := app.jobs.Wait(ctx); err != nil {
+			slog.Error("Jobs didn't finish in time", "error", err)
+		}
+	}
+
+	slog.Info("Listening", "address", listener.Addr().String(), "scheme", scheme)
+	serveErr := serve(ctx, server, listener, config.ShutdownTimeout, func(ctx context.Context) {
+		slog.Info("Shutting down")
+		drainJobs(ctx)
+	})
+	// serving failed before there was a signal to shut down
+	if !drained {
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		drainJobs(drainCtx)
+		cancelDrain()
+	}
+
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+
+	if sqlDB, err := app.db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			slog.Error("Closing the database failed", "error", err)
+		}
+	}
+
+	return serveErr
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self signed certificate for commonName and its key.
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func certificateName(t *testing.T, certificate *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("finished"))
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, server, listener, time.Second, nil)
+	}()
+
+	responses := make(chan string, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	cancel()
+	// the request that was in flight still gets its response
+	assert.Equal(t, "finished", <-responses)
+	assert.NoError(t, <-served)
+
+	_, err = http.Get("http://" + listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, server, listener, 50*time.Millisecond, nil)
+	}()
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err == nil {
+			response.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+	assert.ErrorIs(t, <-served, context.DeadlineExceeded)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("secure")) }),
+		TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = serve(ctx, server, listener, time.Second, nil)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	served := func() string {
+		response, err := client.Get("https://" + listener.Addr().String())
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(t, "secure", string(body))
+		return response.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	// renewed files are picked up on the next handshake once they're due to be checked
+	writeTestCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "first", served())
+	reloader.checkInterval = 0
+	assert.Equal(t, "second", served())
+
+	// broken files leave the current certificate in place
+	assert.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0600))
+	assert.Error(t, reloader.Reload())
+	certificate, err := reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", certificateName(t, certificate))
+
+	_, err = newCertReloader(certFile, keyFile)
+	assert.Error(t, err)
+}
+
+func TestEventStreamStopsWhenDraining(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+	close(app.draining)
+
+	// no timeout, the stream has to end by itself
+	req, _ := http.NewRequest("GET", "/events", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServeDrainSharesDeadline(t *testing.T) {
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var drainDeadline time.Time
+	started := time.Now()
+	assert.NoError(t, serve(ctx, server, listener, time.Minute, func(ctx context.Context) {
+		drainDeadline, _ = ctx.Deadline()
+	}))
+	assert.WithinDuration(t, started.Add(time.Minute), drainDeadline, time.Second)
+}
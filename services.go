@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errForbidden          = errors.New("forbidden")
+	errEmailTaken         = errors.New("email is already registered")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountDisabled    = errors.New("account disabled")
+)
+
+// FileService holds the rules for files that don't depend on HTTP or on where files are kept: who
+// can do what to a file, quotas and unique storage names. Handlers turn its errors into responses.
+type FileService struct {
+	files FileRepository
+	tags  TagRepository
+	// quotaFor is the quota a user's files count against, looked up each time so config reloads apply
+	quotaFor func(user User) Quota
+}
+
+func newFileService(files FileRepository, tags TagRepository, quotaFor func(user User) Quota) *FileService {
+	return &FileService{files: files, tags: tags, quotaFor: quotaFor}
+}
+
+// Role works out the best role the user has on file, "" means no access.
+// Files uploaded without logging in have no owner and stay public, but only admins can change them.
+func (service *FileService) Role(ctx context.Context, file File, user User, loggedIn bool) (string, error) {
+	if file.UserId == 0 {
+		if loggedIn && userRole(user) == "admin" {
+			return roleOwner, nil
+		}
+		return roleViewer, nil
+	}
+	if !loggedIn {
+		return "", nil
+	}
+	if file.UserId == user.ID {
+		return roleOwner, nil
+	}
+
+	grants, err := service.files.Grants(ctx, file.ID, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	role := ""
+	for _, grant := range grants {
+		if roleRanks[grant.Role] > roleRanks[role] {
+			role = grant.Role
+		}
+	}
+	return role, nil
+}
+
+// Authorize returns the file if the user has at least minRole on it. Files the user has no access
+// to at all are errNotFound, so they don't give away that the file exists, and ones where their
+// role isn't enough are errForbidden.
+func (service *FileService) Authorize(ctx context.Context, id uint, user User, loggedIn bool, minRole string) (File, error) {
+	file, err := service.files.Get(ctx, id)
+	if err != nil {
+		return File{}, err
+	}
+	return file, service.authorize(ctx, file, user, loggedIn, minRole)
+}
+
+// GetDeleted is Authorize for files whether or not they've been soft deleted, for purging and restoring them.
+func (service *FileService) GetDeleted(ctx context.Context, id uint, user User, loggedIn bool, minRole string) (File, error) {
+	file, err := service.files.GetDeleted(ctx, id)
+	if err != nil {
+		return File{}, err
+	}
+	return file, service.authorize(ctx, file, user, loggedIn, minRole)
+}
+
+func (service *FileService) authorize(ctx context.Context, file File, user User, loggedIn bool, minRole string) error {
+	role, err := service.Role(ctx, file, user, loggedIn)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return errNotFound
+	}
+	if roleRanks[role] < roleRanks[minRole] {
+		return errForbidden
+	}
+	return nil
+}
+
+// Get returns a file without checking who's asking, like to read back one that was just saved.
+func (service *FileService) Get(ctx context.Context, id uint) (File, error) {
+	return service.files.Get(ctx, id)
+}
+
+func (service *FileService) List(ctx context.Context, user User, loggedIn bool, page int, pageSize int) ([]File, error) {
+	return service.files.List(ctx, user, loggedIn, page, pageSize)
+}
+
+func (service *FileService) Usage(ctx context.Context, userId uint) (Usage, error) {
+	return service.files.Usage(ctx, userId)
+}
+
+// UploadBudget is how much more a user can store before an upload, anonymous uploads have no quota.
+type UploadBudget struct {
+	Quota Quota
+	Usage Usage
+	// MaxRequestBytes is how big the upload request can be before the file can't fit, 0 is no limit.
+	// It leaves room for the multipart boundaries and the other form fields.
+	MaxRequestBytes int64
+}
+
+// Fits reports whether a file of size bytes fits in the budget.
+func (budget UploadBudget) Fits(size int64) bool {
+	return budget.Quota.allows(budget.Usage, size, 1)
+}
+
+// UploadBudget works out what the user can still upload, failing with errQuotaExceeded along with the
+// budget when there isn't room for another file at all. Create checks the quota again when the file
+// is saved, this is so uploads that can't fit are turned away before they're read.
+func (service *FileService) UploadBudget(ctx context.Context, user User, loggedIn bool) (UploadBudget, error) {
+	if !loggedIn {
+		return UploadBudget{}, nil
+	}
+
+	usage, err := service.files.Usage(ctx, user.ID)
+	if err != nil {
+		return UploadBudget{}, err
+	}
+	budget := UploadBudget{Quota: service.quotaFor(user), Usage: usage}
+	if !budget.Fits(1) {
+		return budget, errQuotaExceeded
+	}
+	if budget.Quota.Bytes > 0 {
+		budget.MaxRequestBytes = budget.Quota.Bytes - usage.Bytes + multipartOverhead
+	}
+	return budget, nil
+}
+
+// UniqueKey picks a storage name no other file has, uuids shouldn't collide but it's cheap to check.
+func (service *FileService) UniqueKey(ctx context.Context) (string, error) {
+	for {
+		key := uuid.New().String()
+		exists, err := service.files.PathExists(ctx, key)
+		if err != nil || !exists {
+			return key, err
+		}
+	}
+}
+
+// Create saves a new file for owner labelled with tags, each name once, and charges it to the owner's
+// quota. Files without an owner, uploaded without logging in, count against nobody's.
+func (service *FileService) Create(ctx context.Context, owner User, file *File, tags []string) error {
+	file.UserId = owner.ID
+	if names := tagNames(tags); len(names) > 0 {
+		found, err := service.tags.FindOrCreate(ctx, names)
+		if err != nil {
+			return err
+		}
+		file.Tags = found
+	}
+
+	quota := Quota{}
+	if owner.ID != 0 {
+		quota = service.quotaFor(owner)
+	}
+	return service.files.Create(ctx, file, quota)
+}
+
+// Update changes the descriptive fields and returns the file as it is now. Ownership and location
+// have their own endpoints.
+func (service *FileService) Update(ctx context.Context, file File, name string, description string) (File, error) {
+	if err := service.files.Update(ctx, file.ID, name, description); err != nil {
+		return File{}, err
+	}
+	return service.files.Get(ctx, file.ID)
+}
+
+func (service *FileService) Delete(ctx context.Context, file File) error {
+	return service.files.Delete(ctx, file.ID)
+}
+
+// Purge forgets a file for good and frees up its quota. The content is the caller's to delete.
+func (service *FileService) Purge(ctx context.Context, file File) error {
+	return service.files.Purge(ctx, file)
+}
+
+// tagNames trims names and drops empty and repeated ones, keeping the order they came in.
+func tagNames(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	unique := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// UserService holds the rules for accounts: one per email, hashed passwords and disabled accounts
+// staying locked out.
+type UserService struct {
+	users UserRepository
+}
+
+func newUserService(users UserRepository) *UserService {
+	return &UserService{users: users}
+}
+
+// Register creates an account, failing with errEmailTaken when there's one for the email already.
+func (service *UserService) Register(ctx context.Context, email string, password string) (User, error) {
+	_, err := service.users.ByEmail(ctx, email)
+	if err == nil {
+		return User{}, errEmailTaken
+	}
+	if !errors.Is(err, errNotFound) {
+		return User{}, err
+	}
+
+	hash, err := hashPassword(ctx, password)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{Email: email, Password: hash}
+	if err := service.users.Create(ctx, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Login checks a user's password. The user is returned with errInvalidCredentials and
+// errAccountDisabled too, so failed logins can be recorded against them, with only the email when
+// there's no such user. The password is checked first, so a disabled account isn't given away.
+func (service *UserService) Login(ctx context.Context, email string, password string) (User, error) {
+	user, err := service.users.ByEmail(ctx, email)
+	if errors.Is(err, errNotFound) {
+		return User{Email: email}, errInvalidCredentials
+	}
+	if err != nil {
+		return User{Email: email}, err
+	}
+
+	if !checkPassword(ctx, password, user.Password) {
+		return user, errInvalidCredentials
+	}
+	if user.DisabledAt != nil {
+		return user, errAccountDisabled
+	}
+	return user, nil
+}
+
+// Authenticate finds the user a token was issued to. Tokens issued before an account was disabled
+// stop working straight away.
+func (service *UserService) Authenticate(ctx context.Context, email string) (User, error) {
+	user, err := service.users.ByEmail(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+	if user.DisabledAt != nil {
+		return User{}, errAccountDisabled
+	}
+	return user, nil
+}
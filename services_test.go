@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileServiceAuthorize(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryFileRepository()
+	service := newFileService(repo, &memoryTagRepository{}, func(User) Quota { return Quota{} })
+
+	owner, viewer, stranger := User{ID: 1}, User{ID: 2}, User{ID: 3}
+	private := File{}
+	public := File{}
+	assert.NoError(t, service.Create(ctx, owner, &private, nil))
+	assert.NoError(t, service.Create(ctx, User{}, &public, nil))
+	repo.grant(private.ID, viewer.ID, roleViewer)
+
+	_, err := service.Authorize(ctx, private.ID, owner, true, roleOwner)
+	assert.NoError(t, err)
+	_, err = service.Authorize(ctx, private.ID, viewer, true, roleViewer)
+	assert.NoError(t, err)
+	_, err = service.Authorize(ctx, private.ID, viewer, true, roleEditor)
+	assert.ErrorIs(t, err, errForbidden)
+	// files the user can't see at all look like they don't exist
+	_, err = service.Authorize(ctx, private.ID, stranger, true, roleViewer)
+	assert.ErrorIs(t, err, errNotFound)
+	_, err = service.Authorize(ctx, private.ID, User{}, false, roleViewer)
+	assert.ErrorIs(t, err, errNotFound)
+	// anyone can see files without an owner, but only admins can change them
+	_, err = service.Authorize(ctx, public.ID, User{}, false, roleViewer)
+	assert.NoError(t, err)
+	_, err = service.Authorize(ctx, public.ID, User{}, false, roleEditor)
+	assert.ErrorIs(t, err, errForbidden)
+	_, err = service.Authorize(ctx, public.ID, stranger, true, roleOwner)
+	assert.ErrorIs(t, err, errForbidden)
+	_, err = service.Authorize(ctx, public.ID, User{ID: 4, Role: "admin"}, true, roleOwner)
+	assert.NoError(t, err)
+
+	assert.NoError(t, service.Delete(ctx, private))
+	_, err = service.Authorize(ctx, private.ID, owner, true, roleViewer)
+	assert.ErrorIs(t, err, errNotFound)
+	// deleted files can still be purged or restored, by whoever could before
+	_, err = service.GetDeleted(ctx, private.ID, owner, true, roleOwner)
+	assert.NoError(t, err)
+	_, err = service.GetDeleted(ctx, private.ID, viewer, true, roleOwner)
+	assert.ErrorIs(t, err, errForbidden)
+	_, err = service.GetDeleted(ctx, private.ID, stranger, true, roleOwner)
+	assert.ErrorIs(t, err, errNotFound)
+
+	files, err := service.List(ctx, stranger, true, 1, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, public.ID, files[0].ID)
+	}
+	assert.Equal(t, []string{eventFileCreated, eventFileCreated, eventFileDeleted}, repo.events)
+}
+
+func TestFileServiceCreate(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryFileRepository()
+	quota := Quota{Bytes: 100, Files: 2}
+	service := newFileService(repo, &memoryTagRepository{}, func(User) Quota { return quota })
+
+	owner := User{ID: 1}
+	first := File{Size: 60}
+	assert.NoError(t, service.Create(ctx, owner, &first, []string{" work", "work", "", "2024"}))
+	assert.Equal(t, []string{"work", "2024"}, []string{first.Tags[0].Name, first.Tags[1].Name})
+	assert.Equal(t, owner.ID, first.UserId)
+
+	// tags are shared by name
+	second := File{Size: 40}
+	assert.NoError(t, service.Create(ctx, owner, &second, []string{"2024"}))
+	assert.Equal(t, first.Tags[1].ID, second.Tags[0].ID)
+
+	// the quota is the owner's, whichever limit is hit
+	third := File{Size: 1}
+	quota = Quota{Bytes: 100}
+	assert.ErrorIs(t, service.Create(ctx, owner, &third, nil), errQuotaExceeded)
+	quota = Quota{Files: 2}
+	assert.ErrorIs(t, service.Create(ctx, owner, &third, nil), errQuotaExceeded)
+	assert.NoError(t, service.Create(ctx, User{}, &third, nil), "files without an owner have no quota")
+	quota = Quota{Bytes: 100, Files: 2}
+	// uploads that can't fit are turned away before they're read
+	budget, err := service.UploadBudget(ctx, User{ID: 1}, true)
+	assert.ErrorIs(t, err, errQuotaExceeded)
+	assert.Equal(t, int64(100), budget.Usage.Bytes)
+	budget, err = service.UploadBudget(ctx, User{}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadBudget{}, budget, "anonymous uploads have no quota")
+
+	assert.NoError(t, service.Purge(ctx, first))
+	usage, err := service.Usage(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), usage.Bytes)
+	assert.Equal(t, int64(1), usage.Files)
+	budget, err = service.UploadBudget(ctx, User{ID: 1}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60+multipartOverhead), budget.MaxRequestBytes)
+	assert.True(t, budget.Fits(60))
+	assert.False(t, budget.Fits(61))
+
+	key, err := service.UniqueKey(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, key, 36)
+}
+
+func TestUserService(t *testing.T) {
+	ctx := context.Background()
+	repo := &memoryUserRepository{}
+	service := newUserService(repo)
+
+	user, err := service.Register(ctx, "test@test.com", "secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "secret", user.Password, "only the hash is kept")
+	_, err = service.Register(ctx, "test@test.com", "other")
+	assert.ErrorIs(t, err, errEmailTaken)
+
+	_, err = service.Login(ctx, "test@test.com", "secret")
+	assert.NoError(t, err)
+	failed, err := service.Login(ctx, "test@test.com", "wrong")
+	assert.ErrorIs(t, err, errInvalidCredentials)
+	assert.Equal(t, user.ID, failed.ID)
+	failed, err = service.Login(ctx, "nobody@test.com", "secret")
+	assert.ErrorIs(t, err, errInvalidCredentials)
+	assert.Equal(t, User{Email: "nobody@test.com"}, failed)
+
+	now := time.Now()
+	repo.users[0].DisabledAt = &now
+	_, err = service.Login(ctx, "test@test.com", "secret")
+	assert.ErrorIs(t, err, errAccountDisabled)
+	_, err = service.Login(ctx, "test@test.com", "wrong")
+	assert.ErrorIs(t, err, errInvalidCredentials, "the password is still checked first")
+	_, err = service.Authenticate(ctx, "test@test.com")
+	assert.ErrorIs(t, err, errAccountDisabled)
+}
+
+func TestUploadTags(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	w := uploadTestFile(t, router, cookie, "tagged.txt", []byte("This is a test file content."), map[string]string{"tags": `["work", "work", "2024"]`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Len(t, file.Tags, 2)
+
+	w = uploadTestFile(t, router, cookie, "other.txt", []byte("This is a test file content."), map[string]string{"tags": `["2024"]`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var count int64
+	assert.NoError(t, app.db.Model(&Tag{}).Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+	assert.NoError(t, app.db.Table("user_tags").Count(&count).Error)
+	assert.Equal(t, int64(3), count)
+
+	w = uploadTestFile(t, router, cookie, "bad.txt", []byte("This is a test file content."), map[string]string{"tags": "work"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/backend-project/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleOwner: 3}
+
+type grantRequest struct {
+	UserId  *uint  `json:"user_id"`
+	Email   string `json:"email"`
+	GroupId *uint  `json:"group_id"`
+	Role    string `json:"role"`
+}
+
+type shareLinkRequest struct {
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+// memberGroupIds is a subquery of the groups userId belongs to.
+func memberGroupIds(db *gorm.DB, userId uint) *gorm.DB {
+	return db.Table("group_members").Select("group_id").Where("user_id = ?", userId)
+}
+
+// visibleTo limits a query to public files, the user's own files and files shared with them.
+func visibleTo(db *gorm.DB, user User, loggedIn bool) func(query *gorm.DB) *gorm.DB {
+	return func(query *gorm.DB) *gorm.DB {
+		if !loggedIn {
+			return query.Where("user_id = 0")
+		}
+
+		sharedFileIds := db.Model(&FileGrant{}).Select("file_id").
+			Where("user_id = ? OR group_id IN (?)", user.ID, memberGroupIds(db, user.ID))
+		return query.Where("user_id = 0 OR user_id = ? OR id IN (?)", user.ID, sharedFileIds)
+	}
+}
+
+// visibleFiles is visibleTo for the current user.
+func (app *App) visibleFiles(c *gin.Context) func(db *gorm.DB) *gorm.DB {
+	user, loggedIn := currentUser(c)
+	return visibleTo(app.db, user, loggedIn)
+}
+
+// authorizeFile loads the file in the id param and checks the current user has at least minRole on it.
+// It writes the error response itself, so handlers should just return when ok is false.
+func (app *App) authorizeFile(c *gin.Context, minRole string) (File, bool) {
+	user, loggedIn := currentUser(c)
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	file, err := app.files.Authorize(c, uint(id), user, loggedIn, minRole)
+	return file, fileAccessAllowed(c, err, minRole)
+}
+
+// fileAccessAllowed writes the response for an error from FileService.Authorize or GetDeleted,
+// it's false when there was one.
+func fileAccessAllowed(c *gin.Context, err error, minRole string) bool {
+	if errors.Is(err, errNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return false
+	}
+	if errors.Is(err, errForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you need " + minRole + " access to do that"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func (app *App) getFileGrants(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+
+	grants, err := gorm.G[FileGrant](app.db).Where("file_id = ?", file.ID).Find(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, grants)
+}
+
+func (app *App) createFileGrant(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+	user, _ := currentUser(c)
+
+	var request grantRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Role != roleViewer && request.Role != roleEditor {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be viewer or editor"})
+		return
+	}
+
+	grant := FileGrant{FileId: file.ID, Role: request.Role}
+	switch {
+	case request.GroupId != nil && (request.UserId != nil || request.Email != ""):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "share with either a user or a group"})
+		return
+	case request.GroupId != nil:
+		// you can only share with groups you own or belong to
+		group, err := gorm.G[Group](app.db).
+			Where("id = ?", *request.GroupId).
+			Where("user_id = ? OR id IN (?)", user.ID, memberGroupIds(app.db, user.ID)).
+			First(c)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			return
+		}
+		grant.GroupId = &group.ID
+	default:
+		grantee, err := app.findUser(c, request.UserId, request.Email)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		grant.UserId = &grantee.ID
+	}
+
+	// sharing again with the same user or group just changes their role
+	var existing FileGrant
+	query := app.db.WithContext(c).Where("file_id = ?", file.ID)
+	if grant.GroupId != nil {
+		query = query.Where("group_id = ?", *grant.GroupId)
+	} else {
+		query = query.Where("user_id = ?", *grant.UserId)
+	}
+	err := query.First(&existing).Error
+	if err == nil {
+		grant.ID = existing.ID
+		grant.CreatedAt = existing.CreatedAt
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before := existing
+	if err := app.db.WithContext(c).Save(&grant).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if before.ID != 0 {
+		app.audit(c, "grant.update", grant.ID, before, grant)
+	} else {
+		app.audit(c, "grant.create", grant.ID, nil, grant)
+	}
+
+	c.JSON(http.StatusCreated, grant)
+}
+
+func (app *App) deleteFileGrant(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+
+	grant, err := gorm.G[FileGrant](app.db).Where("id = ? AND file_id = ?", c.Param("grantId"), file.ID).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "grant not found"})
+		return
+	}
+
+	if _, err := gorm.G[FileGrant](app.db).Where("id = ?", grant.ID).Delete(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "grant.delete", grant.ID, grant, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (app *App) getShareLinks(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+
+	links, err := gorm.G[ShareLink](app.db).Where("file_id = ?", file.ID).Find(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for i := range links {
+		links[i].HasPassword = links[i].Password != ""
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+func (app *App) createShareLink(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+	if err := scanRefusal(file); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	var request shareLinkRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if request.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_downloads can't be negative"})
+		return
+	}
+
+	token, err := auth.RandomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return
+	}
+
+	link := ShareLink{
+		FileId:       file.ID,
+		Token:        token,
+		TokenHash:    auth.HashToken(token),
+		ExpiresAt:    request.ExpiresAt,
+		MaxDownloads: request.MaxDownloads,
+		HasPassword:  request.Password != "",
+	}
+
+	if request.Password != "" {
+		link.Password, err = hashPassword(c, request.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+			return
+		}
+	}
+
+	if err := gorm.G[ShareLink](app.db).Create(c, &link); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the token is a credential, so it stays out of the audit log
+	audited := link
+	audited.Token = ""
+	app.audit(c, "link.create", link.ID, nil, audited)
+
+	c.JSON(http.StatusCreated, link)
+}
+
+func (app *App) revokeShareLink(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleOwner)
+	if !ok {
+		return
+	}
+
+	result := app.db.WithContext(c).Model(&ShareLink{}).
+		Where("id = ? AND file_id = ?", c.Param("linkId"), file.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "share link not found"})
+		return
+	}
+	linkId, _ := strconv.ParseUint(c.Param("linkId"), 10, 64)
+	app.audit(c, "link.revoke", uint(linkId), nil, gin.H{"file_id": file.ID})
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// downloadShareLink serves a shared file to anyone with the token, no login needed.
+// The password, if the link has one, goes in the X-Share-Password header or a password form field.
+func (app *App) downloadShareLink(c *gin.Context) {
+	link, err := gorm.G[ShareLink](app.db).Where("token_hash = ?", auth.HashToken(c.Param("token"))).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "share link not found"})
+		return
+	}
+
+	if link.RevokedAt != nil || (link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt)) {
+		c.JSON(http.StatusGone, gin.H{"error": "share link has expired"})
+		return
+	}
+
+	if link.Password != "" {
+		password := c.GetHeader("X-Share-Password")
+		if password == "" {
+			password = c.PostForm("password")
+		}
+
+		if !checkPassword(c, password, link.Password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong password"})
+			return
+		}
+	}
+
+	file, err := gorm.G[File](app.db).Where("id = ?", link.FileId).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	// count the download in the same statement that checks the limit, so concurrent downloads can't go over it
+	result := app.db.WithContext(c).Model(&ShareLink{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", link.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "share link has reached its download limit"})
+		return
+	}
+	app.audit(c, "link.download", link.ID, nil, gin.H{"file_id": file.ID})
+
+	app.sendFileContent(c, file, dispositionAttachment)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileGrants(t *testing.T) {
+	defer cleanUp()
+
+	_, router := setupTestApp()
+	ownerCookie := registerTestUser(t, router, "owner@test.com")
+	otherCookie := registerTestUser(t, router, "other@test.com")
+
+	w := uploadTestFile(t, router, ownerCookie, "testfile.txt", []byte("This is a test file content."), map[string]string{"name": "private"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	filePath := fmt.Sprintf("/files/%d", file.ID)
+
+	// only the owner can see it
+	w = performJSON(router, "GET", filePath, nil, otherCookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performJSON(router, "GET", filePath, nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performJSON(router, "GET", "/files", nil, otherCookie)
+	assert.Equal(t, "[]", w.Body.String())
+
+	w = performJSON(router, "POST", filePath+"/grants", grantRequest{Email: "other@test.com", Role: roleViewer}, ownerCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = performJSON(router, "GET", filePath+"/content", nil, otherCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "This is a test file content.", w.Body.String())
+	w = performJSON(router, "PATCH", filePath, File{Name: "renamed"}, otherCookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// sharing with a group the other user is in upgrades them to editor
+	var group Group
+	w = performJSON(router, "POST", "/groups", groupRequest{Name: "team"}, ownerCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &group))
+	w = performJSON(router, "POST", fmt.Sprintf("/groups/%d/members", group.ID), groupMemberRequest{Email: "other@test.com"}, ownerCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "POST", filePath+"/grants", grantRequest{GroupId: &group.ID, Role: roleEditor}, ownerCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = performJSON(router, "PATCH", filePath, File{Name: "renamed"}, otherCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "DELETE", filePath, nil, otherCookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performJSON(router, "GET", "/files", nil, otherCookie)
+	var files []File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+	assert.Len(t, files, 1)
+
+	// leaving the group and revoking the grant removes access again
+	w = performJSON(router, "DELETE", fmt.Sprintf("/groups/%d/members/%d", group.ID, 2), nil, ownerCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var grants []FileGrant
+	w = performJSON(router, "GET", filePath+"/grants", nil, ownerCookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grants))
+	assert.Len(t, grants, 2)
+	for _, grant := range grants {
+		w = performJSON(router, "DELETE", fmt.Sprintf("%s/grants/%d", filePath, grant.ID), nil, ownerCookie)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = performJSON(router, "GET", filePath, nil, otherCookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestShareLinks(t *testing.T) {
+	defer cleanUp()
+
+	_, router := setupTestApp()
+	ownerCookie := registerTestUser(t, router, "owner@test.com")
+
+	w := uploadTestFile(t, router, ownerCookie, "testfile.txt", []byte("This is a test file content."), map[string]string{"name": "shared.txt"})
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	filePath := fmt.Sprintf("/files/%d", file.ID)
+
+	expiresAt := time.Now().Add(time.Hour)
+	w = performJSON(router, "POST", filePath+"/links", shareLinkRequest{Password: "hunter2", ExpiresAt: &expiresAt, MaxDownloads: 1}, ownerCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var link ShareLink
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.NotEmpty(t, link.Token)
+	assert.True(t, link.HasPassword)
+
+	download := func(password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/s/"+link.Token, nil)
+		req.Header.Set("X-Share-Password", password)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, download("wrong").Code)
+
+	w = download("hunter2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "This is a test file content.", w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "shared.txt")
+
+	// max downloads reached
+	assert.Equal(t, http.StatusGone, download("hunter2").Code)
+
+	w = performJSON(router, "POST", filePath+"/links", shareLinkRequest{}, ownerCookie)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.Equal(t, http.StatusOK, download("").Code)
+
+	w = performJSON(router, "DELETE", fmt.Sprintf("%s/links/%d", filePath, link.ID), nil, ownerCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusGone, download("").Code)
+
+	assert.Equal(t, http.StatusNotFound, performJSON(router, "GET", "/s/not-a-token", nil, nil).Code)
+}
+
+func TestPresignedURLs(t *testing.T) {
+	defer cleanUp()
+	t.Setenv("URL_SIGNING_KEYS", "k1:signing-secret")
+	t.Setenv("PUBLIC_URL", "https://files.example.com/")
+
+	_, router := setupTestApp()
+	ownerCookie := registerTestUser(t, router, "owner@test.com")
+
+	w := uploadTestFile(t, router, ownerCookie, "testfile.txt", []byte("This is a test file content."), map[string]string{"name": "signed.txt"})
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	filePath := fmt.Sprintf("/files/%d", file.ID)
+
+	// presigning needs access to the file
+	w = performJSON(router, "POST", filePath+"/presign", presignRequest{}, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performJSON(router, "POST", filePath+"/presign", presignRequest{ExpiresIn: 60, Disposition: dispositionInline}, ownerCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var presigned struct {
+		URL string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &presigned))
+	assert.True(t, strings.HasPrefix(presigned.URL, "https://files.example.com"+filePath+"/content?"))
+
+	// no cookie needed
+	signedPath := strings.TrimPrefix(presigned.URL, "https://files.example.com")
+	w = performJSON(router, "GET", signedPath, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "This is a test file content.", w.Body.String())
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline"))
+
+	w = performJSON(router, "GET", strings.Replace(signedPath, "disposition=inline", "disposition=attachment", 1), nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performJSON(router, "POST", filePath+"/presign", presignRequest{ExpiresIn: -1}, ownerCookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// logged in downloads ignore the disposition query
+	w = performJSON(router, "GET", filePath+"/content?disposition=inline", nil, ownerCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+
+	// anything that could run script is an attachment even when presigned inline
+	w = uploadTestFile(t, router, ownerCookie, "page.html", []byte("<html><script>alert(1)</script></html>"), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	w = performJSON(router, "POST", fmt.Sprintf("/files/%d/presign", page.ID), presignRequest{Disposition: dispositionInline}, ownerCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &presigned))
+	w = performJSON(router, "GET", strings.TrimPrefix(presigned.URL, "https://files.example.com"), nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment"))
+	assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+}
+
+func TestInlineContentType(t *testing.T) {
+	assert.True(t, inlineContentType("image/png"))
+	assert.True(t, inlineContentType("text/plain; charset=utf-8"))
+	assert.True(t, inlineContentType("application/pdf"))
+	assert.False(t, inlineContentType("image/svg+xml"))
+	assert.False(t, inlineContentType("text/html; charset=utf-8"))
+	assert.False(t, inlineContentType("application/xhtml+xml"))
+	assert.False(t, inlineContentType(""))
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Disk stores blobs as files below Root.
+type Disk struct {
+	Root string
+}
+
+func NewDisk(root string) *Disk {
+	return &Disk{Root: root}
+}
+
+// path turns a key into a file path, refusing keys that would escape Root.
+func (disk *Disk) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || cleaned[1:] != key {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(disk.Root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first, so readers never see half written blobs.
+func (disk *Disk) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	filePath, err := disk.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+		return 0, err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(temp.Name())
+
+	written, err := io.Copy(temp, r)
+	if err != nil {
+		_ = temp.Close()
+		return written, err
+	}
+	if err := temp.Close(); err != nil {
+		return written, err
+	}
+
+	return written, os.Rename(temp.Name(), filePath)
+}
+
+func (disk *Disk) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	filePath, err := disk.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+func (disk *Disk) Stat(ctx context.Context, key string) (Info, error) {
+	filePath, err := disk.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (disk *Disk) Delete(ctx context.Context, key string) error {
+	filePath, err := disk.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+func (disk *Disk) Rename(ctx context.Context, from string, to string) error {
+	fromPath, err := disk.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := disk.path(to)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(toPath), 0750); err != nil {
+		return err
+	}
+	return os.Rename(fromPath, toPath)
+}
+
+// Walk only descends into directories that can hold keys starting with prefix.
+func (disk *Disk) Walk(ctx context.Context, prefix string, fn func(Info) error) error {
+	err := filepath.WalkDir(disk.Root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(disk.Root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// skip uploads that are still being written
+		if strings.HasPrefix(entry.Name(), ".upload-") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(Info{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+
+	// nothing has been uploaded yet
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisk(t *testing.T) {
+	ctx := context.Background()
+	disk := NewDisk(t.TempDir())
+
+	written, err := disk.Put(ctx, "a", strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), written)
+
+	reader, err := disk.Open(ctx, "a")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "hello", string(content))
+
+	assert.NoError(t, disk.Rename(ctx, "a", "quarantine/a"))
+	_, err = disk.Stat(ctx, "a")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	info, err := disk.Stat(ctx, "quarantine/a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+
+	_, err = disk.Put(ctx, "b", strings.NewReader("world"))
+	assert.NoError(t, err)
+
+	var keys []string
+	assert.NoError(t, disk.Walk(ctx, "", func(info Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	}))
+	sort.Strings(keys)
+	assert.Equal(t, []string{"b", "quarantine/a"}, keys)
+
+	for prefix, want := range map[string][]string{"quarantine/": {"quarantine/a"}, "quar": {"quarantine/a"}, "b": {"b"}, "c": nil} {
+		keys = nil
+		assert.NoError(t, disk.Walk(ctx, prefix, func(info Info) error {
+			keys = append(keys, info.Key)
+			return nil
+		}))
+		assert.Equal(t, want, keys, prefix)
+	}
+
+	assert.NoError(t, disk.Delete(ctx, "b"))
+	assert.ErrorIs(t, disk.Delete(ctx, "b"), os.ErrNotExist)
+
+	// keys can't escape the root
+	for _, key := range []string{"", "../a", "/a", "a/../../b", "a//b"} {
+		_, err := disk.Put(ctx, key, strings.NewReader("x"))
+		assert.Error(t, err, key)
+	}
+
+	// walking an upload directory that doesn't exist yet is fine
+	assert.NoError(t, NewDisk(t.TempDir()+"/missing").Walk(ctx, "", func(Info) error { return nil }))
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage keeps blobs under slash separated keys like "quarantine/<uuid>".
+// Missing keys give errors that match os.ErrNotExist.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	Delete(ctx context.Context, key string) error
+	Rename(ctx context.Context, from string, to string) error
+	// Walk calls fn for every blob whose key starts with prefix, in no particular order.
+	Walk(ctx context.Context, prefix string, fn func(Info) error) error
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is looked up on every use, so it follows whichever provider is set globally.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/backend-project/storage")
+}
+
+// Traced records a span for every call to the wrapped storage.
+type Traced struct {
+	Storage Storage
+}
+
+func NewTraced(storage Storage) *Traced {
+	return &Traced{Storage: storage}
+}
+
+func startSpan(ctx context.Context, operation string, key string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "storage."+operation, trace.WithAttributes(attribute.String("storage.key", key)))
+}
+
+// endSpan finishes span, marking it failed when err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (traced *Traced) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	ctx, span := startSpan(ctx, "put", key)
+	written, err := traced.Storage.Put(ctx, key, r)
+	span.SetAttributes(attribute.Int64("storage.bytes", written))
+	endSpan(span, err)
+	return written, err
+}
+
+// Open only covers opening the blob, reading it happens after the span has ended.
+func (traced *Traced) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	ctx, span := startSpan(ctx, "open", key)
+	content, err := traced.Storage.Open(ctx, key)
+	endSpan(span, err)
+	return content, err
+}
+
+func (traced *Traced) Stat(ctx context.Context, key string) (Info, error) {
+	ctx, span := startSpan(ctx, "stat", key)
+	info, err := traced.Storage.Stat(ctx, key)
+	endSpan(span, err)
+	return info, err
+}
+
+func (traced *Traced) Delete(ctx context.Context, key string) error {
+	ctx, span := startSpan(ctx, "delete", key)
+	err := traced.Storage.Delete(ctx, key)
+	endSpan(span, err)
+	return err
+}
+
+func (traced *Traced) Rename(ctx context.Context, from string, to string) error {
+	ctx, span := startSpan(ctx, "rename", from)
+	span.SetAttributes(attribute.String("storage.to", to))
+	err := traced.Storage.Rename(ctx, from, to)
+	endSpan(span, err)
+	return err
+}
+
+func (traced *Traced) Walk(ctx context.Context, prefix string, fn func(Info) error) error {
+	ctx, span := tracer().Start(ctx, "storage.walk")
+	err := traced.Storage.Walk(ctx, prefix, fn)
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,86 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels stops huge images, or small files claiming to be huge images, from using up all the memory.
+const MaxPixels = 50_000_000
+
+var (
+	ErrUnsupported = errors.New("unsupported image type")
+	ErrTooLarge    = errors.New("image is too large to make a thumbnail of")
+)
+
+var supportedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Supported reports whether thumbnails can be made for a content type.
+func Supported(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return supportedTypes[mediaType]
+}
+
+// Generate scales an image down to fit in a size by size square, keeping its aspect ratio.
+// Images with transparency are encoded as PNG and the rest as JPEG, the content type is returned
+// with the encoded thumbnail. Animated GIFs only keep their first frame.
+func Generate(r io.ReadSeeker, size int) ([]byte, string, error) {
+	config, _, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", ErrUnsupported
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	source, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := source.Bounds()
+	width, height := fit(bounds.Dx(), bounds.Dy(), size)
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, bounds, draw.Src, nil)
+
+	var encoded bytes.Buffer
+	if scaled.Opaque() {
+		err = jpeg.Encode(&encoded, scaled, &jpeg.Options{Quality: 85})
+		return encoded.Bytes(), "image/jpeg", err
+	}
+
+	err = png.Encode(&encoded, scaled)
+	return encoded.Bytes(), "image/png", err
+}
+
+// fit scales width and height down to fit in size, images that already fit are left alone.
+func fit(width int, height int, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
@@ -0,0 +1,65 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := range 400 {
+		for y := range 200 {
+			opaque.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 100, 300))
+
+	var jpegBytes, pngBytes, gifBytes bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&jpegBytes, opaque, nil))
+	assert.NoError(t, png.Encode(&pngBytes, transparent))
+	assert.NoError(t, gif.Encode(&gifBytes, opaque, nil))
+
+	tests := []struct {
+		name        string
+		content     []byte
+		size        int
+		width       int
+		height      int
+		contentType string
+	}{
+		{"jpeg", jpegBytes.Bytes(), 100, 100, 50, "image/jpeg"},
+		{"png keeps transparency", pngBytes.Bytes(), 150, 50, 150, "image/png"},
+		{"gif", gifBytes.Bytes(), 64, 64, 32, "image/jpeg"},
+		{"no upscaling", jpegBytes.Bytes(), 1000, 400, 200, "image/jpeg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thumbnail, contentType, err := Generate(bytes.NewReader(test.content), test.size)
+			assert.NoError(t, err)
+			assert.Equal(t, test.contentType, contentType)
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(thumbnail))
+			assert.NoError(t, err)
+			assert.Equal(t, test.width, config.Width)
+			assert.Equal(t, test.height, config.Height)
+		})
+	}
+
+	_, _, err := Generate(bytes.NewReader([]byte("not an image")), 100)
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestSupported(t *testing.T) {
+	assert.True(t, Supported("image/webp"))
+	assert.True(t, Supported("image/png; charset=binary"))
+	assert.False(t, Supported("image/svg+xml"))
+	assert.False(t, Supported("text/plain; charset=utf-8"))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/backend-project/scan"
+	"github.com/backend-project/storage"
+	"github.com/backend-project/thumbnail"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+)
+
+// thumbnailMarker separates a thumbnail's size from the key of the upload it was made from.
+const thumbnailMarker = ".thumb-"
+
+// thumbnailKey keeps thumbnails in storage next to the upload they were made from.
+func thumbnailKey(file File, size int) string {
+	return fmt.Sprintf("%s%d", thumbnailPrefix(file), size)
+}
+
+// thumbnailPrefix starts the key of every thumbnail of file, whatever its size.
+func thumbnailPrefix(file File) string {
+	return file.FilePath + thumbnailMarker
+}
+
+func (app *App) generateThumbnail(ctx context.Context, file File, size int) error {
+	content, err := app.store().Open(ctx, storageKey(file))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	data, _, err := thumbnail.Generate(content, size)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.store().Put(ctx, thumbnailKey(file, size), bytes.NewReader(data))
+	return err
+}
+
+// generateThumbnails makes a thumbnail at every configured size, it runs as a job after uploads.
+func (app *App) generateThumbnails(ctx context.Context, file File) error {
+	if file.ScanStatus == scan.StatusInfected || !thumbnail.Supported(file.ContentType) {
+		return nil
+	}
+
+	var errs []error
+	for _, size := range app.config.Uploads.ThumbnailSizes {
+		if err := app.generateThumbnail(ctx, file, size); err != nil {
+			errs = append(errs, fmt.Errorf("%dpx thumbnail: %w", size, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteThumbnails removes every thumbnail of file, including ones made at sizes that have since
+// been taken out of the config.
+func (app *App) deleteThumbnails(ctx context.Context, file File) {
+	var keys []string
+	err := app.store().Walk(ctx, thumbnailPrefix(file), func(info storage.Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		logFor(ctx).Error("Listing thumbnails failed", "file_id", file.ID, "error", err)
+		return
+	}
+
+	for _, key := range keys {
+		err := app.store().Delete(ctx, key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logFor(ctx).Error("Deleting thumbnail failed", "file_id", file.ID, "key", key, "error", err)
+		}
+	}
+}
+
+// sniffContentType fills in the content type of files uploaded before it was recorded.
+func (app *App) sniffContentType(ctx context.Context, file *File) error {
+	if file.ContentType != "" {
+		return nil
+	}
+
+	content, err := app.store().Open(ctx, storageKey(*file))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	detected, err := mimetype.DetectReader(content)
+	if err != nil {
+		return err
+	}
+
+	file.ContentType = detected.String()
+	return app.db.WithContext(ctx).Model(file).Update("content_type", file.ContentType).Error
+}
+
+// getFileThumbnail serves a thumbnail, making it first if it doesn't exist yet,
+// like for files uploaded before thumbnails were a thing.
+func (app *App) getFileThumbnail(c *gin.Context) {
+	file, ok := app.authorizeFile(c, roleViewer)
+	if !ok {
+		return
+	}
+
+	if err := scanRefusal(file); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	sizes := app.config.Uploads.ThumbnailSizes
+	size := sizes[0]
+	if rawSize := c.Query("size"); rawSize != "" {
+		size, _ = strconv.Atoi(rawSize)
+		if !slices.Contains(sizes, size) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be one of %v", sizes)})
+			return
+		}
+	}
+
+	if err := app.sniffContentType(c, &file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !thumbnail.Supported(file.ContentType) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "thumbnails aren't available for this type of file"})
+		return
+	}
+
+	key := thumbnailKey(file, size)
+	_, err := app.store().Stat(c, key)
+	if errors.Is(err, os.ErrNotExist) {
+		err = app.generateThumbnail(c, file, size)
+	}
+	if errors.Is(err, thumbnail.ErrUnsupported) || errors.Is(err, thumbnail.ErrTooLarge) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	app.sendStoredBlob(c, key, "", "", "")
+}
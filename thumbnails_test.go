@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbnails(t *testing.T) {
+	defer cleanUp()
+	t.Setenv("THUMBNAIL_SIZES", "64,128")
+
+	app, router := setupTestApp()
+
+	source := image.NewRGBA(image.Rect(0, 0, 300, 150))
+	for x := range 300 {
+		source.Set(x, x/2, color.RGBA{R: 255, A: 255})
+	}
+	var pngBytes bytes.Buffer
+	assert.NoError(t, png.Encode(&pngBytes, source))
+
+	w := uploadTestFile(t, router, nil, "picture.png", pngBytes.Bytes(), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+
+	// both sizes are made after the upload
+	runJobs(t, app)
+	for _, size := range []int{64, 128} {
+		_, err := app.store().Stat(context.TODO(), thumbnailKey(file, size))
+		assert.NoError(t, err)
+	}
+
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d/thumbnail?size=128", file.ID), nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	config, _, err := image.DecodeConfig(w.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 128, config.Width)
+	assert.Equal(t, 64, config.Height)
+
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d/thumbnail?size=7", file.ID), nil, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// thumbnails at sizes taken out of the config are deleted too
+	_, err = app.store().Put(context.TODO(), thumbnailKey(file, 32), bytes.NewReader(pngBytes.Bytes()))
+	assert.NoError(t, err)
+
+	// files from before thumbnails existed get them when they're first asked for
+	app.deleteThumbnails(context.TODO(), file)
+	for _, size := range []int{32, 64, 128} {
+		_, err = app.store().Stat(context.TODO(), thumbnailKey(file, size))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	assert.NoError(t, app.db.Model(&file).Update("content_type", "").Error)
+
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d/thumbnail", file.ID), nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	config, _, err = image.DecodeConfig(w.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, config.Width)
+	_, err = app.store().Stat(context.TODO(), thumbnailKey(file, 64))
+	assert.NoError(t, err)
+
+	w = uploadTestFile(t, router, nil, "notes.txt", []byte("This is a test file content."), nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d/thumbnail", file.ID), nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/backend-project/auth"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "backend-project"
+
+// tracer is looked up on every use rather than once, so it follows the provider set by setupTracing or a test.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/backend-project")
+}
+
+// tracingEnabled is true when there's an OTLP endpoint to send spans to, unless
+// OTEL_SDK_DISABLED=true or OTEL_TRACES_EXPORTER=none turn tracing off.
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing installs the W3C trace context propagator and, when tracing is enabled, an OTLP/HTTP
+// exporter configured by the standard OTEL_* variables. The returned function flushes any spans
+// that haven't been sent yet.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !tracingEnabled() {
+		slog.Info("Tracing disabled, set OTEL_EXPORTER_OTLP_ENDPOINT to send spans to a collector")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.Merge(
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled")
+
+	return provider.Shutdown, nil
+}
+
+// hashPassword is auth.HashPassword in a span, bcrypt is slow on purpose and it shows in traces.
+func hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer().Start(ctx, "bcrypt.hash")
+	defer span.End()
+
+	return auth.HashPassword(password)
+}
+
+// checkPassword is auth.CheckPasswordHash in a span.
+func checkPassword(ctx context.Context, password string, hash string) bool {
+	_, span := tracer().Start(ctx, "bcrypt.compare")
+	defer span.End()
+
+	return auth.CheckPasswordHash(password, hash)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans collects every finished span until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func TestTracing(t *testing.T) {
+	defer cleanUp()
+
+	recorder := recordSpans(t)
+	_, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+
+	// the caller's trace is continued
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	body := `{"email": "test@test.com", "password": "secret"}`
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceId {
+			continue
+		}
+		names[span.Name()] = true
+
+		// query values are left out of spans
+		for _, attr := range span.Attributes() {
+			assert.NotContains(t, attr.Value.Emit(), "test@test.com")
+		}
+	}
+	assert.True(t, names["POST /login"], "request span")
+	assert.True(t, names["bcrypt.compare"], "password check span")
+	assert.True(t, names["select users"], "query span")
+
+	w = uploadTestFile(t, router, cookie, "testfile.txt", []byte("This is a test file content."), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	parents := map[string]string{}
+	var requestSpanId string
+	for _, span := range recorder.Ended() {
+		parents[span.Name()] = span.Parent().SpanID().String()
+		if span.Name() == "POST /files" {
+			requestSpanId = span.SpanContext().SpanID().String()
+		}
+	}
+	if assert.NotEmpty(t, requestSpanId) {
+		assert.Equal(t, requestSpanId, parents["multipart.parse"])
+		assert.Equal(t, requestSpanId, parents["storage.put"])
+	}
+}
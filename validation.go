@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/backend-project/scan"
+	"github.com/gabriel-vasile/mimetype"
+)
+
+var (
+	errTypeNotAllowed  = errors.New("file type is not allowed")
+	errContentMismatch = errors.New("file content doesn't match its extension")
+	errQuarantined     = errors.New("file is quarantined")
+	errScanPending     = errors.New("file is waiting to be scanned again")
+	errRescanFailed    = errors.New("scanning failed again")
+)
+
+func init() {
+	// common types that aren't in Go's builtin table, so checks don't depend on the host's mime.types
+	extraTypes := map[string]string{
+		".txt":  "text/plain",
+		".csv":  "text/csv",
+		".md":   "text/markdown",
+		".zip":  "application/zip",
+		".gz":   "application/gzip",
+		".tar":  "application/x-tar",
+		".mp3":  "audio/mpeg",
+		".mp4":  "video/mp4",
+		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}
+	for extension, mimeType := range extraTypes {
+		if mime.TypeByExtension(extension) == "" {
+			_ = mime.AddExtensionType(extension, mimeType)
+		}
+	}
+}
+
+// uploadPolicy decides which uploads are accepted. MIME types can use wildcards like image/*,
+// extensions include the dot. Empty allow lists allow everything that isn't denied.
+type uploadPolicy struct {
+	AllowedTypes      []string
+	DeniedTypes       []string
+	AllowedExtensions []string
+	DeniedExtensions  []string
+}
+
+func lowerList(values []string) []string {
+	var items []string
+	for _, item := range values {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// policy is the upload policy these settings describe, matched case-insensitively.
+func (config UploadConfig) policy() uploadPolicy {
+	return uploadPolicy{
+		AllowedTypes:      lowerList(config.AllowedTypes),
+		DeniedTypes:       lowerList(config.DeniedTypes),
+		AllowedExtensions: lowerList(config.AllowedExtensions),
+		DeniedExtensions:  lowerList(config.DeniedExtensions),
+	}
+}
+
+func matchesType(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		prefix, isWildcard := strings.CutSuffix(pattern, "*")
+		if mimeType == pattern || (isWildcard && strings.HasPrefix(mimeType, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectedTypes is the detected MIME type and all the types it's a special case of,
+// e.g. a docx is also a zip. Parameters like charset are dropped.
+func detectedTypes(detected *mimetype.MIME) []string {
+	var types []string
+	for m := detected; m != nil; m = m.Parent() {
+		mediaType, _, _ := mime.ParseMediaType(m.String())
+		types = append(types, mediaType)
+	}
+	return types
+}
+
+func isTextual(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") ||
+		strings.HasSuffix(mimeType, "+xml") ||
+		strings.HasSuffix(mimeType, "+json") ||
+		mimeType == "application/json" ||
+		mimeType == "application/xml" ||
+		mimeType == "application/javascript"
+}
+
+// contentMatchesExtension compares what the magic bytes say with what the extension claims.
+// Unknown extensions aren't checked. Text formats can't be told apart by their bytes,
+// so plain text is accepted for any of them.
+func contentMatchesExtension(detected *mimetype.MIME, extension string) bool {
+	expected, _, _ := mime.ParseMediaType(mime.TypeByExtension(extension))
+	if expected == "" {
+		return true
+	}
+
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(expected) {
+			return true
+		}
+	}
+
+	return detected.Is("text/plain") && isTextual(expected)
+}
+
+// check sniffs the start of an upload and returns its content type,
+// or an error if the policy rejects it.
+func (policy uploadPolicy) check(fileName string, content io.Reader) (string, error) {
+	detected, err := mimetype.DetectReader(content)
+	if err != nil {
+		return "", err
+	}
+	types := detectedTypes(detected)
+	extension := strings.ToLower(filepath.Ext(fileName))
+
+	for _, mimeType := range types {
+		if matchesType(mimeType, policy.DeniedTypes) {
+			return "", errTypeNotAllowed
+		}
+	}
+
+	if len(policy.AllowedTypes) > 0 {
+		allowed := false
+		for _, mimeType := range types {
+			allowed = allowed || matchesType(mimeType, policy.AllowedTypes)
+		}
+		if !allowed {
+			return "", errTypeNotAllowed
+		}
+	}
+
+	for _, denied := range policy.DeniedExtensions {
+		if extension == denied {
+			return "", errTypeNotAllowed
+		}
+	}
+
+	if len(policy.AllowedExtensions) > 0 {
+		allowed := false
+		for _, allowedExtension := range policy.AllowedExtensions {
+			allowed = allowed || extension == allowedExtension
+		}
+		if !allowed {
+			return "", errTypeNotAllowed
+		}
+	}
+
+	if !contentMatchesExtension(detected, extension) {
+		return "", errContentMismatch
+	}
+
+	return detected.String(), nil
+}
+
+// quarantinePrefix is where infected uploads are moved, out of the way of normal downloads.
+const quarantinePrefix = "quarantine/"
+
+// storageKey is where a file's upload is kept in storage.
+func storageKey(file File) string {
+	if file.ScanStatus == scan.StatusInfected {
+		return quarantinePrefix + file.FilePath
+	}
+	return file.FilePath
+}
+
+// scanRefusal is why a file can't be handed out, nil when it can. Files whose scan failed are held
+// back like infected ones until the rescan job gets through.
+func scanRefusal(file File) error {
+	switch file.ScanStatus {
+	case scan.StatusInfected:
+		return errQuarantined
+	case scan.StatusError:
+		return errScanPending
+	}
+	return nil
+}
+
+// scanUpload runs the configured scanner, if there is one, over a saved upload and
+// quarantines it if it's infected. It returns the scan status to record on the file,
+// and an error when an infected upload couldn't be moved into quarantine.
+func (app *App) scanUpload(ctx context.Context, key string) (string, scan.Result, error) {
+	if app.scanner == nil {
+		return scan.StatusSkipped, scan.Result{}, nil
+	}
+
+	upload, err := app.store().Open(ctx, key)
+	if err != nil {
+		logFor(ctx).Error("Opening upload to scan failed", "key", key, "error", err)
+		return scan.StatusError, scan.Result{}, nil
+	}
+	defer upload.Close()
+
+	result, err := app.scanner.Scan(ctx, upload)
+	if err != nil {
+		logFor(ctx).Error("Scanning upload failed", "key", key, "error", err)
+		return scan.StatusError, result, nil
+	}
+
+	if !result.Infected {
+		return scan.StatusClean, result, nil
+	}
+
+	logFor(ctx).Warn("Quarantining infected upload", "key", key, "virus", result.Signature)
+	if err := app.store().Rename(ctx, key, quarantinePrefix+key); err != nil {
+		return scan.StatusInfected, result, fmt.Errorf("quarantining upload: %w", err)
+	}
+
+	return scan.StatusInfected, result, nil
+}
+
+// rescanFile scans a file again whose scan failed when it was uploaded. It runs as a job and
+// returns an error to be retried while the scanner keeps failing.
+func (app *App) rescanFile(ctx context.Context, file File) error {
+	if file.ScanStatus != scan.StatusError {
+		return nil
+	}
+
+	status, _, err := app.scanUpload(ctx, file.FilePath)
+	if err != nil {
+		return err
+	}
+	if status == scan.StatusError {
+		return errRescanFailed
+	}
+	if status == scan.StatusInfected {
+		app.deleteThumbnails(ctx, file)
+	}
+
+	return app.db.WithContext(ctx).Model(&File{}).Where("id = ?", file.ID).Update("scan_status", status).Error
+}
+
+// setupScanner connects to clamd at address, without one uploads aren't scanned.
+func setupScanner(address string) scan.Scanner {
+	if address == "" {
+		slog.Warn("CLAMAV_ADDRESS not set, uploads won't be scanned")
+		return nil
+	}
+
+	scanner, err := scan.NewClamAV(address, time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	return scanner
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/backend-project/jobs"
+	"github.com/backend-project/scan"
+	"github.com/backend-project/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+
+func TestUploadPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   uploadPolicy
+		fileName string
+		content  []byte
+		err      error
+	}{
+		{"text", uploadPolicy{}, "notes.txt", []byte("hello"), nil},
+		{"png", uploadPolicy{}, "photo.png", pngHeader, nil},
+		{"png upper case extension", uploadPolicy{}, "photo.PNG", pngHeader, nil},
+		{"png named jpg", uploadPolicy{}, "photo.jpg", pngHeader, errContentMismatch},
+		{"text named png", uploadPolicy{}, "photo.png", []byte("hello"), errContentMismatch},
+		{"json", uploadPolicy{}, "data.json", []byte(`{"a": 1}`), nil},
+		{"text in a text format", uploadPolicy{}, "page.html", []byte("hello"), nil},
+		{"unknown extension", uploadPolicy{}, "data.xyz", pngHeader, nil},
+		{"denied extension", uploadPolicy{DeniedExtensions: []string{".exe"}}, "setup.exe", []byte("MZ"), errTypeNotAllowed},
+		{"allowed extension", uploadPolicy{AllowedExtensions: []string{".png"}}, "notes.txt", []byte("hello"), errTypeNotAllowed},
+		{"allowed wildcard type", uploadPolicy{AllowedTypes: []string{"image/*"}}, "photo.png", pngHeader, nil},
+		{"not an allowed type", uploadPolicy{AllowedTypes: []string{"image/*"}}, "notes.txt", []byte("hello"), errTypeNotAllowed},
+		{"denied type", uploadPolicy{DeniedTypes: []string{"image/png"}}, "photo.png", pngHeader, errTypeNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.policy.check(test.fileName, bytes.NewReader(test.content))
+			assert.ErrorIs(t, err, test.err)
+		})
+	}
+}
+
+type fakeScanner struct{}
+
+func (fakeScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return scan.Result{}, err
+	}
+	if strings.Contains(string(content), "EICAR") {
+		return scan.Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+	return scan.Result{}, nil
+}
+
+func TestUploadScanning(t *testing.T) {
+	defer cleanUp()
+	t.Setenv("DENIED_EXTENSIONS", ".exe")
+
+	app, router := setupTestApp()
+	app.scanner = fakeScanner{}
+
+	w := uploadTestFile(t, router, nil, "setup.exe", []byte("MZ"), nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	w = uploadTestFile(t, router, nil, "photo.jpg", pngHeader, nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = uploadTestFile(t, router, nil, "clean.txt", []byte("This is a test file content."), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, scan.StatusClean, file.ScanStatus)
+	assert.Equal(t, "text/plain; charset=utf-8", file.ContentType)
+
+	w = uploadTestFile(t, router, nil, "infected.txt", []byte("X5O!P%@AP EICAR"), nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var response struct {
+		File File `json:"file"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, scan.StatusInfected, response.File.ScanStatus)
+
+	// the upload is moved into quarantine and can't be downloaded
+	_, err := app.store().Stat(context.TODO(), response.File.FilePath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = app.store().Stat(context.TODO(), quarantinePrefix+response.File.FilePath)
+	assert.NoError(t, err)
+
+	w = performJSON(router, "GET", fmt.Sprintf("/files/%d/content", response.File.ID), nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// failingScanner can't reach clamd until it's told to work.
+type failingScanner struct {
+	working *bool
+}
+
+func (scanner failingScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	if !*scanner.working {
+		return scan.Result{}, errors.New("connecting to clamd: connection refused")
+	}
+	return fakeScanner{}.Scan(ctx, r)
+}
+
+func TestScanErrorsHoldFilesBack(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	working := false
+	app.scanner = failingScanner{working: &working}
+	cookie := registerTestUser(t, router, "owner@test.com")
+
+	w := uploadTestFile(t, router, cookie, "clean.txt", []byte("This is a test file content."), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file File
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, scan.StatusError, file.ScanStatus)
+	filePath := fmt.Sprintf("/files/%d", file.ID)
+
+	w = performJSON(router, "GET", filePath+"/content", nil, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performJSON(router, "POST", filePath+"/links", shareLinkRequest{}, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performJSON(router, "POST", "/files/archive", archiveRequest{Ids: []uint{file.ID}}, cookie)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the rescan job keeps failing while clamd is down
+	runJobs(t, app)
+	var job jobs.Job
+	assert.NoError(t, app.db.Where("type = ?", jobScanFile).First(&job).Error)
+	assert.Equal(t, jobs.StatusPending, job.Status)
+
+	working = true
+	assert.NoError(t, app.db.Model(&jobs.Job{}).Where("id = ?", job.ID).Update("run_at", time.Now()).Error)
+	runJobs(t, app)
+
+	w = performJSON(router, "GET", filePath+"/content", nil, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "This is a test file content.", w.Body.String())
+}
+
+// brokenRenameStorage can't move anything, like into quarantine.
+type brokenRenameStorage struct {
+	storage.Storage
+}
+
+func (brokenRenameStorage) Rename(ctx context.Context, from string, to string) error {
+	return errors.New("rename failed")
+}
+
+func TestInfectedUploadRejectedWhenQuarantineFails(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	app.scanner = fakeScanner{}
+	app.storage = brokenRenameStorage{storage.NewDisk(app.config.Uploads.Path)}
+
+	w := uploadTestFile(t, router, nil, "infected.txt", []byte("X5O!P%@AP EICAR"), nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var count int64
+	assert.NoError(t, app.db.Model(&File{}).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+	var blobs int
+	assert.NoError(t, app.store().Walk(context.TODO(), "", func(info storage.Info) error {
+		blobs++
+		return nil
+	}))
+	assert.Equal(t, 0, blobs)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/backend-project/jobs"
+	"github.com/backend-project/storage"
+	"gorm.io/gorm"
+)
+
+// Problems the storage verifier finds. A file's IntegrityStatus is set to one of the first three
+// when broken rows are marked.
+const (
+	problemMissing          = "missing"
+	problemSizeMismatch     = "size_mismatch"
+	problemChecksumMismatch = "checksum_mismatch"
+	problemOrphan           = "orphan"
+)
+
+// orphanPrefix is where orphaned blobs are moved when they're quarantined, they're not deleted
+// in case a file's row was what went missing.
+const orphanPrefix = quarantinePrefix + "orphans/"
+
+// jobVerifyStorage runs the storage verifier every VERIFY_INTERVAL.
+const jobVerifyStorage = "storage.verify"
+
+type verifyOptions struct {
+	// Checksums rehashes every blob, otherwise only sizes are compared.
+	Checksums         bool
+	QuarantineOrphans bool
+	MarkBroken        bool
+	// OrphanAge is how old a blob without a file has to be to count as an orphan, uploads are
+	// stored before their row is created.
+	OrphanAge time.Duration
+}
+
+type verifyProblem struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	FileId   uint   `json:"file_id,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// Repaired is what was done about it, "quarantined" or "marked", empty when nothing was.
+	Repaired string `json:"repaired,omitempty"`
+}
+
+// verifyReport is what the storage verifier found, "files verify -json" prints it as is.
+type verifyReport struct {
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt time.Time       `json:"finished_at"`
+	Checksums  bool            `json:"checksums"`
+	Files      int             `json:"files"`
+	Blobs      int             `json:"blobs"`
+	Problems   []verifyProblem `json:"problems"`
+}
+
+func (report verifyReport) writeText(w io.Writer) {
+	for _, problem := range report.Problems {
+		switch problem.Kind {
+		case problemMissing:
+			fmt.Fprintf(w, "file %d: %s is missing", problem.FileId, problem.Key)
+		case problemSizeMismatch:
+			fmt.Fprintf(w, "file %d: %s is %s bytes, expected %s", problem.FileId, problem.Key, problem.Actual, problem.Expected)
+		case problemChecksumMismatch:
+			fmt.Fprintf(w, "file %d: %s has the checksum %s, expected %s", problem.FileId, problem.Key, problem.Actual, problem.Expected)
+		case problemOrphan:
+			fmt.Fprintf(w, "%s doesn't belong to a file", problem.Key)
+		}
+		if problem.Repaired != "" {
+			fmt.Fprintf(w, ", %s", problem.Repaired)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "checked %d files and %d blobs, %d problems\n", report.Files, report.Blobs, len(report.Problems))
+}
+
+// verifyStorage compares every file, soft deleted ones included, with the blobs in storage. Files
+// created and blobs written after it starts are left for the next run, so uploads in flight aren't
+// reported.
+func (app *App) verifyStorage(ctx context.Context, options verifyOptions) (verifyReport, error) {
+	report := verifyReport{StartedAt: time.Now(), Checksums: options.Checksums, Problems: []verifyProblem{}}
+
+	blobs := map[string]storage.Info{}
+	err := app.store().Walk(ctx, "", func(info storage.Info) error {
+		blobs[info.Key] = info
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("listing storage: %w", err)
+	}
+	report.Blobs = len(blobs)
+	paths := map[string]bool{}
+
+	// files from before sizes were recorded have none until files reindex reads it from storage
+	var unsizedIds []uint
+	if err := app.db.WithContext(ctx).Unscoped().Model(&File{}).Where("size IS NULL").Pluck("id", &unsizedIds).Error; err != nil {
+		return report, err
+	}
+	unsized := make(map[uint]bool, len(unsizedIds))
+	for _, id := range unsizedIds {
+		unsized[id] = true
+	}
+
+	var files []File
+	err = app.db.WithContext(ctx).Unscoped().Where("created_at < ?", report.StartedAt).
+		FindInBatches(&files, 500, func(tx *gorm.DB, batch int) error {
+			for _, file := range files {
+				problem, err := app.verifyFile(ctx, file, !unsized[file.ID], blobs, options)
+				if err != nil {
+					return err
+				}
+				if err := app.markFile(ctx, file, problem, options); err != nil {
+					return err
+				}
+				if problem != nil {
+					report.Problems = append(report.Problems, *problem)
+				}
+
+				// what's left at the end belongs to no file
+				delete(blobs, storageKey(file))
+				paths[file.FilePath] = true
+			}
+			report.Files += len(files)
+			return nil
+		}).Error
+	if err != nil {
+		return report, err
+	}
+
+	// thumbnails belong to their file whatever their size, sizes that were configured once may not be now
+	for key := range blobs {
+		if index := strings.LastIndex(key, thumbnailMarker); index >= 0 && paths[key[:index]] {
+			delete(blobs, key)
+		}
+	}
+
+	cutoff := report.StartedAt.Add(-options.OrphanAge)
+	for key, info := range blobs {
+		if strings.HasPrefix(key, orphanPrefix) || strings.HasPrefix(key, healthCheckPrefix) || !info.ModTime.Before(cutoff) {
+			continue
+		}
+
+		problem := verifyProblem{Kind: problemOrphan, Key: key, Actual: fmt.Sprint(info.Size)}
+		if options.QuarantineOrphans {
+			if err := app.store().Rename(ctx, key, orphanPrefix+key); err != nil {
+				return report, fmt.Errorf("quarantining %s: %w", key, err)
+			}
+			problem.Repaired = "quarantined"
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// verifyFile checks one file's blob, returning nil when it's fine. The size is only compared when
+// the file has one.
+func (app *App) verifyFile(ctx context.Context, file File, sized bool, blobs map[string]storage.Info, options verifyOptions) (*verifyProblem, error) {
+	key := storageKey(file)
+	info, ok := blobs[key]
+	if !ok {
+		return &verifyProblem{Kind: problemMissing, Key: key, FileId: file.ID}, nil
+	}
+	if sized && info.Size != file.Size {
+		return &verifyProblem{Kind: problemSizeMismatch, Key: key, FileId: file.ID, Expected: fmt.Sprint(file.Size), Actual: fmt.Sprint(info.Size)}, nil
+	}
+	// files still waiting to be hashed have nothing to compare with
+	if !options.Checksums || file.Checksum == "" {
+		return nil, nil
+	}
+
+	content, err := app.store().Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", key, err)
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != file.Checksum {
+		return &verifyProblem{Kind: problemChecksumMismatch, Key: key, FileId: file.ID, Expected: file.Checksum, Actual: checksum}, nil
+	}
+	return nil, nil
+}
+
+// markFile records a file's problem in its IntegrityStatus, or clears one that's been fixed.
+// A checksum mismatch is only cleared by a run that compared checksums.
+func (app *App) markFile(ctx context.Context, file File, problem *verifyProblem, options verifyOptions) error {
+	if !options.MarkBroken {
+		return nil
+	}
+
+	status := ""
+	if problem != nil {
+		status = problem.Kind
+		problem.Repaired = "marked"
+	}
+	if status == file.IntegrityStatus || (status == "" && file.IntegrityStatus == problemChecksumMismatch && !options.Checksums) {
+		return nil
+	}
+
+	return app.db.WithContext(ctx).Unscoped().Model(&File{}).Where("id = ?", file.ID).Update("integrity_status", status).Error
+}
+
+// verifyFiles runs "files verify" and fails when there are problems, repaired or not.
+func (app *App) verifyFiles(ctx context.Context, options verifyOptions, asJSON bool, w io.Writer) error {
+	report, err := app.verifyStorage(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.writeText(w)
+	}
+
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d problems found in storage", len(report.Problems))
+	}
+	return nil
+}
+
+func (app *App) verifyOptions() verifyOptions {
+	config := app.config.Verify
+	return verifyOptions{
+		Checksums:         config.Checksums,
+		QuarantineOrphans: config.QuarantineOrphans,
+		MarkBroken:        config.MarkBroken,
+		OrphanAge:         config.OrphanAge,
+	}
+}
+
+type verifyJobPayload struct {
+	// Due is when the run was scheduled for, in unix seconds.
+	Due int64 `json:"due"`
+}
+
+// scheduleStorageVerify queues the first verifier run after the given time. Runs are keyed by when
+// they're due, so every server can schedule them and each one still happens once.
+func (app *App) scheduleStorageVerify(ctx context.Context, after time.Time) error {
+	interval := app.config.Verify.Interval
+	if interval <= 0 {
+		return nil
+	}
+
+	runAt := after.Truncate(interval).Add(interval)
+	_, err := app.jobs.Enqueue(ctx, jobs.Spec{
+		Type:           jobVerifyStorage,
+		Payload:        verifyJobPayload{Due: runAt.Unix()},
+		IdempotencyKey: fmt.Sprintf("%s:%d", jobVerifyStorage, runAt.Unix()),
+		RunAt:          runAt,
+	})
+	return err
+}
+
+// runStorageVerify is the job behind VERIFY_INTERVAL. It schedules the next run first, so a run that
+// fails doesn't stop them, and logs what it finds.
+func (app *App) runStorageVerify(ctx context.Context, job jobs.Job) error {
+	var payload verifyJobPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+	after := time.Unix(payload.Due, 0)
+	if now := time.Now(); now.After(after) {
+		after = now
+	}
+	if err := app.scheduleStorageVerify(ctx, after); err != nil {
+		return err
+	}
+
+	report, err := app.verifyStorage(ctx, app.verifyOptions())
+	if err != nil {
+		return err
+	}
+
+	logger := logFor(ctx)
+	for _, problem := range report.Problems {
+		logger.Warn("Storage problem", "kind", problem.Kind, "key", problem.Key, "file_id", problem.FileId,
+			"expected", problem.Expected, "actual", problem.Actual, "repaired", problem.Repaired)
+	}
+	level := slog.LevelInfo
+	if len(report.Problems) > 0 {
+		level = slog.LevelError
+	}
+	logger.Log(ctx, level, "Verified storage", "files", report.Files, "blobs", report.Blobs,
+		"problems", len(report.Problems), "duration", report.FinishedAt.Sub(report.StartedAt))
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/backend-project/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyStorage(t *testing.T) {
+	defer cleanUp()
+
+	app, router := setupTestApp()
+	cookie := registerTestUser(t, router, "test@test.com")
+	ctx := context.Background()
+
+	uploaded := make([]File, 4)
+	for i := range uploaded {
+		w := uploadTestFile(t, router, cookie, fmt.Sprintf("file%d.txt", i), []byte("This is a test file content."), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &uploaded[i]))
+	}
+	runJobs(t, app)
+	assert.NoError(t, app.db.First(&uploaded[2], uploaded[2].ID).Error)
+
+	// one of each problem, the damaged file is the same size so only checksums catch it
+	assert.NoError(t, app.store().Delete(ctx, storageKey(uploaded[0])))
+	_, err := app.store().Put(ctx, storageKey(uploaded[1]), strings.NewReader("short"))
+	assert.NoError(t, err)
+	_, err = app.store().Put(ctx, storageKey(uploaded[2]), strings.NewReader("This is a test file CONTENT."))
+	assert.NoError(t, err)
+	_, err = app.store().Put(ctx, "stray.txt", strings.NewReader("nobody's"))
+	assert.NoError(t, err)
+	// a thumbnail at a size that isn't configured still belongs to its file
+	_, err = app.store().Put(ctx, thumbnailKey(uploaded[3], 999), strings.NewReader("thumbnail"))
+	assert.NoError(t, err)
+
+	report, err := app.verifyStorage(ctx, verifyOptions{OrphanAge: time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Files)
+	assert.Equal(t, 5, report.Blobs)
+	assert.Equal(t, []verifyProblem{
+		{Kind: problemMissing, Key: uploaded[0].FilePath, FileId: uploaded[0].ID},
+		{Kind: problemSizeMismatch, Key: uploaded[1].FilePath, FileId: uploaded[1].ID, Expected: "28", Actual: "5"},
+	}, report.Problems, "checksums aren't compared and the stray blob is too new to be an orphan")
+
+	report, err = app.verifyStorage(ctx, verifyOptions{Checksums: true, QuarantineOrphans: true, MarkBroken: true})
+	assert.NoError(t, err)
+	if assert.Len(t, report.Problems, 4) {
+		assert.Equal(t, problemChecksumMismatch, report.Problems[2].Kind)
+		assert.Equal(t, uploaded[2].Checksum, report.Problems[2].Expected)
+		assert.Equal(t, "marked", report.Problems[2].Repaired)
+		assert.Equal(t, verifyProblem{Kind: problemOrphan, Key: "stray.txt", Actual: "8", Repaired: "quarantined"}, report.Problems[3])
+	}
+	_, err = app.store().Stat(ctx, orphanPrefix+"stray.txt")
+	assert.NoError(t, err)
+
+	var files []File
+	assert.NoError(t, app.db.Order("id").Find(&files).Error)
+	statuses := []string{}
+	for _, file := range files {
+		statuses = append(statuses, file.IntegrityStatus)
+	}
+	assert.Equal(t, []string{problemMissing, problemSizeMismatch, problemChecksumMismatch, ""}, statuses)
+
+	// a file that's put right is unmarked, except that a checksum mismatch needs checksums to clear it
+	_, err = app.store().Put(ctx, storageKey(uploaded[0]), strings.NewReader("This is a test file content."))
+	assert.NoError(t, err)
+	_, err = app.store().Put(ctx, storageKey(uploaded[2]), strings.NewReader("This is a test file content."))
+	assert.NoError(t, err)
+	report, err = app.verifyStorage(ctx, verifyOptions{MarkBroken: true})
+	assert.NoError(t, err)
+	assert.Len(t, report.Problems, 1, "quarantined orphans aren't reported again")
+	assert.NoError(t, app.db.Order("id").Find(&files).Error)
+	assert.Equal(t, "", files[0].IntegrityStatus)
+	assert.Equal(t, problemChecksumMismatch, files[2].IntegrityStatus)
+	_, err = app.verifyStorage(ctx, verifyOptions{Checksums: true, MarkBroken: true})
+	assert.NoError(t, err)
+	assert.NoError(t, app.db.First(&files[2], uploaded[2].ID).Error)
+	assert.Equal(t, "", files[2].IntegrityStatus)
+
+	// the command's JSON report
+	var output bytes.Buffer
+	err = app.verifyFiles(ctx, verifyOptions{}, true, &output)
+	assert.Error(t, err)
+	var printed verifyReport
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &printed))
+	assert.Equal(t, 4, printed.Files)
+	if assert.Len(t, printed.Problems, 1) {
+		assert.Equal(t, problemSizeMismatch, printed.Problems[0].Kind)
+	}
+}
+
+func TestScheduledStorageVerify(t *testing.T) {
+	defer cleanUp()
+
+	app, _ := setupTestApp()
+	ctx := context.Background()
+	app.config.Verify.Interval = time.Hour
+
+	// every server schedules the same run
+	assert.NoError(t, app.scheduleStorageVerify(ctx, time.Now()))
+	assert.NoError(t, app.scheduleStorageVerify(ctx, time.Now()))
+	var scheduled []jobs.Job
+	assert.NoError(t, app.db.Where("type = ?", jobVerifyStorage).Find(&scheduled).Error)
+	if assert.Len(t, scheduled, 1) {
+		assert.Equal(t, time.Now().Truncate(time.Hour).Add(time.Hour).Unix(), scheduled[0].RunAt.Unix())
+	}
+
+	// running it, even early, queues the one after
+	assert.NoError(t, app.db.Model(&jobs.Job{}).Where("id = ?", scheduled[0].ID).Update("run_at", time.Now().Add(-time.Minute)).Error)
+	ran, err := app.jobs.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.True(t, ran)
+	assert.NoError(t, app.db.Where("type = ?", jobVerifyStorage).Order("id").Find(&scheduled).Error)
+	if assert.Len(t, scheduled, 2) {
+		assert.Equal(t, jobs.StatusSucceeded, scheduled[0].Status)
+		assert.Equal(t, jobs.StatusPending, scheduled[1].Status)
+	}
+
+	app.config.Verify.Interval = 0
+	assert.NoError(t, app.db.Where("type = ?", jobVerifyStorage).Delete(&jobs.Job{}).Error)
+	assert.NoError(t, app.scheduleStorageVerify(ctx, time.Now()))
+	var count int64
+	assert.NoError(t, app.db.Model(&jobs.Job{}).Where("type = ?", jobVerifyStorage).Count(&count).Error)
+	assert.Zero(t, count)
+}
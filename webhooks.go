@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/backend-project/auth"
+	"github.com/backend-project/jobs"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Event types that webhooks can subscribe to.
+const (
+	eventFileCreated    = "file.created"
+	eventFileUpdated    = "file.updated"
+	eventFileDeleted    = "file.deleted"
+	eventFileRestored   = "file.restored"
+	eventFilePurged     = "file.purged"
+	eventUserRegistered = "user.registered"
+)
+
+var eventTypes = []string{eventFileCreated, eventFileUpdated, eventFileDeleted, eventFileRestored, eventFilePurged, eventUserRegistered}
+
+const (
+	jobDeliverWebhook = "webhook.deliver"
+
+	webhookMaxAttempts = 8
+
+	// only the start of a response is kept in the delivery log
+	webhookResponseLimit = 1024
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// event is the body posted to webhooks.
+type event struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type deliveryJobPayload struct {
+	DeliveryId uint `json:"delivery_id"`
+}
+
+// registeredUser is the data sent with user.registered, without the password hash.
+type registeredUser struct {
+	ID        uint      `json:"id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// subscribes reports whether the webhook wants events of eventType.
+func (webhook Webhook) subscribes(eventType string) bool {
+	for _, subscribed := range strings.Split(webhook.Events, ",") {
+		if subscribed == "*" || subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhook signs a delivery the way receivers check it: HMAC-SHA256 of "<timestamp>.<body>".
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// publishEvent records an event as part of tx, queueing a delivery for every webhook subscribed to it.
+// Deliveries only go out if tx commits.
+func (app *App) publishEvent(tx *gorm.DB, eventType string, data any) error {
+	var webhooks []Webhook
+	if err := tx.Find(&webhooks).Error; err != nil {
+		return err
+	}
+
+	envelope := event{Id: uuid.New().String(), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+	var payload []byte
+	for _, webhook := range webhooks {
+		if !webhook.subscribes(eventType) {
+			continue
+		}
+
+		// every webhook gets the same body, so it only needs encoding once
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(envelope); err != nil {
+				return err
+			}
+		}
+
+		delivery := WebhookDelivery{WebhookId: webhook.ID, EventId: envelope.Id, Event: eventType, Payload: string(payload), Status: deliveryPending}
+		if err := app.queueDelivery(tx, &delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishFileEvent publishes an event carrying the file as it is now in tx, deleted or not,
+// to webhooks and to the change log /events streams from.
+func (app *App) publishFileEvent(tx *gorm.DB, eventType string, fileId uint) error {
+	var file File
+	if err := tx.Unscoped().Preload("Tags").First(&file, fileId).Error; err != nil {
+		return err
+	}
+	if err := app.appendChangeEvent(tx, eventType, file); err != nil {
+		return err
+	}
+	return app.publishEvent(tx, eventType, file)
+}
+
+// publishEventLater publishes an event for a change that has already been saved.
+// The change can't be undone, so failing to publish is only logged.
+func (app *App) publishEventLater(ctx context.Context, eventType string, data any) {
+	err := app.transaction(ctx, func(tx *gorm.DB) error {
+		return app.publishEvent(tx, eventType, data)
+	})
+	if err != nil {
+		logFor(ctx).Error("Publishing event failed", "event", eventType, "error", err)
+	}
+}
+
+func (app *App) queueDelivery(tx *gorm.DB, delivery *WebhookDelivery) error {
+	if err := tx.Create(delivery).Error; err != nil {
+		return err
+	}
+
+	_, err := app.jobs.EnqueueTx(tx, jobs.Spec{
+		Type:           jobDeliverWebhook,
+		Payload:        deliveryJobPayload{DeliveryId: delivery.ID},
+		IdempotencyKey: fmt.Sprintf("%s:%d", jobDeliverWebhook, delivery.ID),
+		MaxAttempts:    webhookMaxAttempts,
+	})
+	return err
+}
+
+// deliverWebhook posts a delivery to its webhook. Anything but a 2xx response fails the job,
+// so the queue retries it with backoff until it runs out of attempts.
+func (app *App) deliverWebhook(ctx context.Context, job jobs.Job) error {
+	var payload deliveryJobPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+
+	var delivery WebhookDelivery
+	err := app.db.WithContext(ctx).First(&delivery, payload.DeliveryId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var webhook Webhook
+	err = app.db.WithContext(ctx).First(&webhook, delivery.WebhookId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return app.db.WithContext(ctx).Model(&delivery).
+			Updates(map[string]any{"status": deliveryFailed, "last_error": "webhook was deleted"}).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	responseStatus, responseBody, sendErr := sendWebhook(ctx, webhook, delivery)
+
+	updates := map[string]any{
+		"attempts":        gorm.Expr("attempts + 1"),
+		"response_status": responseStatus,
+		"response_body":   responseBody,
+		"last_error":      "",
+	}
+	switch {
+	case sendErr == nil:
+		updates["status"] = deliveryDelivered
+		updates["delivered_at"] = time.Now()
+	case job.Attempts >= job.MaxAttempts:
+		updates["status"] = deliveryFailed
+		updates["last_error"] = sendErr.Error()
+	default:
+		updates["last_error"] = sendErr.Error()
+	}
+	if err := app.db.WithContext(ctx).Model(&delivery).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	return sendErr
+}
+
+// sendWebhook makes one attempt at a delivery, returning the response status and the start of its body.
+func sendWebhook(ctx context.Context, webhook Webhook, delivery WebhookDelivery) (int, string, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "backend-project-webhooks")
+	request.Header.Set("X-Webhook-Event", delivery.Event)
+	request.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set("X-Webhook-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, signWebhook(webhook.Secret, timestamp, body)))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, webhookResponseLimit))
+	// drain what's left so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 1<<20))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, string(responseBody), fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return response.StatusCode, string(responseBody), nil
+}
+
+func (app *App) getWebhooks(c *gin.Context) {
+	webhooks, err := gorm.G[Webhook](app.db).Order("id").Find(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func (app *App) createWebhook(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	var request webhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https url"})
+		return
+	}
+
+	if len(request.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "events is required"})
+		return
+	}
+	for _, eventType := range request.Events {
+		if eventType != "*" && !slices.Contains(eventTypes, eventType) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown event " + strconv.Quote(eventType)})
+			return
+		}
+	}
+
+	secret, err := auth.RandomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhook := Webhook{URL: target.String(), Events: strings.Join(request.Events, ","), Secret: secret, UserId: user.ID}
+	if err := gorm.G[Webhook](app.db).Create(c, &webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	app.audit(c, "webhook.create", webhook.ID, nil, webhook)
+
+	webhook.SigningSecret = secret
+	c.JSON(http.StatusCreated, webhook)
+}
+
+func (app *App) deleteWebhook(c *gin.Context) {
+	webhook, err := gorm.G[Webhook](app.db).Where("id = ?", c.Param("id")).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	if _, err := gorm.G[Webhook](app.db).Where("id = ?", webhook.ID).Delete(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "webhook.delete", webhook.ID, webhook, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// getWebhookDeliveries is the delivery log for a webhook, newest first.
+func (app *App) getWebhookDeliveries(c *gin.Context) {
+	if _, err := gorm.G[Webhook](app.db).Where("id = ?", c.Param("id")).First(c); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	var deliveries []WebhookDelivery
+	err := app.db.WithContext(c).Scopes(Paginate(c.Request)).
+		Where("webhook_id = ?", c.Param("id")).Order("id DESC").Find(&deliveries).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// redeliverWebhook sends a past delivery's event again, as a new delivery.
+func (app *App) redeliverWebhook(c *gin.Context) {
+	previous, err := gorm.G[WebhookDelivery](app.db).
+		Where("id = ? AND webhook_id = ?", c.Param("deliveryId"), c.Param("id")).First(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+	if _, err := gorm.G[Webhook](app.db).Where("id = ?", previous.WebhookId).First(c); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	delivery := WebhookDelivery{
+		WebhookId: previous.WebhookId,
+		EventId:   previous.EventId,
+		Event:     previous.Event,
+		Payload:   previous.Payload,
+		Status:    deliveryPending,
+	}
+	err = app.transaction(c, func(tx *gorm.DB) error {
+		return app.queueDelivery(tx, &delivery)
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	app.audit(c, "webhook.redeliver", previous.WebhookId, nil, gin.H{"delivery_id": delivery.ID, "event_id": delivery.EventId})
+
+	c.JSON(http.StatusCreated, delivery)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	defer cleanUp()
+
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("thanks"))
+	}))
+	defer receiver.Close()
+
+	app, router := setupTestApp()
+	app.jobs.BaseBackoff = time.Nanosecond
+	app.jobs.MaxBackoff = time.Nanosecond
+	adminCookie := registerTestUser(t, router, "damien.z.hall@gmail.com")
+
+	w := performJSON(router, "POST", "/admin/webhooks", webhookRequest{URL: receiver.URL, Events: []string{eventFileCreated, eventUserRegistered}}, adminCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var webhook Webhook
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &webhook))
+	assert.NotEmpty(t, webhook.SigningSecret)
+
+	w = performJSON(router, "POST", "/admin/webhooks", webhookRequest{URL: "ftp://example.com", Events: []string{"*"}}, adminCookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performJSON(router, "POST", "/admin/webhooks", webhookRequest{URL: receiver.URL, Events: []string{"file.exploded"}}, adminCookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the secret isn't shown again
+	w = performJSON(router, "GET", "/admin/webhooks", nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), webhook.SigningSecret)
+
+	registerTestUser(t, router, "test@test.com")
+	w = uploadTestFile(t, router, nil, "testfile.txt", []byte("This is a test file content."), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// not subscribed to
+	w = performJSON(router, "DELETE", "/files/1", nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	runJobs(t, app)
+
+	mu.Lock()
+	assert.Len(t, received, 3)
+	var events []event
+	for i, r := range received {
+		var e event
+		assert.NoError(t, json.Unmarshal(bodies[i], &e))
+		events = append(events, e)
+
+		var timestamp int64
+		var signature string
+		_, err := fmt.Sscanf(strings.Replace(r.Header.Get("X-Webhook-Signature"), ",v1=", " ", 1), "t=%d %s", &timestamp, &signature)
+		assert.NoError(t, err)
+		assert.Equal(t, signWebhook(webhook.SigningSecret, timestamp, bodies[i]), signature)
+		assert.Equal(t, e.Type, r.Header.Get("X-Webhook-Event"))
+	}
+	mu.Unlock()
+
+	// the first attempt failed and was retried with the same event
+	eventIds := map[string][]string{}
+	for _, e := range events {
+		eventIds[e.Type] = append(eventIds[e.Type], e.Id)
+	}
+	assert.Len(t, eventIds[eventUserRegistered], 2)
+	assert.Equal(t, eventIds[eventUserRegistered][0], eventIds[eventUserRegistered][1])
+	assert.Len(t, eventIds[eventFileCreated], 1)
+	assert.Equal(t, "test@test.com", events[0].Data.(map[string]any)["email"])
+
+	var deliveries []WebhookDelivery
+	w = performJSON(router, "GET", fmt.Sprintf("/admin/webhooks/%d/deliveries", webhook.ID), nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, eventUserRegistered, deliveries[1].Event)
+	assert.Equal(t, deliveryDelivered, deliveries[1].Status)
+	assert.Equal(t, 2, deliveries[1].Attempts)
+	assert.Equal(t, "thanks", deliveries[1].ResponseBody)
+
+	w = performJSON(router, "POST", fmt.Sprintf("/admin/webhooks/%d/deliveries/%d/redeliver", webhook.ID, deliveries[0].ID), nil, adminCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	runJobs(t, app)
+	mu.Lock()
+	assert.Len(t, received, 4)
+	assert.Equal(t, deliveries[0].Payload, string(bodies[3]))
+	mu.Unlock()
+
+	w = performJSON(router, "DELETE", fmt.Sprintf("/admin/webhooks/%d", webhook.ID), nil, adminCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", "/admin/webhooks", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}